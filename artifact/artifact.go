@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package artifact records what is created for a container outside of its
+// spec, the network links in its network namespace and the files in its
+// rootfs, so it is removed once the container is stopped or deleted.
+//
+// Each container has a record file, named after its ID. The cleanup removes
+// the artifacts and then the record, so running it again does nothing.
+package artifact
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/atomicfile"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultDir is the default records directory.
+const DefaultDir = "/run/habana-container-runtime/containers"
+
+// Record is what was created for a container.
+type Record struct {
+	Container string `json:"container"`
+	// Path of the network namespace of the container, when it outlives the
+	// container, i.e the one of a pod.
+	NetNS string `json:"netns,omitempty"`
+	// Names of the macvlan links exposing the devices network interfaces in
+	// NetNS.
+	Links []string `json:"links,omitempty"`
+	// Absolute path of the container rootfs.
+	Rootfs string `json:"rootfs,omitempty"`
+	// Absolute paths of the files created in Rootfs.
+	Files []string `json:"files,omitempty"`
+}
+
+// Store holds the records of the host.
+type Store struct {
+	dir string
+}
+
+// NewStore returns the store of the records in dir, created on first use.
+func NewStore(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Store{dir: dir}
+}
+
+// path returns the record file of the container.
+func (s *Store) path(container string) (string, error) {
+	if container == "" || container == "." || container == ".." || strings.ContainsRune(container, '/') {
+		return "", fmt.Errorf("invalid container ID %q", container)
+	}
+	return filepath.Join(s.dir, container+".json"), nil
+}
+
+// Add merges r into the record of its container, so the artifacts of a
+// container whose spec is applied again, i.e on restore, are all kept.
+func (s *Store) Add(r Record) error {
+	name, err := s.path(r.Container)
+	if err != nil {
+		return err
+	}
+	prev, err := s.Load(r.Container)
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		if r.NetNS == "" {
+			r.NetNS = prev.NetNS
+		}
+		if r.Rootfs == "" {
+			r.Rootfs = prev.Rootfs
+		}
+		r.Links = merge(prev.Links, r.Links)
+		r.Files = merge(prev.Files, r.Files)
+	}
+
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding artifacts: %w", err)
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("creating artifacts directory: %w", err)
+	}
+	if err := atomicfile.WriteFile(name, content, 0600); err != nil {
+		return fmt.Errorf("writing artifacts: %w", err)
+	}
+	return nil
+}
+
+func merge(a, b []string) []string {
+	res := slices.Clone(a)
+	for _, s := range b {
+		if !slices.Contains(res, s) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// Load returns the record of the container, or nil when there is none.
+func (s *Store) Load(container string) (*Record, error) {
+	name, err := s.path(container)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading artifacts: %w", err)
+	}
+	var r Record
+	if err := json.Unmarshal(content, &r); err != nil {
+		return nil, fmt.Errorf("decoding artifacts: %w", err)
+	}
+	return &r, nil
+}
+
+// Cleanup removes the artifacts of the container, and then its record. The
+// ones already removed are skipped, and the record is kept when some could
+// not be removed, for the next cleanup.
+func (s *Store) Cleanup(container string) error {
+	r, err := s.Load(container)
+	if err != nil || r == nil {
+		return err
+	}
+
+	var errs []error
+	if r.NetNS != "" && len(r.Links) != 0 {
+		if err := deleteLinks(r.NetNS, r.Links); err != nil {
+			errs = append(errs, fmt.Errorf("deleting links in %s: %w", r.NetNS, err))
+		}
+	}
+	for _, f := range r.Files {
+		if err := removeInRoot(r.Rootfs, f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return errors.Join(errs...)
+	}
+
+	name, _ := s.path(container)
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing artifacts: %w", err)
+	}
+	return nil
+}
+
+// removeInRoot removes the file name of the root directory, without following
+// the symlinks of its path: the container can replace the directories holding
+// it with symlinks to the host directories. The files missing, or behind a
+// symlink, are not the ones created and are skipped.
+func removeInRoot(root, name string) error {
+	rel, err := filepath.Rel(root, name)
+	if root == "" || err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("removing %s: not in the container rootfs %q", name, root)
+	}
+
+	dir, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return skipMissing(&fs.PathError{Op: "open", Path: root, Err: err})
+	}
+	defer func() { unix.Close(dir) }()
+
+	parts := strings.Split(rel, "/")
+	for i, part := range parts[:len(parts)-1] {
+		next, err := unix.Openat(dir, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return skipMissing(&fs.PathError{Op: "open", Path: filepath.Join(root, filepath.Join(parts[:i+1]...)), Err: err})
+		}
+		unix.Close(dir)
+		dir = next
+	}
+
+	if err := unix.Unlinkat(dir, parts[len(parts)-1], 0); err != nil {
+		return skipMissing(&fs.PathError{Op: "remove", Path: name, Err: err})
+	}
+	return nil
+}
+
+// skipMissing returns nil for the errors of paths which are missing or go
+// through a symlink.
+func skipMissing(err error) error {
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ELOOP) || errors.Is(err, unix.ENOTDIR) {
+		return nil
+	}
+	return err
+}
+
+// deleteLinks is replaced in tests, as it needs privileges.
+var deleteLinks = deleteLinksFunc
+
+// deleteLinksFunc deletes the passthru macvlan links of the namespace with
+// the names. Other links with the same names, i.e the host interfaces in a
+// host network namespace, are kept.
+func deleteLinksFunc(netnsPath string, names []string) error {
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		// The namespace is gone with its links.
+		if errors.As(err, &ns.NSPathNotExistErr{}) {
+			return nil
+		}
+		return err
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		for _, name := range names {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				if errors.As(err, &netlink.LinkNotFoundError{}) {
+					continue
+				}
+				return err
+			}
+			macvlan, ok := link.(*netlink.Macvlan)
+			if !ok || macvlan.Mode != netlink.MACVLAN_MODE_PASSTHRU {
+				continue
+			}
+			if err := netlink.LinkDel(link); err != nil {
+				return fmt.Errorf("deleting link %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package artifact
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAddCleanup(t *testing.T) {
+	var deleted [][]string
+	t.Cleanup(func() { deleteLinks = deleteLinksFunc })
+	deleteLinks = func(netns string, names []string) error {
+		deleted = append(deleted, append([]string{netns}, names...))
+		return nil
+	}
+
+	rootfs := t.TempDir()
+	files := []string{filepath.Join(rootfs, "macAddrInfo.json"), filepath.Join(rootfs, "gaudinet.json")}
+	for _, f := range files {
+		if err := os.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewStore(filepath.Join(t.TempDir(), "containers"))
+	if err := s.Add(Record{Container: "a", NetNS: "/var/run/netns/pod", Links: []string{"eth0"}, Rootfs: rootfs, Files: files[:1]}); err != nil {
+		t.Fatal(err)
+	}
+	// Applying the spec again merges the artifacts.
+	if err := s.Add(Record{Container: "a", Links: []string{"eth0", "eth1"}, Files: files[1:]}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Record{Container: "a", NetNS: "/var/run/netns/pod", Links: []string{"eth0", "eth1"}, Rootfs: rootfs, Files: files}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got record %+v, want %+v", got, want)
+	}
+
+	// The second cleanup, i.e on delete after poststop, does nothing.
+	for i := 0; i < 2; i++ {
+		if err := s.Cleanup("a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := [][]string{{"/var/run/netns/pod", "eth0", "eth1"}}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("got deleted links %v, want %v", deleted, want)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("file %s not removed: %v", f, err)
+		}
+	}
+	if got, err := s.Load("a"); got != nil || err != nil {
+		t.Errorf("got record %+v, error %v after cleanup, want none", got, err)
+	}
+
+	// Containers without a record have nothing to clean.
+	if err := s.Cleanup("b"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCleanupSymlinks(t *testing.T) {
+	// The container replaced the directory of its files with a symlink to a
+	// host directory, and its file with a symlink to a host file.
+	host := t.TempDir()
+	hostFile := filepath.Join(host, "macAddrInfo.json")
+	if err := os.WriteFile(hostFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(host, filepath.Join(rootfs, "etc/habanalabs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(hostFile, filepath.Join(rootfs, "etc/gaudinet.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStore(t.TempDir())
+	files := []string{filepath.Join(rootfs, "etc/habanalabs/macAddrInfo.json"), filepath.Join(rootfs, "etc/gaudinet.json")}
+	if err := s.Add(Record{Container: "a", Rootfs: rootfs, Files: files}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Cleanup("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(hostFile); err != nil {
+		t.Errorf("host file removed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, "etc/gaudinet.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("symlink in the rootfs not removed: %v", err)
+	}
+	if got, err := s.Load("a"); got != nil || err != nil {
+		t.Errorf("got record %+v, error %v after cleanup, want none", got, err)
+	}
+
+	// Files outside of the rootfs are never removed.
+	if err := s.Add(Record{Container: "b", Rootfs: rootfs, Files: []string{hostFile}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Cleanup("b"); err == nil {
+		t.Error("got no error, want the file outside of the rootfs refused")
+	}
+	if _, err := os.Stat(hostFile); err != nil {
+		t.Errorf("host file removed: %v", err)
+	}
+}
+
+func TestCleanupFailureKeepsRecord(t *testing.T) {
+	t.Cleanup(func() { deleteLinks = deleteLinksFunc })
+	deleteLinks = func(string, []string) error { return errors.New("permission denied") }
+
+	s := NewStore(t.TempDir())
+	if err := s.Add(Record{Container: "a", NetNS: "/var/run/netns/pod", Links: []string{"eth0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Cleanup("a"); err == nil {
+		t.Fatal("got no error, want the links deletion failure")
+	}
+	if got, err := s.Load("a"); got == nil || err != nil {
+		t.Errorf("got record %+v, error %v, want it kept", got, err)
+	}
+}
+
+func TestInvalidContainer(t *testing.T) {
+	s := NewStore(t.TempDir())
+	for _, id := range []string{"", "..", "../a"} {
+		if err := s.Add(Record{Container: id}); err == nil {
+			t.Errorf("%q: got no error, want invalid container ID", id)
+		}
+	}
+}
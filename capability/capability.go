@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package capability parses the HABANA_DRIVER_CAPABILITIES values, the classes
+// of driver files injected in a container with its devices.
+//
+// A value is a comma separated list of classes:
+//
+//	compute   accel device nodes
+//	control   accel_controlD device nodes, for monitoring
+//	rdma      infiniband uverbs device nodes
+//	network   scale-out network interfaces, and the macAddrInfo and gaudinet files
+//	utility   host tools
+//	all       all the classes
+//
+// An empty value is Default.
+package capability
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/discover"
+)
+
+// Set is a set of capability classes.
+type Set uint8
+
+const (
+	Compute Set = 1 << iota
+	Control
+	RDMA
+	Network
+	Utility
+
+	// Default is what a container gets when it does not set its capabilities.
+	Default = Compute | Control | RDMA | Network
+	All     = Default | Utility
+)
+
+// names are the classes names, in the order of Set.String.
+var names = []struct {
+	name string
+	set  Set
+}{
+	{"compute", Compute},
+	{"control", Control},
+	{"rdma", RDMA},
+	{"network", Network},
+	{"utility", Utility},
+}
+
+// Parse parses a HABANA_DRIVER_CAPABILITIES value.
+func Parse(value string) (Set, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return Default, nil
+	}
+
+	var s Set
+	for _, class := range strings.Split(value, ",") {
+		class = strings.TrimSpace(class)
+		if class == "all" {
+			s |= All
+			continue
+		}
+		found := false
+		for _, n := range names {
+			if n.name == class {
+				s |= n.set
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid driver capability %q in %q", class, value)
+		}
+	}
+	return s, nil
+}
+
+// Has reports whether all the classes of c are in s.
+func (s Set) Has(c Set) bool {
+	return s&c == c
+}
+
+// UnmarshalText parses the set of a config value like Parse, except that an
+// empty value is the empty set, which all the sets have.
+func (s *Set) UnmarshalText(text []byte) error {
+	if strings.TrimSpace(string(text)) == "" {
+		*s = 0
+		return nil
+	}
+	v, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
+
+// MarshalText returns the set in the HABANA_DRIVER_CAPABILITIES format.
+func (s Set) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// DevicePaths returns the device nodes of the accelerator in the set, accel
+// for Compute and accel_controlD for Control.
+func (s Set) DevicePaths(acc discover.Accelerator) []string {
+	var paths []string
+	if s.Has(Compute) {
+		paths = append(paths, acc.AccelPath)
+	}
+	if s.Has(Control) {
+		paths = append(paths, acc.ControlPath)
+	}
+	return paths
+}
+
+// String returns the set in the HABANA_DRIVER_CAPABILITIES format.
+func (s Set) String() string {
+	var classes []string
+	for _, n := range names {
+		if s.Has(n.set) {
+			classes = append(classes, n.name)
+		}
+	}
+	return strings.Join(classes, ",")
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package capability
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/discover"
+)
+
+func TestParse(t *testing.T) {
+	for value, want := range map[string]string{
+		"":                       "compute,control,rdma,network",
+		"control":                "control",
+		"utility, control":       "control,utility",
+		"compute,compute":        "compute",
+		"all":                    "compute,control,rdma,network,utility",
+		"network,rdma,all":       "compute,control,rdma,network,utility",
+		"compute,control,rdma\n": "compute,control,rdma",
+	} {
+		s, err := Parse(value)
+		if err != nil {
+			t.Fatalf("%q: %v", value, err)
+		}
+		if s.String() != want {
+			t.Errorf("%q: got %q, want %q", value, s.String(), want)
+		}
+	}
+
+	for _, value := range []string{"graphics", "compute,", "compute,ngx", "none"} {
+		if _, err := Parse(value); err == nil {
+			t.Errorf("%q: got no error", value)
+		}
+	}
+}
+
+func TestUnmarshalText(t *testing.T) {
+	for value, want := range map[string]Set{
+		"":             0,
+		"rdma":         RDMA,
+		"rdma,network": RDMA | Network,
+		"all":          All,
+	} {
+		var s Set
+		if err := s.UnmarshalText([]byte(value)); err != nil {
+			t.Fatalf("%q: %v", value, err)
+		}
+		if s != want {
+			t.Errorf("%q: got %s, want %s", value, s, want)
+		}
+		if text, _ := s.MarshalText(); value != "all" && string(text) != value {
+			t.Errorf("%q: marshaled as %q", value, text)
+		}
+	}
+
+	var s Set
+	if err := s.UnmarshalText([]byte("graphics")); err == nil {
+		t.Error("got no error for an invalid class")
+	}
+	// The empty set is a condition all the sets meet.
+	if !Control.Has(s) {
+		t.Error("want the empty set in all the sets")
+	}
+}
+
+func TestHas(t *testing.T) {
+	s := Control | Utility
+	if !s.Has(Control) || !s.Has(Control|Utility) {
+		t.Errorf("%s: want control and utility", s)
+	}
+	if s.Has(Compute) || s.Has(Control|RDMA) {
+		t.Errorf("%s: want no compute nor rdma", s)
+	}
+}
+
+func TestDevicePaths(t *testing.T) {
+	acc := discover.Accelerator{AccelPath: "/dev/accel/accel0", ControlPath: "/dev/accel/accel_controlD0"}
+	for s, want := range map[Set][]string{
+		Default: {"/dev/accel/accel0", "/dev/accel/accel_controlD0"},
+		Control: {"/dev/accel/accel_controlD0"},
+		RDMA:    nil,
+	} {
+		if got := s.DevicePaths(acc); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cdi
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseQualifiedName(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantKind string
+		wantName string
+		expError bool
+	}{
+		{in: "habana.ai/gaudi=0", wantKind: "habana.ai/gaudi", wantName: "0"},
+		{in: "habana.ai/gaudi=0000:4d:00.0", wantKind: "habana.ai/gaudi", wantName: "0000:4d:00.0"},
+		{in: "habana.ai/gaudi=all", wantKind: "habana.ai/gaudi", wantName: "all"},
+		{in: "habana.ai/gaudi", expError: true},
+		{in: "gaudi=0", expError: true},
+		{in: "habana.ai/gaudi=", expError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			kind, name, err := ParseQualifiedName(tt.in)
+			if tt.expError {
+				if err == nil {
+					t.Fatal("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got: %v", err)
+			}
+			if kind != tt.wantKind || name != tt.wantName {
+				t.Errorf("got (%q, %q), want (%q, %q)", kind, name, tt.wantKind, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestRegistryResolve(t *testing.T) {
+	reg, err := NewRegistry([]string{"testdata/etc", "testdata/run", "testdata/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantNames := []string{"habana.ai/gaudi=0", "habana.ai/gaudi=1", "habana.ai/gaudi=all"}
+	if got := reg.DeviceNames(); !reflect.DeepEqual(got, wantNames) {
+		t.Errorf("got devices %v, want %v", got, wantNames)
+	}
+
+	t.Run("spec edits are added once", func(t *testing.T) {
+		edits, err := reg.Resolve([]string{"habana.ai/gaudi=0", "habana.ai/gaudi=all", "habana.ai/gaudi=0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(edits.Env, []string{"HABANA_CDI=1"}) {
+			t.Errorf("got env %v", edits.Env)
+		}
+		if len(edits.DeviceNodes) != 5 {
+			t.Errorf("got %d device nodes, want 5", len(edits.DeviceNodes))
+		}
+	})
+
+	t.Run("later directory overrides device", func(t *testing.T) {
+		edits, err := reg.Resolve([]string{"habana.ai/gaudi=1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(edits.DeviceNodes) != 2 || len(edits.Mounts) != 1 {
+			t.Errorf("got %d nodes and %d mounts, want 2 and 1", len(edits.DeviceNodes), len(edits.Mounts))
+		}
+		if len(edits.Env) != 0 {
+			t.Errorf("got env %v, want none", edits.Env)
+		}
+	})
+
+	t.Run("unknown device", func(t *testing.T) {
+		if _, err := reg.Resolve([]string{"habana.ai/gaudi=7"}); err == nil {
+			t.Error("expected an error, got none")
+		}
+	})
+}
+
+func TestWriteSpecRoundTrip(t *testing.T) {
+	mode := uint32(0)
+	spec := &Spec{
+		Version: CurrentVersion,
+		Kind:    "habana.ai/gaudi",
+		Devices: []Device{
+			{
+				Name: "0",
+				ContainerEdits: ContainerEdits{
+					DeviceNodes: []*DeviceNode{{Path: "/dev/accel/accel0", Major: 510, Minor: 0, GID: &mode}},
+				},
+			},
+		},
+	}
+
+	for _, name := range []string{"habana.yaml", "habana.json"} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), name)
+			if err := WriteSpec(file, spec); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadSpec(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, spec) {
+				t.Errorf("got %+v, want %+v", got, spec)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cdi
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// AnnotationPrefix is the prefix of the OCI spec annotations used by container
+// engines to request CDI devices.
+const AnnotationPrefix = "cdi.k8s.io/"
+
+type entry struct {
+	spec   *Spec
+	device *Device
+}
+
+// Registry holds the devices of all the spec files found in a set of directories.
+type Registry struct {
+	devices map[string]entry
+}
+
+// NewRegistry loads all the spec files in dirs. When the same device is defined
+// in more than one directory, the one from the later directory wins.
+func NewRegistry(dirs []string) (*Registry, error) {
+	r := &Registry{devices: make(map[string]entry)}
+
+	for _, dir := range dirs {
+		files, err := specFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := make(map[string]string)
+		for _, file := range files {
+			spec, err := ReadSpec(file)
+			if err != nil {
+				return nil, err
+			}
+			for i := range spec.Devices {
+				name := QualifiedName(spec.Kind, spec.Devices[i].Name)
+				if other, ok := seen[name]; ok {
+					return nil, fmt.Errorf("device %q defined in both %s and %s", name, other, file)
+				}
+				seen[name] = file
+				r.devices[name] = entry{spec: spec, device: &spec.Devices[i]}
+			}
+		}
+	}
+
+	return r, nil
+}
+
+func specFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("reading CDI spec dir: %w", err)
+	}
+
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".json", ".yaml", ".yml":
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// DeviceNames returns the qualified names of all known devices, sorted.
+func (r *Registry) DeviceNames() []string {
+	names := make([]string, 0, len(r.devices))
+	for name := range r.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Resolve returns the merged container edits of the requested devices. The
+// spec-level edits of every spec involved are included once, before the device
+// edits. An unknown device is an error.
+func (r *Registry) Resolve(devices []string) (ContainerEdits, error) {
+	var edits ContainerEdits
+	specs := make(map[*Spec]bool)
+	resolved := make(map[string]bool)
+
+	for _, name := range devices {
+		if resolved[name] {
+			continue
+		}
+		if _, _, err := ParseQualifiedName(name); err != nil {
+			return ContainerEdits{}, err
+		}
+		e, ok := r.devices[name]
+		if !ok {
+			return ContainerEdits{}, fmt.Errorf("unresolvable CDI device %q", name)
+		}
+		resolved[name] = true
+
+		if !specs[e.spec] {
+			specs[e.spec] = true
+			edits.Append(e.spec.ContainerEdits)
+		}
+		edits.Append(e.device.ContainerEdits)
+	}
+
+	return edits, nil
+}
+
+// QualifiedName returns the fully qualified name of a device, vendor/class=name.
+func QualifiedName(kind, name string) string {
+	return kind + "=" + name
+}
+
+// ParseQualifiedName splits vendor/class=name into its kind and device name.
+func ParseQualifiedName(device string) (string, string, error) {
+	kind, name, ok := strings.Cut(device, "=")
+	if !ok || !kindRe.MatchString(kind) || !deviceNameRe.MatchString(name) {
+		return "", "", fmt.Errorf("invalid qualified CDI device name %q", device)
+	}
+	return kind, name, nil
+}
+
+// IsQualifiedName reports whether device is a fully qualified CDI device name.
+func IsQualifiedName(device string) bool {
+	_, _, err := ParseQualifiedName(device)
+	return err == nil
+}
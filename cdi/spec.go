@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cdi reads, writes and resolves Container Device Interface spec files.
+// See https://github.com/cncf-tags/container-device-interface/blob/main/SPEC.md
+package cdi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/atomicfile"
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion is the CDI spec version written by this package.
+const CurrentVersion = "0.6.0"
+
+var (
+	kindRe       = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9.\-]*/[a-zA-Z0-9][a-zA-Z0-9_.\-]*$`)
+	deviceNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.:\-]*$`)
+)
+
+// Spec is the content of a single CDI spec file.
+type Spec struct {
+	Version        string            `json:"cdiVersion" yaml:"cdiVersion"`
+	Kind           string            `json:"kind" yaml:"kind"`
+	Annotations    map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	Devices        []Device          `json:"devices" yaml:"devices"`
+	ContainerEdits ContainerEdits    `json:"containerEdits,omitempty" yaml:"containerEdits,omitempty"`
+}
+
+// Device is a single named device of a spec.
+type Device struct {
+	Name           string            `json:"name" yaml:"name"`
+	Annotations    map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	ContainerEdits ContainerEdits    `json:"containerEdits" yaml:"containerEdits"`
+}
+
+// ContainerEdits are the modifications applied to the OCI spec of a container
+// requesting a device.
+type ContainerEdits struct {
+	Env            []string      `json:"env,omitempty" yaml:"env,omitempty"`
+	DeviceNodes    []*DeviceNode `json:"deviceNodes,omitempty" yaml:"deviceNodes,omitempty"`
+	Hooks          []*Hook       `json:"hooks,omitempty" yaml:"hooks,omitempty"`
+	Mounts         []*Mount      `json:"mounts,omitempty" yaml:"mounts,omitempty"`
+	AdditionalGIDs []uint32      `json:"additionalGids,omitempty" yaml:"additionalGids,omitempty"`
+}
+
+// DeviceNode is a device node to create inside the container.
+type DeviceNode struct {
+	Path        string       `json:"path" yaml:"path"`
+	HostPath    string       `json:"hostPath,omitempty" yaml:"hostPath,omitempty"`
+	Type        string       `json:"type,omitempty" yaml:"type,omitempty"`
+	Major       int64        `json:"major,omitempty" yaml:"major,omitempty"`
+	Minor       int64        `json:"minor,omitempty" yaml:"minor,omitempty"`
+	FileMode    *os.FileMode `json:"fileMode,omitempty" yaml:"fileMode,omitempty"`
+	Permissions string       `json:"permissions,omitempty" yaml:"permissions,omitempty"`
+	UID         *uint32      `json:"uid,omitempty" yaml:"uid,omitempty"`
+	GID         *uint32      `json:"gid,omitempty" yaml:"gid,omitempty"`
+}
+
+// Mount is a mount to add to the container.
+type Mount struct {
+	HostPath      string   `json:"hostPath" yaml:"hostPath"`
+	ContainerPath string   `json:"containerPath" yaml:"containerPath"`
+	Options       []string `json:"options,omitempty" yaml:"options,omitempty"`
+	Type          string   `json:"type,omitempty" yaml:"type,omitempty"`
+}
+
+// Hook is an OCI hook to add to the container.
+type Hook struct {
+	HookName string   `json:"hookName" yaml:"hookName"`
+	Path     string   `json:"path" yaml:"path"`
+	Args     []string `json:"args,omitempty" yaml:"args,omitempty"`
+	Env      []string `json:"env,omitempty" yaml:"env,omitempty"`
+	Timeout  *int     `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// Append adds the content of other to the edits.
+func (e *ContainerEdits) Append(other ContainerEdits) {
+	e.Env = append(e.Env, other.Env...)
+	e.DeviceNodes = append(e.DeviceNodes, other.DeviceNodes...)
+	e.Hooks = append(e.Hooks, other.Hooks...)
+	e.Mounts = append(e.Mounts, other.Mounts...)
+	e.AdditionalGIDs = append(e.AdditionalGIDs, other.AdditionalGIDs...)
+}
+
+// Validate checks the spec kind, version and device names.
+func (s *Spec) Validate() error {
+	if s.Version == "" {
+		return fmt.Errorf("missing cdiVersion")
+	}
+	if !kindRe.MatchString(s.Kind) {
+		return fmt.Errorf("invalid kind %q", s.Kind)
+	}
+	if len(s.Devices) == 0 {
+		return fmt.Errorf("no devices defined")
+	}
+	names := make(map[string]bool)
+	for _, d := range s.Devices {
+		if !deviceNameRe.MatchString(d.Name) {
+			return fmt.Errorf("invalid device name %q", d.Name)
+		}
+		if names[d.Name] {
+			return fmt.Errorf("duplicate device name %q", d.Name)
+		}
+		names[d.Name] = true
+		for _, n := range d.ContainerEdits.DeviceNodes {
+			if n.Path == "" {
+				return fmt.Errorf("device %q: device node without path", d.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// ReadSpec loads and validates a spec file. The format is selected by the
+// file extension, ".json" for JSON and anything else for YAML.
+func ReadSpec(file string) (*Spec, error) {
+	data, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+
+	var spec Spec
+	if isJSON(file) {
+		err = json.Unmarshal(data, &spec)
+	} else {
+		err = yaml.Unmarshal(data, &spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing CDI spec %s: %w", file, err)
+	}
+
+	if err := spec.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid CDI spec %s: %w", file, err)
+	}
+	return &spec, nil
+}
+
+// WriteSpec writes the spec into file, in JSON or YAML based on the extension.
+// The content is written to a temporary file first and renamed, so readers never
+// see a partial spec.
+func WriteSpec(file string, spec *Spec) error {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+
+	var data []byte
+	var err error
+	if isJSON(file) {
+		data, err = json.MarshalIndent(spec, "", "  ")
+	} else {
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		err = enc.Encode(spec)
+		data = buf.Bytes()
+	}
+	if err != nil {
+		return fmt.Errorf("marshaling CDI spec: %w", err)
+	}
+
+	return atomicfile.WriteFile(file, data, 0644)
+}
+
+func isJSON(file string) bool {
+	return strings.EqualFold(filepath.Ext(file), ".json")
+}
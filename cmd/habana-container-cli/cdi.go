@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/cdi"
+	rtconfig "github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/discover"
+	"github.com/HabanaAI/habana-container-runtime/netinfo"
+
+	"github.com/urfave/cli/v2"
+)
+
+type cdiGenerateConfig struct {
+	// Root of the host file system the devices are discovered from.
+	root string
+	// Directory the spec file is written into.
+	outputDir string
+	// Spec file format, yaml or json.
+	format string
+	// CDI device kind.
+	kind string
+	// Host directory for the generated network information files.
+	netinfoDir string
+	// Gaudinet file path for l3.
+	gaudinetFile string
+}
+
+func cdiCommand(shared *rtconfig.Config) *cli.Command {
+	var cfg cdiGenerateConfig
+
+	return &cli.Command{
+		Name:  "cdi",
+		Usage: "Manage Container Device Interface specs",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "generate",
+				Usage: "Generate a CDI spec for the accelerators of the node",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "output-dir",
+						Usage:       "Directory to write the spec file into",
+						Value:       "/var/run/cdi",
+						Destination: &cfg.outputDir,
+					},
+					&cli.StringFlag{
+						Name:        "format",
+						Usage:       "Spec file format. Supported values are \"yaml\" and \"json\"",
+						Value:       "yaml",
+						Destination: &cfg.format,
+						Action: func(_ *cli.Context, s string) error {
+							if s != "yaml" && s != "json" {
+								return fmt.Errorf("unsupported format %q. valid formats are \"yaml\" and \"json\"", s)
+							}
+							return nil
+						},
+					},
+					&cli.StringFlag{
+						Name:        "kind",
+						Usage:       "CDI device kind, in the vendor/class form",
+						Value:       shared.Runtime.CDI.DefaultKind,
+						Destination: &cfg.kind,
+					},
+					&cli.StringFlag{
+						Name:        "netinfo-dir",
+						Usage:       "Host directory for the generated network information files",
+						Value:       "/run/habana-container-runtime/cdi",
+						Destination: &cfg.netinfoDir,
+					},
+					&cli.StringFlag{
+						Name:        "routes-files",
+						Usage:       "Gaudinet file path",
+						Value:       shared.NetworkL3Config.Path,
+						Destination: &cfg.gaudinetFile,
+					},
+					&cli.StringFlag{
+						Name:        "root",
+						Usage:       "Root of the file system holding /sys and /dev, or a fixture directory",
+						Value:       shared.Runtime.DiscoveryRoot,
+						Destination: &cfg.root,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+					spec, err := generateCDISpec(logger, cfg)
+					if err != nil {
+						return err
+					}
+
+					if err := os.MkdirAll(cfg.outputDir, 0755); err != nil {
+						return err
+					}
+					name := strings.ReplaceAll(cfg.kind, "/", "-") + "." + cfg.format
+					file := filepath.Join(cfg.outputDir, name)
+					if err := cdi.WriteSpec(file, spec); err != nil {
+						return fmt.Errorf("writing CDI spec: %w", err)
+					}
+					fmt.Fprintln(ctx.App.Writer, file)
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// generateCDISpec builds a spec with a device per accelerator, named by its
+// index, its PCI address and its module id, and an 'all' device.
+func generateCDISpec(logger *slog.Logger, cfg cdiGenerateConfig) (*cdi.Spec, error) {
+	root, err := discover.NewRoot(cfg.root)
+	if err != nil {
+		return nil, err
+	}
+	accelerators, err := root.Accelerators()
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &cdi.Spec{
+		Version: cdi.CurrentVersion,
+		Kind:    cfg.kind,
+	}
+
+	var all cdi.ContainerEdits
+	for _, acc := range accelerators {
+		nodes, err := cdiDeviceNodes(root, acc)
+		if err != nil {
+			return nil, err
+		}
+		edits := cdi.ContainerEdits{DeviceNodes: nodes}
+
+		names := []string{acc.ID(), acc.PCIAddress}
+		if acc.ModuleID != "" {
+			names = append(names, "module:"+acc.ModuleID)
+		}
+		for _, name := range names {
+			spec.Devices = append(spec.Devices, cdi.Device{Name: name, ContainerEdits: edits})
+		}
+		all.Append(edits)
+	}
+	spec.Devices = append(spec.Devices, cdi.Device{Name: "all", ContainerEdits: all})
+
+	spec.ContainerEdits.Mounts = netinfoMounts(logger, cfg, accelerators)
+
+	return spec, nil
+}
+
+// cdiDeviceNodes returns the accel, control and uverbs device nodes of the accelerator.
+func cdiDeviceNodes(root *discover.Root, acc discover.Accelerator) ([]*cdi.DeviceNode, error) {
+	devPaths := acc.DevicePaths()
+	if acc.UverbsPath != "" {
+		devPaths = append(devPaths, acc.UverbsPath)
+	}
+
+	var nodes []*cdi.DeviceNode
+	for _, p := range devPaths {
+		info, err := root.DeviceInfo(p)
+		if err != nil {
+			return nil, err
+		}
+		mode := info.FileMode.Perm()
+		nodes = append(nodes, &cdi.DeviceNode{
+			Path:     p,
+			Type:     "c",
+			Major:    int64(info.Major),
+			Minor:    int64(info.Minor),
+			FileMode: &mode,
+		})
+	}
+	return nodes, nil
+}
+
+// netinfoMounts generates the network information files on the host, and
+// returns the mounts exposing them in the containers. Failures only drop the
+// file from the spec, since not all nodes have external ports.
+func netinfoMounts(logger *slog.Logger, cfg cdiGenerateConfig, accelerators []discover.Accelerator) []*cdi.Mount {
+	var mounts []*cdi.Mount
+
+	if err := os.MkdirAll(path.Join(cfg.netinfoDir, "etc"), 0755); err != nil {
+		logger.Warn("creating netinfo directory", "error", err)
+		return nil
+	}
+	err := netinfo.Generate(accelerators, cfg.netinfoDir)
+	if err != nil {
+		logger.Warn("generating macAddrInfo failed", "error", err)
+	}
+	macAddrInfo := path.Join(cfg.netinfoDir, "etc/habanalabs/macAddrInfo.json")
+	if fileExist(macAddrInfo) {
+		mounts = append(mounts, &cdi.Mount{
+			HostPath:      macAddrInfo,
+			ContainerPath: "/etc/habanalabs/macAddrInfo.json",
+			Options:       []string{"ro", "nosuid", "nodev", "bind"},
+		})
+	}
+
+	if cfg.gaudinetFile != "" && fileExist(path.Join(cfg.root, cfg.gaudinetFile)) {
+		mounts = append(mounts, &cdi.Mount{
+			HostPath:      cfg.gaudinetFile,
+			ContainerPath: "/etc/habanalabs/gaudinet.json",
+			Options:       []string{"ro", "nosuid", "nodev", "bind"},
+		})
+	}
+
+	return mounts
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/cdi"
+	"github.com/HabanaAI/habana-container-runtime/discover"
+)
+
+// fakeNode creates a fake sysfs tree under root, with a fixture devices file
+// holding the device nodes with the numbers of the minors map.
+func fakeNode(t *testing.T, files map[string]string, minors map[string]uint32) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nodes := make(map[string]discover.DevInfo)
+	for p, minor := range minors {
+		nodes[p] = discover.DevInfo{Major: 510, Minor: minor, FileMode: 0666}
+	}
+	content, err := json.Marshal(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, discover.FixtureDevicesFile), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return root
+}
+
+func TestGenerateCDISpec(t *testing.T) {
+	root := fakeNode(t, map[string]string{
+		"sys/class/accel/accel0/device/pci_addr":                   "0000:4d:00.0\n",
+		"sys/class/accel/accel0/device/module_id":                  "2\n",
+		"sys/class/accel/accel0/device/device_type":                "GAUDI2\n",
+		"sys/class/accel/accel0/device/infiniband_verbs/uverbs0/x": "",
+		"sys/class/accel/accel_controlD0/device/pci_addr":          "0000:4d:00.0\n",
+		"sys/class/accel/accel10/device/pci_addr":                  "0000:b3:00.0\n",
+		"sys/class/accel/accel10/device/module_id":                 "7\n",
+		"sys/class/accel/accel10/device/device_type":               "GAUDI2\n",
+		"etc/habanalabs/gaudinet.json":                             "{}",
+	}, map[string]uint32{
+		"/dev/accel/accel0":           0,
+		"/dev/accel/accel_controlD0":  1,
+		"/dev/infiniband/uverbs0":     192,
+		"/dev/accel/accel10":          20,
+		"/dev/accel/accel_controlD10": 21,
+	})
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	spec, err := generateCDISpec(logger, cdiGenerateConfig{
+		root:         root,
+		kind:         "habana.ai/gaudi",
+		netinfoDir:   t.TempDir(),
+		gaudinetFile: "/etc/habanalabs/gaudinet.json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	nodes := make(map[string][]string)
+	for _, d := range spec.Devices {
+		names = append(names, d.Name)
+		for _, n := range d.ContainerEdits.DeviceNodes {
+			nodes[d.Name] = append(nodes[d.Name], n.Path)
+		}
+	}
+
+	wantNames := []string{"0", "0000:4d:00.0", "module:2", "10", "0000:b3:00.0", "module:7", "all"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("got devices %v, want %v", names, wantNames)
+	}
+
+	wantNodes := []string{"/dev/accel/accel0", "/dev/accel/accel_controlD0", "/dev/infiniband/uverbs0"}
+	if !reflect.DeepEqual(nodes["module:2"], wantNodes) {
+		t.Errorf("got nodes %v, want %v", nodes["module:2"], wantNodes)
+	}
+	if len(nodes["all"]) != 5 {
+		t.Errorf("got %d nodes for all, want 5", len(nodes["all"]))
+	}
+
+	var mounts []string
+	for _, m := range spec.ContainerEdits.Mounts {
+		mounts = append(mounts, m.ContainerPath)
+	}
+	wantMounts := []string{"/etc/habanalabs/macAddrInfo.json", "/etc/habanalabs/gaudinet.json"}
+	if !reflect.DeepEqual(mounts, wantMounts) {
+		t.Errorf("got mounts %v, want %v", mounts, wantMounts)
+	}
+
+	// The generated spec must be valid for the runtime.
+	file := filepath.Join(t.TempDir(), "habana.ai-gaudi.yaml")
+	if err := cdi.WriteSpec(file, spec); err != nil {
+		t.Fatal(err)
+	}
+	reg, err := cdi.NewRegistry([]string{filepath.Dir(file)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Resolve([]string{"habana.ai/gaudi=0000:b3:00.0"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGenerateCDISpecNoDevices(t *testing.T) {
+	root := fakeNode(t, map[string]string{"sys/class/accel/.keep": ""}, nil)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	_, err := generateCDISpec(logger, cdiGenerateConfig{root: root, kind: "habana.ai/gaudi"})
+	if !errors.Is(err, discover.ErrNoDevices) {
+		t.Errorf("got error %v, want %v", err, discover.ErrNoDevices)
+	}
+}
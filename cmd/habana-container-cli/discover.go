@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/HabanaAI/habana-container-runtime/discover"
+
+	"github.com/urfave/cli/v2"
+)
+
+func discoverCommand() *cli.Command {
+	var root string
+
+	return &cli.Command{
+		Name:  "discover",
+		Usage: "Inspect the accelerators of the node",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "capture",
+				Usage:     "Capture the sysfs and device nodes layout into a fixture directory",
+				UsageText: "habana-container-cli discover capture [command options] directory",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "root",
+						Usage:       "Root of the file system holding /sys and /dev",
+						Value:       "/",
+						Destination: &root,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 1 {
+						return fmt.Errorf("expected a fixture directory")
+					}
+					dst := ctx.Args().First()
+
+					r, err := discover.NewRoot(root)
+					if err != nil {
+						return err
+					}
+					if err := os.MkdirAll(dst, 0755); err != nil {
+						return err
+					}
+					if err := discover.Capture(r, dst); err != nil {
+						return fmt.Errorf("capturing %s: %w", r.Path(), err)
+					}
+					fmt.Fprintln(ctx.App.Writer, dst)
+					return nil
+				},
+			},
+		},
+	}
+}
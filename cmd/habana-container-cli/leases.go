@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	rtconfig "github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/lease"
+
+	"github.com/urfave/cli/v2"
+)
+
+func leasesCommand(shared *rtconfig.Config) *cli.Command {
+	var dir string
+
+	return &cli.Command{
+		Name:  "leases",
+		Usage: "Inspect the devices held by containers",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "List the device leases, with the containers holding or sharing them",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "dir",
+						Usage:       "Directory of the leases registry",
+						Value:       shared.Runtime.Leases.Dir,
+						Destination: &dir,
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					leases, err := lease.NewRegistry(dir).List()
+					if err != nil {
+						return err
+					}
+					return printLeases(ctx.App.Writer, leases)
+				},
+			},
+		},
+	}
+}
+
+func printLeases(out io.Writer, leases []lease.Lease) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tCONTAINER\tSHARING\tSINCE")
+	for _, l := range leases {
+		sharing := "shared"
+		if l.Exclusive {
+			sharing = "exclusive"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", l.Device, l.Container, sharing, l.Created.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
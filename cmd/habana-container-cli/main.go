@@ -19,16 +19,18 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path"
-	"strconv"
-	"strings"
 
+	"github.com/HabanaAI/habana-container-runtime/capability"
 	"github.com/HabanaAI/habana-container-runtime/cgroup"
+	rtconfig "github.com/HabanaAI/habana-container-runtime/config"
 	"github.com/HabanaAI/habana-container-runtime/discover"
 	"github.com/HabanaAI/habana-container-runtime/netinfo"
+	"github.com/HabanaAI/habana-container-runtime/selector"
 
 	"github.com/urfave/cli/v2"
 )
@@ -40,16 +42,13 @@ const (
 	HookCreateRuntime = "createRuntime"
 )
 
-var (
-	devPrefixes  = []string{"accel/accel", "accel/accel_controlD"}
-	ErrNoDevices = errors.New("no habanalabs devices found. driver might not be loaded")
-)
-
 type config struct {
 	// Requested hook cycle
 	hook string
 	// Device flag
 	device string
+	// Modules flag, module IDs selected among the devices
+	modules string
 	// Container PID
 	pid int
 	// Log file path
@@ -61,11 +60,20 @@ type config struct {
 	mountAccelerators bool
 	// Mount Infiniband uverbs devices
 	mountUverbs bool
+	// Driver capabilities flag, what is injected with the devices
+	driverCapabilities string
 }
 
 func main() {
 	var cfg config
 
+	// The flags default to the config shared with the runtime and the hook.
+	shared, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	app := &cli.App{
 		Name:      "habana-container-cli",
 		Usage:     "Mount HabanaLabs devices into containers",
@@ -86,7 +94,6 @@ func main() {
 			&cli.IntFlag{
 				Name:        "pid",
 				Usage:       "Container `PID`",
-				Required:    true,
 				Destination: &cfg.pid,
 				Action: func(_ *cli.Context, i int) error {
 					if i <= 0 {
@@ -97,47 +104,71 @@ func main() {
 			},
 			&cli.StringFlag{
 				Name:        "device",
-				Usage:       "Comma separated devices",
-				Required:    true,
+				Usage:       "Devices selector, in the HABANA_VISIBLE_DEVICES format",
 				Value:       "all",
 				Destination: &cfg.device,
 				Action: func(_ *cli.Context, s string) error {
-					if s != "all" {
-						for _, i := range strings.Split(s, ",") {
-							if _, err := strconv.Atoi(i); err != nil {
-								return fmt.Errorf("device value must be a number. invalid value: %s", i)
-							}
-						}
-					}
-					return nil
+					_, err := selector.Parse(s)
+					return err
+				},
+			},
+			&cli.StringFlag{
+				Name:        "modules",
+				Usage:       "Module IDs selector, in the HABANA_VISIBLE_MODULES format",
+				Destination: &cfg.modules,
+				Action: func(_ *cli.Context, s string) error {
+					_, err := selector.ParseModules(s)
+					return err
 				},
 			},
 			&cli.StringFlag{
 				Name:        "debug",
 				Usage:       "Debug log file location",
-				Value:       "/dev/null",
+				Value:       shared.CLI.Debug,
 				Destination: &cfg.logFilePath,
 			},
 			&cli.StringFlag{
 				Name:        "routes-files",
 				Usage:       "Gaudinet file path",
-				Value:       "",
+				Value:       shared.NetworkL3Config.Path,
 				Destination: &cfg.gaudinetFile,
 			},
 			&cli.BoolFlag{
 				Name:        "mount-accelerators",
 				Usage:       "Enable or disable mounting Habanalabs Accelerator devices.",
-				Value:       true,
+				Value:       shared.MountAccelerators,
 				Destination: &cfg.mountAccelerators,
 			},
 			&cli.BoolFlag{
 				Name:        "mount-uverbs",
 				Usage:       "Mount accelerators' attached infiniband verb devices",
-				Value:       true,
+				Value:       shared.MountUverbs,
 				Destination: &cfg.mountUverbs,
 			},
+			&cli.StringFlag{
+				Name:        "driver-capabilities",
+				Usage:       "Driver capabilities, in the HABANA_DRIVER_CAPABILITIES format",
+				Value:       capability.Default.String(),
+				Destination: &cfg.driverCapabilities,
+				Action: func(_ *cli.Context, s string) error {
+					_, err := capability.Parse(s)
+					return err
+				},
+			},
+		},
+		Commands: []*cli.Command{
+			cdiCommand(shared),
+			discoverCommand(),
+			leasesCommand(shared),
 		},
 		Action: func(ctx *cli.Context) error {
+			// Checked here and not as required flags, as they are not needed by
+			// the subcommands.
+			for _, f := range []string{"pid", "device"} {
+				if !ctx.IsSet(f) {
+					return fmt.Errorf("required flag %q not set", f)
+				}
+			}
 			if ctx.NArg() == 0 {
 				return fmt.Errorf("missing rootfs argument")
 			}
@@ -164,6 +195,23 @@ func main() {
 	}
 }
 
+// loadConfig loads the config of the runtime, or the defaults without config
+// file. The warnings are printed on stderr.
+func loadConfig() (*rtconfig.Config, error) {
+	shared, err := rtconfig.Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		defaults := rtconfig.Default()
+		return &defaults, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range shared.Warnings {
+		fmt.Fprintln(os.Stderr, "WARNING:", w)
+	}
+	return shared, nil
+}
+
 func initLogger(filePath string) (*slog.Logger, func(), error) {
 	// Open the log file for write in the specified location
 	logFile, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -184,7 +232,7 @@ func run(rootfs string, config config, logger *slog.Logger) error {
 		}
 	}()
 
-	devices, err := parseDevices(logger, config.device)
+	devices, err := parseDevices(logger, config.device, config.modules)
 	if err != nil {
 		// Driver is not loaded, or the requested container is not habana related,
 		// we'll print to the log and continue.
@@ -196,18 +244,28 @@ func run(rootfs string, config config, logger *slog.Logger) error {
 	}
 	logger.Info("Requested devices", "devices", devices)
 
+	caps, err := capability.Parse(config.driverCapabilities)
+	if err != nil {
+		return err
+	}
+	logger.Info("Driver capabilities", "capabilities", caps.String())
+
 	// If it's a 'prestart' hook, meaning user need to run the cli in
 	// legacy mode, so all the devices mount happen here and not in the runtime.
 	if config.hook == HookPrestart {
-		err := handlePrestart(logger, rootfs, config, devices)
+		err := handlePrestart(logger, rootfs, config, devices, caps)
 		if err != nil {
 			return fmt.Errorf("handling prestart hook: %w", err)
 		}
 	}
 
+	if !caps.Has(capability.Network) {
+		return nil
+	}
+
 	// In both types of hooks, we handle the exposure of the network interfaces
 	// inside the container.
-	err = exposeInterfaces(logger, config.pid, discover.DevicesIDs(devices.accelerators))
+	err = exposeInterfaces(logger, config.pid, devices)
 	if err != nil {
 		return fmt.Errorf("exposing interfaces: %w", err)
 	}
@@ -215,12 +273,7 @@ func run(rootfs string, config config, logger *slog.Logger) error {
 	return nil
 }
 
-type availableDevices struct {
-	accelerators []string
-	uverbs       []string
-}
-
-func handlePrestart(logger *slog.Logger, rootfs string, config config, devices availableDevices) error {
+func handlePrestart(logger *slog.Logger, rootfs string, config config, devices []discover.Accelerator, caps capability.Set) error {
 	// determine cgroup version
 	cgroupVersion, err := cgroup.CGroupVersion("/", config.pid)
 	if err != nil {
@@ -256,19 +309,39 @@ func handlePrestart(logger *slog.Logger, rootfs string, config config, devices a
 	// If we are not running inside kubernetes environment, then we should mount
 	// the devices into the container. Otherwise, this is done by device plugin.
 	if config.mountAccelerators {
-		if err := handleMounts(logger, handler, devices.accelerators, rootfs, config.pid, containerCgroupPath); err != nil {
+		var accelPaths []string
+		for _, acc := range devices {
+			accelPaths = append(accelPaths, caps.DevicePaths(acc)...)
+		}
+		if err := handleMounts(logger, handler, accelPaths, rootfs, config.pid, containerCgroupPath); err != nil {
 			return fmt.Errorf("handle prestart: %w", err)
 		}
 	}
 
-	if config.mountUverbs {
-		if err := handleMounts(logger, handler, devices.uverbs, rootfs, config.pid, containerCgroupPath); err != nil {
+	if config.mountUverbs && caps.Has(capability.RDMA) {
+		var uverbsPaths []string
+		for _, acc := range devices {
+			if acc.UverbsPath != "" {
+				uverbsPaths = append(uverbsPaths, acc.UverbsPath)
+			}
+		}
+		if err := handleMounts(logger, handler, uverbsPaths, rootfs, config.pid, containerCgroupPath); err != nil {
 			return fmt.Errorf("handle prestart: %w", err)
 		}
 	}
 
-	// net info
-	err = netinfo.Generate(discover.DevicesIDs(devices.accelerators), rootfs)
+	if caps.Has(capability.Network) {
+		addNetworkInfo(logger, rootfs, config, devices)
+	}
+
+	logger.Info("Completed prestart hook")
+	return nil
+}
+
+// addNetworkInfo writes the macAddrInfo and gaudinet files of the devices in
+// the container. Failures are only logged.
+func addNetworkInfo(logger *slog.Logger, rootfs string, config config, devices []discover.Accelerator) {
+	err := netinfo.Generate(devices, rootfs)
 	if err != nil {
 		logger.Error(fmt.Sprintf("ERROR adding netinfo: %v", err))
 	} else {
@@ -281,48 +354,39 @@ func handlePrestart(logger *slog.Logger, rootfs string, config config, devices a
 			logger.Error(fmt.Sprintf("copying gaudinet file: %v", err))
 		}
 	}
-
-	logger.Info("Completed prestart hook")
-	return nil
 }
 
-// parseDevices returns the devices number selected by the user.
-func parseDevices(logger *slog.Logger, deviceFlag string) (availableDevices, error) {
-	// TODO: separate prefixes and collect each on its own. Check
-	// length of both matches, if not, return error about driver.
-	accelDevices, err := discover.CharDevices(devPrefixes)
+// parseDevices returns the accelerators selected by the user, with the devices
+// flag and then with the modules flag when set.
+func parseDevices(logger *slog.Logger, deviceFlag, modulesFlag string) ([]discover.Accelerator, error) {
+	sel, err := selector.Parse(deviceFlag)
 	if err != nil {
-		return availableDevices{}, err
+		return nil, err
 	}
-	logger.Info("Available accelerators devices on machines", "accelerators", accelDevices)
 
-	var devices []string
-	if deviceFlag == "all" {
-		devices = append(devices, accelDevices...)
-	} else {
-		// Filter requested devices
-		for _, i := range strings.Split(deviceFlag, ",") {
-			for _, dev := range accelDevices {
-				if i == deviceID(dev) {
-					devices = append(devices, dev)
-				}
-			}
-		}
+	accelerators, err := discover.HostRoot.Accelerators()
+	if err != nil {
+		return nil, err
 	}
+	logger.Info("Available accelerators devices on machines", "accelerators", discover.IDs(accelerators))
 
-	deviceIds := discover.DevicesIDs(devices)
-	logger.Info("Device IDs after filter", "ids", deviceIds)
-
-	// Always add the MOFED devices is exists
-	verbs, err := discover.UverbsForAccelerators(deviceIds)
+	devices, err := sel.Select(accelerators)
 	if err != nil {
-		return availableDevices{}, err
+		return nil, err
+	}
+
+	if modulesFlag != "" {
+		modules, err := selector.ParseModules(modulesFlag)
+		if err != nil {
+			return nil, err
+		}
+		if devices, err = modules.Select(devices); err != nil {
+			return nil, err
+		}
 	}
+	logger.Info("Device IDs after filter", "ids", discover.IDs(devices))
 
-	return availableDevices{
-		accelerators: devices,
-		uverbs:       verbs,
-	}, nil
+	return devices, nil
 }
 
 func handleMounts(logger *slog.Logger, handler cgroup.Handler, devices []string, rootfs string, pid int, cgroupPath string) error {
@@ -446,15 +510,3 @@ func convertDevInfoToDevRule(devices []*discover.DevInfo) []cgroup.DeviceRule {
 	}
 	return rules
 }
-
-// deviceID extracts the numeric value of the accelerator devices.
-// /dev/accel0 --> 0, /dev/accel_controlD0 --> 0
-func deviceID(device string) string {
-	// Clean root dev folder
-	cleanDev := strings.TrimPrefix(device, "/dev/")
-	// Clean accel folder and device
-	cleanDev = strings.TrimPrefix(cleanDev, "accel/accel")
-	// Clean control prefix for controlD devices
-	cleanDev = strings.TrimPrefix(cleanDev, "_controlD")
-	return cleanDev
-}
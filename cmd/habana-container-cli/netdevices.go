@@ -25,32 +25,28 @@ import (
 	"os/exec"
 	"syscall"
 
-	"golang.org/x/exp/slices"
-
 	"github.com/HabanaAI/habana-container-runtime/discover"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
 )
 
-func exposeInterfaces(logger *slog.Logger, pid int, requestedDevs []string) error {
+func exposeInterfaces(logger *slog.Logger, pid int, requestedDevs []discover.Accelerator) error {
 	logger.Info("Exposing interfaces")
 
 	netNS := fmt.Sprintf("/proc/%d/ns/net", pid)
 	logger.Debug("Found network namespace", "path", netNS)
 
-	// Filter network devices based on requested accelerators.
-	hlibDevices := filterDevicesByENV(requestedDevs, discover.InfinibandDevices())
+	var extInts []string
+	for _, acc := range requestedDevs {
+		for _, netDev := range acc.NetDevs {
+			extInts = append(extInts, netDev.Name)
+		}
+	}
 	logger.Info(
 		"Exposing interfaces for devices",
-		"requested_devices", requestedDevs,
-		"hlib_devices", hlibDevices,
+		"requested_devices", discover.IDs(requestedDevs),
 	)
 
-	extInts, err := discover.ExternalInterfaces(hlibDevices)
-	if err != nil {
-		return err
-	}
-
 	if len(extInts) == 0 {
 		logger.Warn("External network is not available")
 		return nil
@@ -198,23 +194,6 @@ func execute(command string) error {
 	return nil
 }
 
-func filterDevicesByENV(requestedDevs, devices []string) []string {
-	// Case when alwaysMatch is true, and user didn't provide the environment variable
-	if len(requestedDevs) == 0 {
-		return devices
-	}
-
-	var filteredDevices []string
-	for _, dev := range devices {
-		devID := string(dev[len(dev)-1])
-		if slices.Contains(requestedDevs, devID) {
-			filteredDevices = append(filteredDevices, dev)
-		}
-	}
-
-	return filteredDevices
-}
-
 var letters = []rune("abcdefghijflmnopqrstuvwxyz")
 
 func randomString(n int) string {
@@ -22,19 +22,25 @@ import (
 	"path"
 	"strings"
 
+	"github.com/HabanaAI/habana-container-runtime/capability"
+	"github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/request"
+	"github.com/HabanaAI/habana-container-runtime/selector"
+
 	"golang.org/x/mod/semver"
 )
 
 const (
 	envHBVisibleDevices = "HABANA_VISIBLE_DEVICES"
-)
-
-const (
-	capSysAdmin = "CAP_SYS_ADMIN"
+	envHBVisibleModules = "HABANA_VISIBLE_MODULES"
 )
 
 type habanaConfig struct {
 	Devices string
+	// Module IDs selected among the devices. Empty means all of them.
+	Modules string
+	// What is injected with the devices.
+	Capabilities capability.Set
 }
 
 type containerConfig struct {
@@ -80,10 +86,11 @@ type Mount struct {
 // We use pointers to structs, similarly to the latest version of runtime-spec:
 // https://github.com/opencontainers/runtime-spec/blob/v1.0.0/specs-go/config.go#L5-L28
 type Spec struct {
-	Version *string  `json:"ociVersion"`
-	Process *Process `json:"process,omitempty"`
-	Root    *Root    `json:"root,omitempty"`
-	Mounts  []Mount  `json:"mounts,omitempty"`
+	Version     *string           `json:"ociVersion"`
+	Process     *Process          `json:"process,omitempty"`
+	Root        *Root             `json:"root,omitempty"`
+	Mounts      []Mount           `json:"mounts,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 // HookState holds state information about the hook
@@ -162,83 +169,103 @@ func isPrivileged(s *Spec) bool {
 		caps = lc.Bounding
 	}
 
-	for _, c := range caps {
-		if c == capSysAdmin {
-			return true
-		}
-	}
-
-	return false
+	return request.IsPrivileged(caps)
 }
 
-func getDevicesFromEnvvar(env map[string]string, legacyImage bool) *string {
-	// Build a list of envvars to consider.
-	envVars := []string{envHBVisibleDevices}
-
-	// Grab a reference to devices from the first envvar
-	// in the list that actually exists in the environment.
-	var devices *string
-	for _, envVar := range envVars {
-		if devs, ok := env[envVar]; ok {
-			devices = &devs
-		}
-	}
-
-	// Environment variable unset with legacy image: default to "all".
+// normalizeDevices returns the devices to pass to habana-container-cli for
+// the requested value. nil means this is not a HL container.
+func normalizeDevices(devices *string, legacyImage bool) *string {
+	// Devices not requested with legacy image: default to "all".
 	if devices == nil && legacyImage {
 		all := "all"
 		return &all
 	}
 
-	// Environment variable unset or empty or "void": return nil
-	if devices == nil || len(*devices) == 0 || *devices == "void" {
-		all := "all"
-		return &all
+	// Devices not requested, or empty or "void": return nil
+	if devices == nil || len(*devices) == 0 || *devices == selector.Void {
+		return nil
 	}
 
-	// Environment variable set to "none": reset to "".
-	if *devices == "none" {
+	// Devices set to "none": reset to "".
+	if *devices == selector.None {
 		empty := ""
 		return &empty
 	}
 
-	// Any other value.
+	// Any other value, validated here so the container fails with a clear error.
+	// The devices are selected by habana-container-cli.
+	if _, err := selector.Parse(*devices); err != nil {
+		log.Panicln(err)
+	}
 	return devices
 }
 
-func getDevices(hookConfig *HookConfig, env map[string]string, mounts []Mount, privileged bool, legacyImage bool) *string {
-	// Fallback to reading from the environment variable if privileges are correct
-	devices := getDevicesFromEnvvar(env, legacyImage)
-	if devices == nil {
-		return nil
+// getModulesFromEnvvar returns the validated HABANA_VISIBLE_MODULES value.
+func getModulesFromEnvvar(env map[string]string) string {
+	modules := env[envHBVisibleModules]
+	if modules == "" {
+		return ""
 	}
-	if privileged || hookConfig.AcceptEnvvarUnprivileged {
-		return devices
+	if _, err := selector.ParseModules(modules); err != nil {
+		log.Panicln(err)
 	}
+	return modules
+}
 
-	// Error out otherwise
-	log.Panicln("insufficient privileges to read device list from HABANA_VISIBLE_DEVICES envvar")
-
-	return nil
+func getDevices(hookConfig *config.Config, c request.Container, mounts []Mount, privileged bool, legacyImage bool) *string {
+	for _, m := range mounts {
+		c.Mounts = append(c.Mounts, m.Destination)
+	}
+	c.Privileged = privileged
+	// The runtime resolved the request, and admitted these devices.
+	if devices, ok := c.Annotations[request.AnnotationAdmittedDevices]; ok {
+		return normalizeDevices(&devices, legacyImage)
+	}
+	opts := request.Options{
+		AcceptEnvvar:             hookConfig.AcceptEnvvar,
+		AcceptVolumeMounts:       hookConfig.AcceptVolumeMounts,
+		AcceptEnvvarUnprivileged: hookConfig.AcceptEnvvarUnprivileged,
+	}
+	// Annotations and volume mounts are set by the device plugin or the
+	// container engine, not by the user, and are always trusted.
+	req, err := request.Resolve(c, opts)
+	if err != nil {
+		// Unless the request is empty, error out
+		if devices := c.Env[request.EnvVisibleDevices]; normalizeDevices(&devices, legacyImage) == nil {
+			return nil
+		}
+		log.Panicln(err)
+	}
+	if req == nil {
+		return normalizeDevices(nil, legacyImage)
+	}
+	return normalizeDevices(&req.Devices, legacyImage)
 }
 
-func getHabanaConfig(hookConfig *HookConfig, env map[string]string, mounts []Mount, privileged bool) *habanaConfig {
+func getHabanaConfig(hookConfig *config.Config, c request.Container, mounts []Mount, privileged bool) *habanaConfig {
 	legacyImage := false
 
 	var devices string
-	if d := getDevices(hookConfig, env, mounts, privileged, legacyImage); d != nil {
+	if d := getDevices(hookConfig, c, mounts, privileged, legacyImage); d != nil {
 		devices = *d
 	} else {
 		// 'nil' devices means this is not a HL container.
 		return nil
 	}
 
+	caps, err := request.DriverCapabilities(c, request.Options{AcceptEnvvar: hookConfig.AcceptEnvvar})
+	if err != nil {
+		log.Panicln(err)
+	}
+
 	return &habanaConfig{
-		Devices: devices,
+		Devices:      devices,
+		Modules:      getModulesFromEnvvar(c.Env),
+		Capabilities: caps,
 	}
 }
 
-func getContainerConfig(hook HookConfig) (config containerConfig) {
+func getContainerConfig(hook *config.Config) containerConfig {
 	var h HookState
 	d := json.NewDecoder(os.Stdin)
 	if err := d.Decode(&h); err != nil {
@@ -258,6 +285,6 @@ func getContainerConfig(hook HookConfig) (config containerConfig) {
 		Pid:    h.Pid,
 		Rootfs: s.Root.Path,
 		Env:    env,
-		Habana: getHabanaConfig(&hook, env, s.Mounts, privileged),
+		Habana: getHabanaConfig(hook, request.Container{Env: env, Annotations: s.Annotations}, s.Mounts, privileged),
 	}
 }
@@ -19,12 +19,16 @@ import (
 	"encoding/json"
 	"reflect"
 	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/capability"
+	"github.com/HabanaAI/habana-container-runtime/request"
 )
 
 func TestGetHabanaConfig(t *testing.T) {
 	tests := []struct {
 		description    string
 		env            map[string]string
+		annotations    map[string]string
 		privileged     bool
 		expectedConfig *habanaConfig
 		expectedPanic  bool
@@ -48,7 +52,8 @@ func TestGetHabanaConfig(t *testing.T) {
 			},
 			privileged: true,
 			expectedConfig: &habanaConfig{
-				Devices: "all",
+				Devices:      "all",
+				Capabilities: capability.Default,
 			},
 		},
 		{
@@ -58,9 +63,102 @@ func TestGetHabanaConfig(t *testing.T) {
 			},
 			privileged: false,
 			expectedConfig: &habanaConfig{
-				Devices: "all",
+				Devices:      "all",
+				Capabilities: capability.Default,
+			},
+		},
+		{
+			description: "environment 'void'",
+			env: map[string]string{
+				envHBVisibleDevices: "void",
+			},
+			privileged:     true,
+			expectedConfig: nil,
+		},
+		{
+			description: "environment 'none'",
+			env: map[string]string{
+				envHBVisibleDevices: "none",
+			},
+			privileged: true,
+			expectedConfig: &habanaConfig{
+				Devices:      "",
+				Capabilities: capability.Default,
 			},
 		},
+		{
+			description: "environment with range and exclusion",
+			env: map[string]string{
+				envHBVisibleDevices: "0-3,-1",
+			},
+			privileged: true,
+			expectedConfig: &habanaConfig{
+				Devices:      "0-3,-1",
+				Capabilities: capability.Default,
+			},
+		},
+		{
+			description: "devices admitted by the runtime",
+			env: map[string]string{
+				envHBVisibleDevices: "count:2",
+			},
+			annotations: map[string]string{
+				request.AnnotationAdmittedDevices: "1,3",
+			},
+			expectedConfig: &habanaConfig{
+				Devices:      "1,3",
+				Capabilities: capability.Default,
+			},
+		},
+		{
+			description: "environment with modules",
+			env: map[string]string{
+				envHBVisibleDevices: "all",
+				envHBVisibleModules: "0,2-3",
+			},
+			privileged: true,
+			expectedConfig: &habanaConfig{
+				Devices:      "all",
+				Modules:      "0,2-3",
+				Capabilities: capability.Default,
+			},
+		},
+		{
+			description: "environment with driver capabilities",
+			env: map[string]string{
+				envHBVisibleDevices:           "all",
+				request.EnvDriverCapabilities: "control,utility",
+			},
+			expectedConfig: &habanaConfig{
+				Devices:      "all",
+				Capabilities: capability.Control | capability.Utility,
+			},
+		},
+		{
+			description: "invalid driver capabilities environment",
+			env: map[string]string{
+				envHBVisibleDevices:           "all",
+				request.EnvDriverCapabilities: "graphics",
+			},
+			expectedPanic: true,
+		},
+		{
+			description: "invalid modules environment",
+			env: map[string]string{
+				envHBVisibleDevices: "all",
+				envHBVisibleModules: "all",
+			},
+			privileged:    true,
+			expectedPanic: true,
+		},
+		{
+			description: "invalid environment",
+			env: map[string]string{
+				envHBVisibleDevices: "0,gpu1",
+			},
+			privileged:    true,
+			expectedPanic: true,
+		},
 	}
 
 	for _, tc := range tests {
@@ -68,10 +166,14 @@ func TestGetHabanaConfig(t *testing.T) {
 			var config *habanaConfig
 			getConfig := func() {
 				hookConfig := getDefaultHookConfig()
-				config = getHabanaConfig(&hookConfig, tc.env, nil, tc.privileged)
+				config = getHabanaConfig(&hookConfig, request.Container{Env: tc.env, Annotations: tc.annotations}, nil, tc.privileged)
 			}
 			if tc.expectedPanic {
-				// panic
+				defer func() {
+					if r := recover(); r == nil {
+						t.Error("expected a panic, got none")
+					}
+				}()
 			}
 
 			getConfig()
@@ -80,7 +182,7 @@ func TestGetHabanaConfig(t *testing.T) {
 				return
 			}
 			if config != nil && tc.expectedConfig != nil {
-				if !reflect.DeepEqual(config.Devices, tc.expectedConfig.Devices) {
+				if !reflect.DeepEqual(config, tc.expectedConfig) {
 					t.Errorf("Unexpected habanaConfig (got: %v, wanted: %v)", config, tc.expectedConfig)
 				}
 				return
@@ -144,7 +246,7 @@ func TestDeviceListSourcePriority(t *testing.T) {
 				}
 				hookConfig := getDefaultHookConfig()
 				hookConfig.AcceptEnvvarUnprivileged = tc.acceptUnprivileged
-				devices = getDevices(&hookConfig, env, []Mount{}, tc.privileged, false)
+				devices = getDevices(&hookConfig, request.Container{Env: env}, []Mount{}, tc.privileged, false)
 			}
 
 			// For all other tests, just grab the devices and check the results
@@ -158,6 +260,87 @@ func TestDeviceListSourcePriority(t *testing.T) {
 	}
 }
 
+func TestDevicesFromTrustedSources(t *testing.T) {
+	tests := []struct {
+		description     string
+		annotations     map[string]string
+		env             map[string]string
+		mounts          []Mount
+		acceptEnvvar    bool
+		acceptMounts    bool
+		privileged      bool
+		expectedDevices *string
+		expectedPanic   bool
+	}{
+		{
+			description:     "annotation takes precedence over the envvar",
+			annotations:     map[string]string{request.AnnotationVisibleDevices: "1"},
+			env:             map[string]string{envHBVisibleDevices: "all"},
+			acceptEnvvar:    true,
+			expectedDevices: &[]string{"1"}[0],
+		},
+		{
+			description:     "envvar ignored when not accepted",
+			env:             map[string]string{envHBVisibleDevices: "all"},
+			acceptEnvvar:    false,
+			privileged:      true,
+			expectedDevices: nil,
+		},
+		{
+			description:     "annotation used when the envvar is not accepted",
+			annotations:     map[string]string{request.AnnotationVisibleDevices: "0,1"},
+			env:             map[string]string{envHBVisibleDevices: "all"},
+			acceptEnvvar:    false,
+			expectedDevices: &[]string{"0,1"}[0],
+		},
+		{
+			description: "volume mounts",
+			mounts: []Mount{
+				{Destination: "/var/run/habana-container-devices/2"},
+				{Destination: "/var/run/habana-container-devices/3"},
+			},
+			env:             map[string]string{envHBVisibleDevices: "all"},
+			acceptEnvvar:    true,
+			acceptMounts:    true,
+			expectedDevices: &[]string{"2,3"}[0],
+		},
+		{
+			description: "volume mounts not accepted",
+			mounts: []Mount{
+				{Destination: "/var/run/habana-container-devices/2"},
+			},
+			acceptEnvvar:    true,
+			expectedDevices: nil,
+		},
+		{
+			description:   "invalid annotation",
+			annotations:   map[string]string{request.AnnotationVisibleDevices: "0,a"},
+			expectedPanic: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			if tc.expectedPanic {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Error("expected a panic, got none")
+					}
+				}()
+			}
+
+			hookConfig := getDefaultHookConfig()
+			hookConfig.AcceptEnvvar = tc.acceptEnvvar
+			hookConfig.AcceptVolumeMounts = tc.acceptMounts
+			hookConfig.AcceptEnvvarUnprivileged = false
+			c := request.Container{Env: tc.env, Annotations: tc.annotations}
+			devices := getDevices(&hookConfig, c, tc.mounts, tc.privileged, false)
+			if !reflect.DeepEqual(devices, tc.expectedDevices) {
+				t.Errorf("Unexpected devices (got: %v, wanted: %v)", devices, tc.expectedDevices)
+			}
+		})
+	}
+}
+
 func TestIsPrivileged(t *testing.T) {
 	tests := []struct {
 		spec     string
@@ -16,76 +16,35 @@
 package main
 
 import (
+	"errors"
+	"io/fs"
 	"log"
-	"os"
-	"path"
 
-	"github.com/BurntSushi/toml"
+	"github.com/HabanaAI/habana-container-runtime/config"
 )
 
-const (
-	configPath = "/etc/habana-container-runtime/config.toml"
-	driverPath = "/run/habana/driver"
-)
-
-var defaultPaths = [...]string{
-	path.Join(driverPath, configPath),
-	configPath,
-}
-
-// CLIConfig : options for habana-container-cli.
-type CLIConfig struct {
-	Root        *string  `toml:"root"`
-	Path        *string  `toml:"path"`
-	Environment []string `toml:"environment"`
-	Debug       *string  `toml:"debug"`
-	// Mount accelerator devices from the container-runtime. If running in kubernetes
-	// environment with Habana Device Plugin, can leave it undefined or set to false,
-	// since device plugin will mount the accelerator devices.
-	MountAccelerators *bool `toml:"mount_accelerators"`
-	// Mount infiniband verbs devices
-	MountUverbs *bool `toml:"mount_uverbs"`
-}
-
-// HookConfig : options for the habana-container-hook.
-type HookConfig struct {
-	AcceptEnvvarUnprivileged bool `toml:"accept-habana-visible-devices-envvar-when-unprivileged"`
-
-	HabanaContainerCLI CLIConfig `toml:"habana-container-cli"`
+func getDefaultHookConfig() config.Config {
+	return config.Default()
 }
 
-func getDefaultHookConfig() (config HookConfig) {
-	return HookConfig{
-		AcceptEnvvarUnprivileged: true,
-		HabanaContainerCLI: CLIConfig{
-			Root:        nil,
-			Path:        nil,
-			Environment: []string{},
-			Debug:       nil,
-		},
-	}
-}
-
-func getHookConfig() (config HookConfig) {
-	var err error
-
+// getHookConfig loads the config of the -config flag, or the one the runtime
+// uses. Without config file, the defaults are used.
+func getHookConfig() *config.Config {
 	if len(*configflag) > 0 {
-		config = getDefaultHookConfig()
-		_, err = toml.DecodeFile(*configflag, &config)
+		cfg, err := config.LoadFile(*configflag)
 		if err != nil {
 			log.Panicln("couldn't open configuration file:", err)
 		}
-	} else {
-		for _, p := range defaultPaths {
-			config = getDefaultHookConfig()
-			_, err = toml.DecodeFile(p, &config)
-			if err == nil {
-				break
-			} else if !os.IsNotExist(err) {
-				log.Panicln("couldn't open default configuration file:", err)
-			}
-		}
+		return cfg
 	}
 
-	return config
+	cfg, err := config.Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		defaults := getDefaultHookConfig()
+		return &defaults
+	}
+	if err != nil {
+		log.Panicln("couldn't open default configuration file:", err)
+	}
+	return cfg
 }
@@ -27,6 +27,8 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/config"
 )
 
 var (
@@ -49,7 +51,7 @@ func exit() {
 	os.Exit(0)
 }
 
-func getPATH(config CLIConfig) string {
+func getPATH(config config.CLIConfig) string {
 	dirs := filepath.SplitList(os.Getenv("PATH"))
 	// directories from the hook environment have higher precedence
 	dirs = append(dirs, defaultPATH...)
@@ -65,7 +67,7 @@ func getPATH(config CLIConfig) string {
 	return strings.Join(dirs, ":")
 }
 
-func getCLIPath(config CLIConfig) (string, error) {
+func getCLIPath(config config.CLIConfig) (string, error) {
 	if config.Path != nil {
 		return *config.Path, nil
 	}
@@ -97,7 +99,10 @@ func doHook(lifecycle string) {
 	log.SetFlags(0)
 
 	hook := getHookConfig()
-	cli := hook.HabanaContainerCLI
+	for _, w := range hook.Warnings {
+		log.Println("WARNING:", w)
+	}
+	cli := hook.CLI
 
 	container := getContainerConfig(hook)
 	habana := container.Habana
@@ -105,25 +110,25 @@ func doHook(lifecycle string) {
 		// Not a HL devices, nothing to do.
 		return
 	}
+	if len(habana.Devices) == 0 {
+		// HABANA_VISIBLE_DEVICES=none, no devices to mount.
+		return
+	}
 
 	rootfs := getRootfsPath(container)
 
-	args := []string{}
-	if len(habana.Devices) > 0 {
-		args = append(args, fmt.Sprintf("--device=%s", habana.Devices))
+	args := []string{fmt.Sprintf("--device=%s", habana.Devices)}
+	if len(habana.Modules) > 0 {
+		args = append(args, fmt.Sprintf("--modules=%s", habana.Modules))
 	}
 	if cli.Root != nil {
 		args = append(args, fmt.Sprintf("--root=%s", *cli.Root))
 	}
-	if cli.Debug != nil {
-		args = append(args, fmt.Sprintf("--debug=%s", *cli.Debug))
-	}
-	if cli.MountAccelerators != nil {
-		args = append(args, fmt.Sprintf("--mount-accelerators=%t", *cli.MountAccelerators))
-	}
-	if cli.MountUverbs != nil {
-		args = append(args, fmt.Sprintf("--mount-uverbs=%t", *cli.MountUverbs))
-	}
+	args = append(args, fmt.Sprintf("--debug=%s", cli.Debug))
+	args = append(args, fmt.Sprintf("--mount-accelerators=%t", hook.MountAccelerators))
+	args = append(args, fmt.Sprintf("--mount-uverbs=%t", hook.MountUverbs))
+	args = append(args, fmt.Sprintf("--routes-files=%s", hook.NetworkL3Config.Path))
+	args = append(args, fmt.Sprintf("--driver-capabilities=%s", habana.Capabilities))
 
 	args = append(args, fmt.Sprintf("--hook=%s", lifecycle))
 	args = append(args, fmt.Sprintf("--pid=%s", strconv.FormatUint(uint64(container.Pid), 10)))
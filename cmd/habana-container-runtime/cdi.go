@@ -0,0 +1,334 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/cdi"
+	"github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/discover"
+	"github.com/HabanaAI/habana-container-runtime/request"
+	"github.com/HabanaAI/habana-container-runtime/selector"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// applyCDIDevices resolves the requested devices against the CDI spec files
+// and applies their container edits to the spec.
+func applyCDIDevices(logger *slog.Logger, spec *specs.Spec, req *request.Request, cfg *config.Config, root *discover.Root) error {
+	devices, err := cdiDevices(spec, req, cfg.Runtime.CDI.DefaultKind, root)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		logger.Info("No CDI devices requested")
+		return nil
+	}
+	logger.Debug("Requested CDI devices", "devices", devices)
+
+	if err := checkPolicyMode(spec, cfg); err != nil {
+		return err
+	}
+	if err := checkRequirementsMode(spec, cfg); err != nil {
+		return err
+	}
+
+	registry, err := cdi.NewRegistry(cfg.Runtime.CDI.SpecDirs)
+	if err != nil {
+		return fmt.Errorf("loading CDI specs: %w", err)
+	}
+
+	edits, err := registry.Resolve(devices)
+	if err != nil {
+		return err
+	}
+
+	return applyContainerEdits(logger, spec, root, edits)
+}
+
+// cdiDevices returns the fully qualified device names requested by the container.
+// Devices are collected from the CDI annotations and from the devices request.
+// The request is either a list of qualified names, or a selector resolved
+// against the accelerators of the root, whose devices are named by index with
+// the default kind.
+func cdiDevices(spec *specs.Spec, req *request.Request, defaultKind string, root *discover.Root) ([]string, error) {
+	// The annotations are sorted by key, so the devices are in the same order
+	// on every run.
+	var keys []string
+	for key := range spec.Annotations {
+		if strings.HasPrefix(key, cdi.AnnotationPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	var devices []string
+	for _, key := range keys {
+		for _, d := range strings.Split(spec.Annotations[key], ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				devices = append(devices, d)
+			}
+		}
+	}
+
+	// Same as the OCI mode, no request means all the devices when we got here.
+	value := ""
+	if req != nil {
+		value = req.Devices
+	} else if len(devices) == 0 {
+		value = "all"
+	}
+
+	if slices.ContainsFunc(strings.Split(value, ","), cdi.IsQualifiedName) {
+		for _, d := range strings.Split(value, ",") {
+			d = strings.TrimSpace(d)
+			if !cdi.IsQualifiedName(d) {
+				return nil, fmt.Errorf("invalid %s value %q: %q cannot be combined with CDI device names", EnvHLVisibleDevices, value, d)
+			}
+			devices = append(devices, d)
+		}
+		return devices, nil
+	}
+
+	sel, err := selector.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case sel.IsNone():
+		return devices, nil
+	case sel.IsAll():
+		return append(devices, cdi.QualifiedName(defaultKind, selector.All)), nil
+	}
+	accelerators, err := root.Accelerators()
+	if err != nil {
+		return nil, err
+	}
+	selected, err := sel.Select(accelerators)
+	if err != nil {
+		return nil, err
+	}
+	for _, acc := range selected {
+		devices = append(devices, cdi.QualifiedName(defaultKind, acc.ID()))
+	}
+	return devices, nil
+}
+
+// applyContainerEdits modifies the spec with the CDI container edits.
+func applyContainerEdits(logger *slog.Logger, spec *specs.Spec, root *discover.Root, edits cdi.ContainerEdits) error {
+	for _, node := range edits.DeviceNodes {
+		dev, access, err := cdiDevice(root, node)
+		if err != nil {
+			return err
+		}
+		logger.Info("Adding CDI device", "path", dev.Path, "type", dev.Type, "access", access)
+		addCDIDevice(spec, dev, access)
+	}
+
+	for _, ev := range edits.Env {
+		key, value, _ := strings.Cut(ev, "=")
+		setEnvVar(spec, key, value)
+	}
+
+	addCDIMounts(logger, spec, edits.Mounts)
+
+	for _, h := range edits.Hooks {
+		if err := addCDIHook(spec, h); err != nil {
+			return err
+		}
+	}
+
+	if len(edits.AdditionalGIDs) != 0 {
+		spec.Process.User.AdditionalGids = append(spec.Process.User.AdditionalGids, edits.AdditionalGIDs...)
+	}
+
+	return nil
+}
+
+// cdiDevice converts a CDI device node to the OCI device, and returns it with
+// the cgroup access of the device, as the CDI spec defines them. Without major
+// and minor numbers, they are read from the host device, with the missing type
+// and file mode. Otherwise the type defaults to "c". The access defaults to
+// "rwm" and the owner to root.
+func cdiDevice(root *discover.Root, node *cdi.DeviceNode) (specs.LinuxDevice, string, error) {
+	hostPath := node.HostPath
+	if hostPath == "" {
+		hostPath = node.Path
+	}
+	dev := specs.LinuxDevice{
+		Path:     node.Path,
+		Type:     node.Type,
+		Major:    node.Major,
+		Minor:    node.Minor,
+		FileMode: node.FileMode,
+		UID:      node.UID,
+		GID:      node.GID,
+	}
+
+	switch dev.Type {
+	case "", "c", "b", "u", "p":
+	default:
+		return dev, "", fmt.Errorf("CDI device %s: invalid type %q", node.Path, dev.Type)
+	}
+	// FIFOs have no device numbers.
+	if dev.Type != "p" && dev.Major == 0 && dev.Minor == 0 {
+		info, err := root.DeviceInfo(hostPath)
+		if err != nil {
+			return dev, "", err
+		}
+		hostType := deviceType(info.Mode)
+		if dev.Type == "" {
+			dev.Type = hostType
+		} else if dev.Type != hostType && !(dev.Type == "u" && hostType == "c") {
+			return dev, "", fmt.Errorf("CDI device %s: type %q, but %s is of type %q", node.Path, dev.Type, hostPath, hostType)
+		}
+		if dev.Major == 0 && dev.Minor == 0 {
+			dev.Major, dev.Minor = int64(info.Major), int64(info.Minor)
+		}
+		if dev.FileMode == nil {
+			mode := info.FileMode
+			dev.FileMode = &mode
+		}
+	}
+	if dev.Type == "" {
+		dev.Type = "c"
+	}
+	if dev.FileMode == nil {
+		mode := os.FileMode(0666)
+		dev.FileMode = &mode
+	}
+	zeroID := uint32(0)
+	if dev.UID == nil {
+		dev.UID = &zeroID
+	}
+	if dev.GID == nil {
+		dev.GID = &zeroID
+	}
+
+	access := node.Permissions
+	if access == "" {
+		access = "rwm"
+	}
+	if strings.Trim(access, "rwm") != "" {
+		return dev, "", fmt.Errorf("CDI device %s: invalid permissions %q", node.Path, access)
+	}
+	return dev, access, nil
+}
+
+// deviceType returns the OCI type of the device of the file mode.
+func deviceType(mode uint32) string {
+	switch mode & unix.S_IFMT {
+	case unix.S_IFBLK:
+		return "b"
+	case unix.S_IFIFO:
+		return "p"
+	}
+	return "c"
+}
+
+// addCDIDevice adds the device to the spec, and its cgroup rule with the
+// access to the allow list. FIFOs are not in the devices cgroup.
+func addCDIDevice(spec *specs.Spec, dev specs.LinuxDevice, access string) {
+	if !slices.ContainsFunc(spec.Linux.Devices, func(d specs.LinuxDevice) bool { return d.Path == dev.Path }) {
+		spec.Linux.Devices = append(spec.Linux.Devices, dev)
+	}
+	if dev.Type == "p" {
+		return
+	}
+	cgroupType := dev.Type
+	if cgroupType == "u" {
+		cgroupType = "c"
+	}
+	for _, rule := range spec.Linux.Resources.Devices {
+		if rule.Allow && rule.Type == cgroupType && rule.Major != nil && *rule.Major == dev.Major &&
+			rule.Minor != nil && *rule.Minor == dev.Minor && rule.Access == access {
+			return
+		}
+	}
+	major, minor := dev.Major, dev.Minor
+	spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, specs.LinuxDeviceCgroup{
+		Allow:  true,
+		Type:   cgroupType,
+		Major:  &major,
+		Minor:  &minor,
+		Access: access,
+	})
+}
+
+func addCDIMounts(logger *slog.Logger, spec *specs.Spec, mounts []*cdi.Mount) {
+	current := make(map[string]struct{})
+	for _, m := range spec.Mounts {
+		current[m.Destination] = struct{}{}
+	}
+
+	for _, m := range mounts {
+		if _, ok := current[m.ContainerPath]; ok {
+			continue
+		}
+		current[m.ContainerPath] = struct{}{}
+
+		mountType, options := m.Type, m.Options
+		if mountType == "" {
+			mountType = "bind"
+		}
+		if len(options) == 0 && mountType == "bind" {
+			options = []string{"bind"}
+		}
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: m.ContainerPath,
+			Source:      m.HostPath,
+			Type:        mountType,
+			Options:     options,
+		})
+		logger.Debug("Added mount to spec", "source", m.HostPath, "destination", m.ContainerPath)
+	}
+}
+
+func addCDIHook(spec *specs.Spec, h *cdi.Hook) error {
+	if spec.Hooks == nil {
+		spec.Hooks = &specs.Hooks{}
+	}
+
+	var hooks *[]specs.Hook
+	switch h.HookName {
+	case "prestart":
+		hooks = &spec.Hooks.Prestart
+	case "createRuntime":
+		hooks = &spec.Hooks.CreateRuntime
+	case "createContainer":
+		hooks = &spec.Hooks.CreateContainer
+	case "startContainer":
+		hooks = &spec.Hooks.StartContainer
+	case "poststart":
+		hooks = &spec.Hooks.Poststart
+	case "poststop":
+		hooks = &spec.Hooks.Poststop
+	default:
+		return fmt.Errorf("unsupported CDI hook %q", h.HookName)
+	}
+
+	// Hooks of several devices, or already in a restored spec, are added once.
+	if slices.ContainsFunc(*hooks, func(e specs.Hook) bool { return e.Path == h.Path && slices.Equal(e.Args, h.Args) }) {
+		return nil
+	}
+	*hooks = append(*hooks, specs.Hook{Path: h.Path, Args: h.Args, Env: h.Env, Timeout: h.Timeout})
+	return nil
+}
@@ -0,0 +1,306 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/cdi"
+	"github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/discover"
+	"github.com/HabanaAI/habana-container-runtime/policy"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestCDIDevices(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         []string
+		annotations map[string]string
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name: "no request means all",
+			want: []string{"habana.ai/gaudi=all"},
+		},
+		{
+			name: "indexes are qualified with the default kind",
+			env:  []string{"HABANA_VISIBLE_DEVICES=0,1"},
+			want: []string{"habana.ai/gaudi=0", "habana.ai/gaudi=1"},
+		},
+		{
+			name: "qualified names are kept",
+			env:  []string{"HABANA_VISIBLE_DEVICES=vendor.com/class=foo"},
+			want: []string{"vendor.com/class=foo"},
+		},
+		{
+			name: "none",
+			env:  []string{"HABANA_VISIBLE_DEVICES=none"},
+			want: nil,
+		},
+		{
+			name:        "annotations only",
+			annotations: map[string]string{"cdi.k8s.io/habana": "habana.ai/gaudi=2,habana.ai/gaudi=3", "other": "x=y"},
+			want:        []string{"habana.ai/gaudi=2", "habana.ai/gaudi=3"},
+		},
+		{
+			name:        "annotations sorted by key",
+			annotations: map[string]string{"cdi.k8s.io/z": "habana.ai/gaudi=1", "cdi.k8s.io/a": "habana.ai/gaudi=3", "cdi.k8s.io/m": "habana.ai/gaudi=0"},
+			want:        []string{"habana.ai/gaudi=3", "habana.ai/gaudi=0", "habana.ai/gaudi=1"},
+		},
+		{
+			name: "ranges are resolved",
+			env:  []string{"HABANA_VISIBLE_DEVICES=0-1"},
+			want: []string{"habana.ai/gaudi=0", "habana.ai/gaudi=1"},
+		},
+		{
+			name: "exclusions are resolved",
+			env:  []string{"HABANA_VISIBLE_DEVICES=all,-0"},
+			want: []string{"habana.ai/gaudi=1"},
+		},
+		{
+			name: "modules and PCI addresses are named by index",
+			env:  []string{"HABANA_VISIBLE_DEVICES=module:3,0000:33:00.0"},
+			want: []string{"habana.ai/gaudi=0", "habana.ai/gaudi=1"},
+		},
+		{
+			name: "count",
+			env:  []string{"HABANA_VISIBLE_DEVICES=count:1"},
+			want: []string{"habana.ai/gaudi=0"},
+		},
+		{
+			name:    "missing device",
+			env:     []string{"HABANA_VISIBLE_DEVICES=0-3"},
+			wantErr: true,
+		},
+		{
+			name:    "names combined with a selector",
+			env:     []string{"HABANA_VISIBLE_DEVICES=vendor.com/class=foo,1"},
+			wantErr: true,
+		},
+	}
+
+	root, err := discover.NewRoot("../../discover/testdata/hls2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &specs.Spec{Process: &specs.Process{Env: tt.env}, Annotations: tt.annotations}
+			req, err := devicesRequest(spec, &config.Config{AcceptEnvvar: true, AcceptEnvvarUnprivileged: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := cdiDevices(spec, req, "habana.ai/gaudi", root)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyCDIDevices(t *testing.T) {
+	cfg := &config.Config{
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		Runtime: config.RuntimeConfig{
+			CDI: config.CDIConfig{
+				SpecDirs:    []string{"../../cdi/testdata/etc", "../../cdi/testdata/run"},
+				DefaultKind: "habana.ai/gaudi",
+			},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	root, err := discover.NewRoot("../../discover/testdata/hls2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &specs.Spec{
+		Process: &specs.Process{Env: []string{"HABANA_VISIBLE_DEVICES=0,1", "HABANA_CDI=0"}},
+		Linux:   &specs.Linux{Resources: &specs.LinuxResources{}},
+	}
+	req, err := devicesRequest(spec, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyCDIDevices(logger, spec, req, cfg, root); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, d := range spec.Linux.Devices {
+		paths = append(paths, d.Path)
+	}
+	sort.Strings(paths)
+	wantPaths := []string{"/dev/accel/accel0", "/dev/accel/accel1", "/dev/accel/accel_controlD0", "/dev/accel/accel_controlD1"}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("got devices %v, want %v", paths, wantPaths)
+	}
+	if len(spec.Linux.Resources.Devices) != 4 {
+		t.Errorf("got %d allow list rules, want 4", len(spec.Linux.Resources.Devices))
+	}
+	if len(spec.Mounts) != 1 || spec.Mounts[0].Destination != "/etc/habanalabs/gaudinet.json" {
+		t.Errorf("unexpected mounts %+v", spec.Mounts)
+	}
+	wantEnv := []string{"HABANA_VISIBLE_DEVICES=0,1", "HABANA_CDI=1"}
+	if !reflect.DeepEqual(spec.Process.Env, wantEnv) {
+		t.Errorf("got env %v, want %v", spec.Process.Env, wantEnv)
+	}
+
+	t.Run("policy matching the container fails", func(t *testing.T) {
+		cfg := *cfg
+		cfg.Policies = []policy.Rule{{Name: "default", Devices: "none"}}
+		spec := &specs.Spec{Process: &specs.Process{Env: []string{"HABANA_VISIBLE_DEVICES=0"}}}
+		req, err := devicesRequest(spec, &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := applyCDIDevices(logger, spec, req, &cfg, root); err == nil {
+			t.Error("expected an error, got none")
+		}
+	})
+
+	t.Run("unknown device fails", func(t *testing.T) {
+		spec := &specs.Spec{Process: &specs.Process{Env: []string{"HABANA_VISIBLE_DEVICES=5"}}}
+		req, err := devicesRequest(spec, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := applyCDIDevices(logger, spec, req, cfg, root); err == nil {
+			t.Error("expected an error, got none")
+		}
+	})
+}
+
+func TestApplyCDIDeviceNodes(t *testing.T) {
+	dir := t.TempDir()
+	nodes := `{"/dev/nvme0n1": {"Major": 259, "Minor": 0, "Mode": 25008, "FileMode": 432}}`
+	if err := os.WriteFile(filepath.Join(dir, discover.FixtureDevicesFile), []byte(nodes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := discover.NewRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	uid, gid := uint32(1000), uint32(1001)
+
+	tests := []struct {
+		name       string
+		node       cdi.DeviceNode
+		want       specs.LinuxDevice
+		wantAccess string
+		wantErr    bool
+	}{
+		{
+			name:       "block device of the host",
+			node:       cdi.DeviceNode{Path: "/dev/nvme0n1"},
+			want:       specs.LinuxDevice{Path: "/dev/nvme0n1", Type: "b", Major: 259, Minor: 0, UID: new(uint32), GID: new(uint32)},
+			wantAccess: "rwm",
+		},
+		{
+			name:       "read-only node",
+			node:       cdi.DeviceNode{Path: "/dev/accel/accel0", Major: 510, Minor: 0, Permissions: "r", UID: &uid, GID: &gid},
+			want:       specs.LinuxDevice{Path: "/dev/accel/accel0", Type: "c", Major: 510, Minor: 0, UID: &uid, GID: &gid},
+			wantAccess: "r",
+		},
+		{
+			name: "fifo",
+			node: cdi.DeviceNode{Path: "/dev/hl-events", Type: "p"},
+			want: specs.LinuxDevice{Path: "/dev/hl-events", Type: "p", UID: new(uint32), GID: new(uint32)},
+		},
+		{
+			name:    "type of another host device",
+			node:    cdi.DeviceNode{Path: "/dev/nvme0n1", Type: "c"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid permissions",
+			node:    cdi.DeviceNode{Path: "/dev/accel/accel0", Major: 510, Permissions: "rwx"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &specs.Spec{Process: &specs.Process{}, Linux: &specs.Linux{Resources: &specs.LinuxResources{}}}
+			err := applyContainerEdits(logger, spec, root, cdi.ContainerEdits{DeviceNodes: []*cdi.DeviceNode{&tt.node}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(spec.Linux.Devices) != 1 {
+				t.Fatalf("got devices %+v, want one", spec.Linux.Devices)
+			}
+			got := spec.Linux.Devices[0]
+			got.FileMode = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got device %+v, want %+v", got, tt.want)
+			}
+
+			var access []string
+			for _, rule := range spec.Linux.Resources.Devices {
+				if rule.Type != tt.want.Type || *rule.Major != tt.want.Major || *rule.Minor != tt.want.Minor {
+					t.Errorf("got rule %+v, want the one of the device", rule)
+				}
+				access = append(access, rule.Access)
+			}
+			var wantAccess []string
+			if tt.wantAccess != "" {
+				wantAccess = []string{tt.wantAccess}
+			}
+			if !reflect.DeepEqual(access, wantAccess) {
+				t.Errorf("got cgroup access %v, want %v", access, wantAccess)
+			}
+		})
+	}
+}
+
+func TestAddCDIHook(t *testing.T) {
+	spec := &specs.Spec{}
+	if err := addCDIHook(spec, &cdi.Hook{HookName: "createContainer", Path: "/bin/true"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Hooks.CreateContainer) != 1 {
+		t.Errorf("hook was not added: %+v", spec.Hooks)
+	}
+	// The same hook is added once, but not a hook with other arguments.
+	for _, args := range [][]string{nil, {"true", "-v"}} {
+		if err := addCDIHook(spec, &cdi.Hook{HookName: "createContainer", Path: "/bin/true", Args: args}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(spec.Hooks.CreateContainer) != 2 {
+		t.Errorf("got hooks %+v, want 2 createContainer hooks", spec.Hooks.CreateContainer)
+	}
+	if err := addCDIHook(spec, &cdi.Hook{HookName: "unknown", Path: "/bin/true"}); err == nil {
+		t.Error("expected an error, got none")
+	}
+}
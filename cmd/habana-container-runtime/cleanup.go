@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/HabanaAI/habana-container-runtime/artifact"
+	"github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/discover"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const poststopCommand = "poststop"
+
+// artifactStore is replaced in tests, not to record the test containers on
+// the host.
+var artifactStore = func(cfg *config.Config) *artifact.Store {
+	return artifact.NewStore(cfg.Runtime.ArtifactsDir)
+}
+
+// poststop cleans up the container whose state is read from stdin, as its
+// poststop hook.
+func poststop(logger *slog.Logger, cfg *config.Config, stdin io.Reader) error {
+	var state specs.State
+	if err := json.NewDecoder(stdin).Decode(&state); err != nil {
+		return fmt.Errorf("reading container state: %w", err)
+	}
+	logger.Info("Container stopped", "container", state.ID)
+	cleanupContainer(logger, cfg, state.ID)
+	return nil
+}
+
+// cleanupContainer removes what was created for the container outside of its
+// spec, and releases its leases. It runs both in the poststop hook and after
+// delete, the second run finds nothing left. Failures are only logged.
+func cleanupContainer(logger *slog.Logger, cfg *config.Config, id string) {
+	if id == "" {
+		return
+	}
+	logger.Debug("Removing container artifacts", "container", id)
+	if err := artifactStore(cfg).Cleanup(id); err != nil {
+		logger.Warn("Removing container artifacts", "container", id, "error", err)
+	}
+	releaseLeases(logger, cfg, id)
+}
+
+// recordArtifacts records the files created in the container rootfs, among
+// files, and the links exposing the devices network interfaces in a network
+// namespace outliving the container. Links in a private namespace are gone
+// with it.
+func recordArtifacts(logger *slog.Logger, spec *specs.Spec, cfg *config.Config, args []string, rootfs string, devices []discover.Accelerator, files []string) {
+	r := artifact.Record{Container: parseContainerID(args)}
+	if r.Container == "" {
+		return
+	}
+	if spec.Linux != nil {
+		for _, ns := range spec.Linux.Namespaces {
+			if ns.Type == specs.NetworkNamespace {
+				r.NetNS = ns.Path
+			}
+		}
+	}
+	if r.NetNS != "" {
+		for _, acc := range devices {
+			for _, netDev := range acc.NetDevs {
+				r.Links = append(r.Links, netDev.Name)
+			}
+		}
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			r.Files = append(r.Files, f)
+		}
+	}
+	if len(r.Files) != 0 {
+		r.Rootfs = rootfs
+	}
+	if len(r.Links) == 0 && len(r.Files) == 0 {
+		return
+	}
+
+	logger.Debug("Recording container artifacts", "container", r.Container, "netns", r.NetNS, "links", r.Links, "files", r.Files)
+	if err := artifactStore(cfg).Add(r); err != nil {
+		logger.Warn("Recording container artifacts", "container", r.Container, "error", err)
+	}
+}
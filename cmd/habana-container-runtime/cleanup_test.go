@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/artifact"
+	"github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/lease"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestMain(m *testing.M) {
+	// The test binary runs as the runtime, for the tests of its exit status.
+	if os.Getenv(testMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+
+	dir, err := os.MkdirTemp("", "artifacts")
+	if err != nil {
+		panic(err)
+	}
+	artifactStore = func(*config.Config) *artifact.Store { return artifact.NewStore(dir) }
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestPoststopCleanup(t *testing.T) {
+	t.Cleanup(func() {
+		execLookPath = exec.LookPath
+		osExecutable = os.Executable
+	})
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+	osExecutable = func() (string, error) { return "/usr/bin/habana-container-runtime", nil }
+
+	bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=0")
+	// The container joins the network namespace of its pod.
+	spec, err := loadSpecs(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.Linux.Namespaces = []specs.LinuxNamespace{{Type: specs.NetworkNamespace, Path: filepath.Join(t.TempDir(), "netns")}}
+	if err := saveSpecs(filepath.Join(bundle, "config.json"), spec); err != nil {
+		t.Fatal(err)
+	}
+
+	leases := t.TempDir()
+	cfg := &config.Config{
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		MountAccelerators:        true,
+		NetworkL3Config:          config.NetworkConfig{Path: filepath.Join(bundle, "gaudinet.json")},
+		Runtime: config.RuntimeConfig{
+			Mode:          config.ModeOCI,
+			DiscoveryRoot: "../../discover/testdata/hls2",
+			Leases:        config.LeasesConfig{Mode: config.LeaseModeExclusive, Dir: leases},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := handleRequest(logger, cfg, []string{"create", "--bundle", bundle, "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadSpecs(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Hooks == nil || len(got.Hooks.Poststop) != 1 || got.Hooks.Poststop[0].Path != "/usr/bin/habana-container-runtime" {
+		t.Fatalf("got hooks %+v, want the runtime poststop hook", got.Hooks)
+	}
+	record, err := artifactStore(cfg).Load("test")
+	if err != nil || record == nil {
+		t.Fatalf("got record %+v, error %v", record, err)
+	}
+	macAddrInfo := filepath.Join(bundle, "rootfs/etc/habanalabs/macAddrInfo.json")
+	if len(record.Links) == 0 || len(record.Files) != 1 || record.Files[0] != macAddrInfo {
+		t.Errorf("got record %+v, want the links and macAddrInfo.json", record)
+	}
+
+	state := `{"ociVersion": "1.1.0", "id": "test", "status": "stopped", "bundle": "` + bundle + `"}`
+	if err := poststop(logger, cfg, strings.NewReader(state)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(macAddrInfo); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("macAddrInfo.json not removed: %v", err)
+	}
+	if record, err := artifactStore(cfg).Load("test"); record != nil || err != nil {
+		t.Errorf("got record %+v, error %v after cleanup, want none", record, err)
+	}
+	held, err := lease.NewRegistry(leases).List()
+	if err != nil || len(held) != 0 {
+		t.Errorf("got leases %+v, error %v after cleanup, want none", held, err)
+	}
+
+	// A forced delete after poststop finds nothing left.
+	cleanupContainer(logger, cfg, "test")
+}
+
+func TestPoststopInvalidState(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := poststop(logger, &config.Config{}, strings.NewReader("{")); err == nil {
+		t.Error("got no error, want the state decoding failure")
+	}
+}
+
+func TestRecordArtifactsImageFiles(t *testing.T) {
+	bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=0")
+	// The image ships its own gaudinet.json, which is not removed.
+	gaudinet := filepath.Join(bundle, "rootfs/etc/habanalabs/gaudinet.json")
+	if err := os.MkdirAll(filepath.Dir(gaudinet), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gaudinet, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bundle, "gaudinet.json"), []byte(`{"NIC_NET_CONFIG": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		NetworkL3Config:          config.NetworkConfig{Path: filepath.Join(bundle, "gaudinet.json")},
+		Runtime: config.RuntimeConfig{
+			Mode:          config.ModeOCI,
+			DiscoveryRoot: "../../discover/testdata/hls2",
+		},
+	}
+	t.Cleanup(func() { execLookPath = exec.LookPath })
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := handleRequest(logger, cfg, []string{"create", "--bundle", bundle, "image-files"}); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := artifactStore(cfg).Load("image-files")
+	if err != nil || record == nil {
+		t.Fatalf("got record %+v, error %v", record, err)
+	}
+	want := filepath.Join(bundle, "rootfs/etc/habanalabs/macAddrInfo.json")
+	if len(record.Files) != 1 || record.Files[0] != want || len(record.Links) != 0 {
+		t.Errorf("got record %+v, want only %s", record, want)
+	}
+	// Without a network namespace path, the links are gone with the container.
+	var content map[string]any
+	if b, err := os.ReadFile(gaudinet); err != nil || json.Unmarshal(b, &content) != nil {
+		t.Errorf("gaudinet.json unreadable: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/discover"
+)
+
+const configCommand = "config"
+
+const configUsage = "usage: habana-container-runtime config validate|dump\n"
+
+// configMain runs the config subcommands, and returns the exit status:
+//
+//	habana-container-runtime config validate
+//	habana-container-runtime config dump
+//
+// validate checks the config the runtime, the hook and the CLI load, and fails
+// when they would not run with it, or when it has unknown keys they ignore.
+// dump prints it with the source of each value.
+func configMain(w io.Writer, args []string) int {
+	positional := positionalArgs(args)
+	if len(positional) != 2 {
+		fmt.Fprint(w, configUsage)
+		return 2
+	}
+
+	switch positional[1] {
+	case "validate":
+		cfg, err := config.LoadStrict()
+		if err != nil {
+			fmt.Fprintf(w, "error: %s\n", err)
+			return 1
+		}
+		errs, warnings := checkConfig(cfg)
+		for _, msg := range warnings {
+			fmt.Fprintf(w, "warning: %s\n", msg)
+		}
+		for _, msg := range errs {
+			fmt.Fprintf(w, "error: %s\n", msg)
+		}
+		if len(errs) != 0 {
+			fmt.Fprintf(w, "%s: invalid\n", strings.Join(cfg.Files, ", "))
+			return 1
+		}
+		fmt.Fprintf(w, "%s: valid\n", strings.Join(cfg.Files, ", "))
+		return 0
+	case "dump":
+		cfg, err := config.Load()
+		if err != nil {
+			fmt.Fprintf(w, "error: %s\n", err)
+			return 1
+		}
+		fmt.Fprintf(w, "# Loaded from %s\n", strings.Join(cfg.Files, ", "))
+		if err := cfg.Dump(w); err != nil {
+			fmt.Fprintf(w, "error: %s\n", err)
+			return 1
+		}
+		return 0
+	default:
+		fmt.Fprint(w, configUsage)
+		return 2
+	}
+}
+
+// checkConfig returns the errors of the config the binaries would fail with
+// on this node, and the warnings of the ones they would run without.
+func checkConfig(cfg *config.Config) (errs, warnings []string) {
+	warnings = append(warnings, cfg.Warnings...)
+
+	for _, f := range []struct {
+		key  string
+		path string
+	}{
+		{"habana-container-runtime.debug", cfg.Runtime.DebugFilePath},
+		{"habana-container-cli.debug", cfg.CLI.Debug},
+	} {
+		if _, err := osStat(filepath.Dir(f.path)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: log file directory: %v", f.key, err))
+		}
+	}
+
+	if _, err := osStat(cfg.Runtime.DiscoveryRoot); err != nil {
+		errs = append(errs, fmt.Sprintf("habana-container-runtime.discovery_root: %v", err))
+	}
+
+	if _, err := findLowLevelRuntime(cfg.Runtime.LowLevelRuntime); err != nil {
+		errs = append(errs, fmt.Sprintf("habana-container-runtime.low_level_runtime.paths: %v", err))
+	}
+
+	// The hook is only run in the oci and legacy modes, and the CLI it runs
+	// only in legacy mode.
+	if cfg.Runtime.Mode != config.ModeCDI {
+		if _, err := hookBinaryPath(cfg); err != nil {
+			errs = append(errs, fmt.Sprintf("binaries-dir: %v", err))
+		}
+	}
+	if cfg.Runtime.Mode == config.ModeLegacy && cfg.CLI.Path != nil {
+		if _, err := osStat(*cfg.CLI.Path); err != nil {
+			errs = append(errs, fmt.Sprintf("habana-container-cli.path: %v", err))
+		}
+	}
+
+	if len(cfg.Policies) != 0 && cfg.Runtime.Mode != config.ModeOCI {
+		errs = append(errs, fmt.Sprintf("policy: the rules are only enforced in %s mode, the containers they match are refused in %s mode", config.ModeOCI, cfg.Runtime.Mode))
+	}
+
+	if cfg.Runtime.Mode == config.ModeCDI {
+		for _, dir := range cfg.Runtime.CDI.SpecDirs {
+			if _, err := osStat(dir); err != nil {
+				warnings = append(warnings, fmt.Sprintf("habana-container-runtime.cdi.spec_dirs: %v", err))
+			}
+		}
+	}
+
+	if _, err := osStat(cfg.NetworkL3Config.Path); err != nil {
+		warnings = append(warnings, fmt.Sprintf("network-layer-routes.path: %v, no routes are given to the containers", err))
+	}
+
+	if ldconfig := cfg.Runtime.Utility.Ldconfig; ldconfig != "" {
+		if _, err := osStat(ldconfig); err != nil {
+			warnings = append(warnings, fmt.Sprintf("habana-container-runtime.utility.ldconfig: %v", err))
+		}
+	}
+
+	root, err := discover.NewRoot(cfg.Runtime.DiscoveryRoot)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("habana-container-runtime.discovery_root: %v", err))
+		return errs, warnings
+	}
+	for i, d := range cfg.Devices {
+		matches, err := root.Glob(d.Path)
+		if err == nil && len(matches) == 0 {
+			err = fmt.Errorf("%s not found", d.Path)
+		}
+		if err == nil {
+			continue
+		}
+		if d.Required {
+			errs = append(errs, fmt.Sprintf("devices[%d]: %v", i, err))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("devices[%d]: %v", i, err))
+		}
+	}
+	for i, m := range cfg.Mounts {
+		matches, err := filepath.Glob(m.Source)
+		if err == nil && len(matches) == 0 {
+			err = fmt.Errorf("%s not found", m.Source)
+		}
+		if err == nil {
+			continue
+		}
+		if m.Required {
+			errs = append(errs, fmt.Sprintf("mounts[%d]: %v", i, err))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("mounts[%d]: %v", i, err))
+		}
+	}
+
+	return errs, warnings
+}
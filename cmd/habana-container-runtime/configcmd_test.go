@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes the runtime config file under a XDG_CONFIG_HOME
+// directory, and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	file := filepath.Join(dir, "habana-container-runtime/config.toml")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Cleanup(func() {
+		execLookPath = exec.LookPath
+		osStat = os.Stat
+	})
+	// Only runc is found, the hook binary is not.
+	execLookPath = func(file string) (string, error) {
+		if file == "runc" {
+			return "/usr/bin/runc", nil
+		}
+		return "", exec.ErrNotFound
+	}
+	osStat = func(name string) (fs.FileInfo, error) {
+		if strings.HasSuffix(name, "/habana-container-hook") {
+			return nil, fs.ErrNotExist
+		}
+		return os.Stat(name)
+	}
+
+	logDir := t.TempDir()
+	base := fmt.Sprintf(`
+[network-layer-routes]
+path = %q
+
+[habana-container-cli]
+debug = %q
+
+[habana-container-runtime]
+debug = %q
+discovery_root = "../../discover/testdata/hls2"
+`, filepath.Join(logDir, "gaudinet.json"), filepath.Join(logDir, "hook.log"), filepath.Join(logDir, "runtime.log"))
+
+	tests := []struct {
+		name     string
+		content  string
+		want     []string
+		wantCode int
+	}{
+		{
+			name: "valid",
+			content: base + `mode = "cdi"
+
+[[devices]]
+path = "/dev/infiniband/rdma_cm"
+required = true
+`,
+			want:     []string{"warning: network-layer-routes.path:", ": valid\n"},
+			wantCode: 0,
+		},
+		{
+			name:     "unknown mode",
+			content:  base + `mode = "lagacy"` + "\n",
+			want:     []string{`error: mode must be "oci", "legacy" or "cdi", got "lagacy"`},
+			wantCode: 1,
+		},
+		{
+			name:     "unknown key",
+			content:  base + `mode = "cdi"` + "\nlow_level_runtime_path = \"/usr/bin/runc\"\n",
+			want:     []string{"error: ", "unknown keys: habana-container-runtime.low_level_runtime_path"},
+			wantCode: 1,
+		},
+		{
+			name: "policy outside oci mode",
+			content: base + `mode = "cdi"
+
+[[policy]]
+name = "default"
+devices = "none"
+`,
+			want:     []string{"error: policy: the rules are only enforced in oci mode"},
+			wantCode: 1,
+		},
+		{
+			name: "leases outside oci mode",
+			content: base + `mode = "legacy"
+
+[habana-container-runtime.leases]
+mode = "exclusive"
+`,
+			want:     []string{`error: leases: mode "exclusive" is only enforced in oci mode, not legacy`},
+			wantCode: 1,
+		},
+		{
+			name:     "hook not found",
+			content:  base + `mode = "legacy"` + "\n",
+			want:     []string{"error: binaries-dir: habana-container-hook was not found", ": invalid\n"},
+			wantCode: 1,
+		},
+		{
+			name: "required mount missing",
+			content: base + `mode = "cdi"
+
+[[mounts]]
+source = "/nonexistent/site-ca.pem"
+required = true
+`,
+			want:     []string{"error: mounts[0]: /nonexistent/site-ca.pem not found"},
+			wantCode: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfig(t, tt.content)
+			var b strings.Builder
+			if code := configMain(&b, []string{"config", "validate"}); code != tt.wantCode {
+				t.Errorf("got exit status %d, want %d:\n%s", code, tt.wantCode, b.String())
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(b.String(), want) {
+					t.Errorf("output is missing %q:\n%s", want, b.String())
+				}
+			}
+		})
+	}
+}
+
+func TestConfigDump(t *testing.T) {
+	file := writeConfig(t, "[habana-container-runtime]\nmode = \"cdi\"\n")
+	t.Setenv("HABANA_RUNTIME_LOG_LEVEL", "debug")
+
+	var b strings.Builder
+	if code := configMain(&b, []string{"config", "dump"}); code != 0 {
+		t.Fatalf("got exit status %d:\n%s", code, b.String())
+	}
+	for _, want := range []string{
+		"# Loaded from " + file + "\n",
+		"mode = 'cdi' # " + file + "\n",
+		"log_level = 'DEBUG' # $HABANA_RUNTIME_LOG_LEVEL\n",
+		"numa_placement = false # default\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, b.String())
+		}
+	}
+
+	if code := configMain(&b, []string{"config"}); code != 2 {
+		t.Errorf("got exit status %d without subcommand, want 2", code)
+	}
+}
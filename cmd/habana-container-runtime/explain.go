@@ -0,0 +1,257 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/diff"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const explainCommand = "explain"
+
+// explain prints how the spec of a bundle would be modified on creation,
+// without writing anything or executing the low-level runtime:
+//
+//	habana-container-runtime explain --bundle <dir> [container-id]
+func explain(w io.Writer, cfg *config.Config, args []string) error {
+	bundleDir, err := parseBundle(args)
+	if err != nil {
+		return fmt.Errorf("parsing bundle: %w", err)
+	}
+	bundleConfigFile := filepath.Join(bundleDir, "config.json")
+	content, err := os.ReadFile(bundleConfigFile)
+	if err != nil {
+		return fmt.Errorf("reading OCI spec file: %w", err)
+	}
+	var orig, spec specs.Spec
+	if err := json.Unmarshal(content, &orig); err != nil {
+		return fmt.Errorf("reading OCI spec file: %w", err)
+	}
+	if err := json.Unmarshal(content, &spec); err != nil {
+		return fmt.Errorf("reading OCI spec file: %w", err)
+	}
+
+	// The decisions are the log records of the flow, at any level.
+	fmt.Fprintf(w, "Mode: %s\n\nDecisions:\n", cfg.Runtime.Mode)
+	logger := slog.New(slog.NewTextHandler(&indentWriter{w: w}, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	for _, w := range cfg.Warnings {
+		logger.Warn(w)
+	}
+
+	// The flow is the one of a create command, in place of explain.
+	id := parseContainerID(args)
+	if id == "" {
+		id = explainCommand
+	}
+	createArgs := []string{"create", "--bundle", bundleDir, id}
+	if root := parseRuncRoot(args, ""); root != "" {
+		createArgs = append([]string{"--root", root}, createArgs...)
+	}
+	dry := &dryRun{}
+	if err := modifySpec(logger, cfg, createArgs, bundleDir, &spec, dry); err != nil {
+		fmt.Fprintf(w, "\nThe container creation would fail: %v\n", err)
+		return nil
+	}
+
+	section(w, "Hooks", addedHooks(&orig, &spec))
+	section(w, "Devices", addedDevices(&orig, &spec))
+	section(w, "Cgroup device rules", addedDeviceRules(&orig, &spec))
+	section(w, "Mounts", addedMounts(&orig, &spec))
+	section(w, "Environment", added(processEnv(&orig), processEnv(&spec)))
+	section(w, "Files written in the rootfs", dry.files)
+
+	doc, modified, err := patchedSpec(content, &spec)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(w, "\nconfig.json:\n")
+	if !modified {
+		fmt.Fprint(w, "  unchanged\n")
+		return nil
+	}
+	before, err := decodeDocument(content)
+	if err != nil {
+		return fmt.Errorf("reading OCI spec file: %w", err)
+	}
+	a, err := json.MarshalIndent(before, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling OCI spec: %w", err)
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling OCI spec: %w", err)
+	}
+	fmt.Fprint(w, diff.Unified("a/config.json", "b/config.json", string(a)+"\n", string(b)+"\n"))
+	return nil
+}
+
+// section prints a titled list, or "none".
+func section(w io.Writer, title string, lines []string) {
+	fmt.Fprintf(w, "\n%s:\n", title)
+	if len(lines) == 0 {
+		fmt.Fprint(w, "  none\n")
+	}
+	for _, l := range lines {
+		fmt.Fprintf(w, "  %s\n", l)
+	}
+}
+
+// added returns the entries of mod missing from orig.
+func added(orig, mod []string) []string {
+	seen := make(map[string]bool, len(orig))
+	for _, s := range orig {
+		seen[s] = true
+	}
+	var res []string
+	for _, s := range mod {
+		if !seen[s] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func processEnv(spec *specs.Spec) []string {
+	if spec.Process == nil {
+		return nil
+	}
+	return spec.Process.Env
+}
+
+func addedHooks(orig, mod *specs.Spec) []string {
+	stages := func(spec *specs.Spec) []string {
+		if spec.Hooks == nil {
+			return nil
+		}
+		var res []string
+		for _, s := range []struct {
+			name  string
+			hooks []specs.Hook
+		}{
+			{"prestart", spec.Hooks.Prestart},
+			{"createRuntime", spec.Hooks.CreateRuntime},
+			{"createContainer", spec.Hooks.CreateContainer},
+			{"startContainer", spec.Hooks.StartContainer},
+			{"poststart", spec.Hooks.Poststart},
+			{"poststop", spec.Hooks.Poststop},
+		} {
+			for _, h := range s.hooks {
+				res = append(res, fmt.Sprintf("%s: %s", s.name, strings.Join(h.Args, " ")))
+			}
+		}
+		return res
+	}
+	return added(stages(orig), stages(mod))
+}
+
+func addedDevices(orig, mod *specs.Spec) []string {
+	devices := func(spec *specs.Spec) []string {
+		if spec.Linux == nil {
+			return nil
+		}
+		var res []string
+		for _, d := range spec.Linux.Devices {
+			res = append(res, fmt.Sprintf("%s %s %d:%d", d.Path, d.Type, d.Major, d.Minor))
+		}
+		return res
+	}
+	return added(devices(orig), devices(mod))
+}
+
+func addedDeviceRules(orig, mod *specs.Spec) []string {
+	rules := func(spec *specs.Spec) []string {
+		if spec.Linux == nil || spec.Linux.Resources == nil {
+			return nil
+		}
+		var res []string
+		for _, r := range spec.Linux.Resources.Devices {
+			verdict := "deny"
+			if r.Allow {
+				verdict = "allow"
+			}
+			res = append(res, fmt.Sprintf("%s %s %s:%s %s", verdict, r.Type, devNumber(r.Major), devNumber(r.Minor), r.Access))
+		}
+		return res
+	}
+	res := added(rules(orig), rules(mod))
+	if orig.Linux != nil && mod.Linux != nil && !reflect.DeepEqual(cpuResources(orig), cpuResources(mod)) {
+		cpu := cpuResources(mod)
+		res = append(res, fmt.Sprintf("cpuset cpus=%s mems=%s", cpu.Cpus, cpu.Mems))
+	}
+	return res
+}
+
+func cpuResources(spec *specs.Spec) specs.LinuxCPU {
+	if spec.Linux.Resources == nil || spec.Linux.Resources.CPU == nil {
+		return specs.LinuxCPU{}
+	}
+	return *spec.Linux.Resources.CPU
+}
+
+// devNumber formats a device rule number, where nil matches all of them.
+func devNumber(n *int64) string {
+	if n == nil {
+		return "*"
+	}
+	return fmt.Sprint(*n)
+}
+
+func addedMounts(orig, mod *specs.Spec) []string {
+	mounts := func(spec *specs.Spec) []string {
+		var res []string
+		for _, m := range spec.Mounts {
+			res = append(res, fmt.Sprintf("%s -> %s (%s)", m.Source, m.Destination, strings.Join(m.Options, ",")))
+		}
+		return res
+	}
+	return added(mounts(orig), mounts(mod))
+}
+
+// indentWriter indents the lines written to w.
+type indentWriter struct {
+	w io.Writer
+}
+
+func (iw *indentWriter) Write(p []byte) (int, error) {
+	lines := strings.SplitAfter(string(p), "\n")
+	for _, l := range lines {
+		if l == "" {
+			continue
+		}
+		if _, err := io.WriteString(iw.w, "  "+l); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/config"
+)
+
+func TestExplain(t *testing.T) {
+	t.Cleanup(func() { execLookPath = exec.LookPath })
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+
+	bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=0")
+	leases := filepath.Join(t.TempDir(), "leases")
+	cfg := &config.Config{
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		MountAccelerators:        true,
+		MountUverbs:              true,
+		Runtime: config.RuntimeConfig{
+			Mode:          config.ModeOCI,
+			DiscoveryRoot: "../../discover/testdata/hls2",
+			Leases:        config.LeasesConfig{Mode: config.LeaseModeExclusive, Dir: leases},
+		},
+	}
+	before, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := explain(&out, cfg, []string{"explain", "--bundle", bundle}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Mode: oci\n",
+		`msg="Devices request" devices=0`,
+		"createRuntime: /usr/bin/habana-container-hook createRuntime\n",
+		"/dev/accel/accel0 c 510:0\n",
+		"allow c 510:0 rwm\n",
+		filepath.Join(bundle, "rootfs/etc/habanalabs/macAddrInfo.json") + "\n",
+		"HABANA_VISIBLE_MODULES=1\n",
+		"--- a/config.json\n+++ b/config.json\n",
+		`+        "path": "/dev/accel/accel0",`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output misses %q:\n%s", want, out.String())
+		}
+	}
+
+	after, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("config.json modified:\n%s", after)
+	}
+	if _, err := os.Stat(filepath.Join(bundle, "rootfs/etc/habanalabs")); !os.IsNotExist(err) {
+		t.Errorf("rootfs modified: %v", err)
+	}
+	if _, err := os.Stat(leases); !os.IsNotExist(err) {
+		t.Errorf("leases registry created: %v", err)
+	}
+}
+
+func TestExplainFailure(t *testing.T) {
+	bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=0", "HABANA_DRIVER_CAPABILITIES=bogus")
+	cfg := &config.Config{
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		Runtime: config.RuntimeConfig{
+			Mode:          config.ModeOCI,
+			DiscoveryRoot: "../../discover/testdata/hls2",
+		},
+	}
+
+	var out bytes.Buffer
+	if err := explain(&out, cfg, []string{"explain", "--bundle", bundle, "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "The container creation would fail: reading driver capabilities") {
+		t.Errorf("output misses the failure:\n%s", out.String())
+	}
+}
@@ -29,7 +29,7 @@ func parseBundle(osArgs []string) (string, error) {
 		}
 		if ok {
 			bundleDir = val
-		} else {
+		} else if i+1 < len(osArgs) {
 			bundleDir = osArgs[i+1]
 		}
 		break
@@ -50,3 +50,77 @@ func isBundleFlag(arg string) bool {
 	s := strings.TrimLeft(arg, "-")
 	return s == "b" || s == "bundle"
 }
+
+// runc flags taking a value, global or of the create, run and restore
+// commands, which are skipped when looking for the command and container ID.
+var runcValueFlags = map[string]bool{
+	"b":                   true,
+	"bundle":              true,
+	"console-socket":      true,
+	"pid-file":            true,
+	"preserve-fds":        true,
+	"root":                true,
+	"log":                 true,
+	"log-format":          true,
+	"criu":                true,
+	"rootless":            true,
+	"cgroup-manager":      true,
+	"image-path":          true,
+	"work-path":           true,
+	"manage-cgroups-mode": true,
+	"empty-ns":            true,
+	"lsm-profile":         true,
+	"lsm-mount-context":   true,
+}
+
+// positionalArgs returns the arguments which are not flags or flag values,
+// the command and then the container ID.
+func positionalArgs(osArgs []string) []string {
+	var positional []string
+	for args := osArgs; len(args) != 0; args = args[1:] {
+		arg := args[0]
+		if !strings.HasPrefix(arg, "-") {
+			positional = append(positional, arg)
+			continue
+		}
+		f, _, ok := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !ok && runcValueFlags[f] && len(args) > 1 {
+			args = args[1:]
+		}
+	}
+	return positional
+}
+
+// parseCommand returns the runc command, i.e "create" or "delete".
+func parseCommand(osArgs []string) string {
+	if positional := positionalArgs(osArgs); len(positional) != 0 {
+		return positional[0]
+	}
+	return ""
+}
+
+// parseContainerID returns the container ID of the command.
+func parseContainerID(osArgs []string) string {
+	if positional := positionalArgs(osArgs); len(positional) > 1 {
+		return positional[1]
+	}
+	return ""
+}
+
+// parseRuncRoot returns the runtime state directory, set by the --root global
+// flag, or def.
+func parseRuncRoot(osArgs []string, def string) string {
+	for i, arg := range osArgs {
+		f, val, ok := strings.Cut(arg, "=")
+		if strings.TrimLeft(f, "-") != "root" || !strings.HasPrefix(f, "-") {
+			continue
+		}
+		if ok {
+			return val
+		}
+		if i+1 < len(osArgs) {
+			return osArgs[i+1]
+		}
+	}
+	return def
+}
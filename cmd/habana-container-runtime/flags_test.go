@@ -71,3 +71,37 @@ func TestParseBundleWithoutFlag(t *testing.T) {
 		t.Errorf("got %q, want %q", got, want)
 	}
 }
+
+func TestParseContainerID(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "--root /run/runc create --bundle /bundle test", want: "test"},
+		{input: "create -b /bundle --pid-file=/pid --no-pivot test", want: "test"},
+		{input: "--log /log --systemd-cgroup delete --force test", want: "test"},
+		{input: "restore --image-path /checkpoint --manage-cgroups-mode soft -b /bundle test", want: "test"},
+		{input: "--root create run create", want: "create"},
+		{input: "create --bundle /bundle", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := parseContainerID(strings.Fields(tt.input)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRuncRoot(t *testing.T) {
+	for input, want := range map[string]string{
+		"--root /run/docker/runtime-runc/moby create test": "/run/docker/runtime-runc/moby",
+		"--root=/run/containerd/runc/k8s.io delete test":   "/run/containerd/runc/k8s.io",
+		"create --bundle /root test":                       "/run/runc",
+	} {
+		if got := parseRuncRoot(strings.Fields(input), "/run/runc"); got != want {
+			t.Errorf("%q: got %q, want %q", input, got, want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/lease"
+
+	"golang.org/x/mod/semver"
+)
+
+// lowLevelKind describes a low-level OCI runtime the runtime can wrap.
+type lowLevelKind struct {
+	// Oldest version running the createRuntime hooks.
+	minVersion string
+	// Global flags using the systemd cgroup driver.
+	systemdCgroup []string
+	// Default state directory, holding a directory per container.
+	stateRoot string
+}
+
+var lowLevelKinds = map[string]lowLevelKind{
+	"runc":  {minVersion: "v1.0.0", systemdCgroup: []string{"--systemd-cgroup"}, stateRoot: lease.DefaultRuncRoot},
+	"crun":  {minVersion: "v1.0.0", systemdCgroup: []string{"--cgroup-manager=systemd"}, stateRoot: "/run/crun"},
+	"youki": {minVersion: "v0.1.0", systemdCgroup: []string{"--systemd-cgroup"}, stateRoot: "/run/youki"},
+}
+
+var runtimeVersion = runtimeVersionFunc
+
+// runtimeVersionFunc returns the output of the low-level runtime --version.
+func runtimeVersionFunc(path string) ([]byte, error) {
+	return exec.Command(path, "--version").Output()
+}
+
+// lowLevelRuntime is the low-level OCI runtime the container commands are
+// passed to.
+type lowLevelRuntime struct {
+	path string
+	// Name of the runtime, i.e "runc" for docker-runc.
+	name string
+	args []string
+}
+
+// findLowLevelRuntime returns the first configured runtime found, by absolute
+// path or in PATH.
+func findLowLevelRuntime(cfg config.LowLevelRuntimeConfig) (*lowLevelRuntime, error) {
+	for _, p := range cfg.Paths {
+		if filepath.IsAbs(p) {
+			if _, err := osStat(p); err != nil {
+				continue
+			}
+		} else {
+			var err error
+			if p, err = execLookPath(p); err != nil {
+				continue
+			}
+		}
+		return &lowLevelRuntime{
+			path: p,
+			name: strings.TrimPrefix(filepath.Base(p), "docker-"),
+			args: cfg.Args,
+		}, nil
+	}
+	return nil, fmt.Errorf("low-level runtime not found, searched %s", strings.Join(cfg.Paths, ", "))
+}
+
+// stateRoot returns the directory holding the runtime state of the containers,
+// set by the --root global flag or the default of the runtime.
+func (r *lowLevelRuntime) stateRoot(args []string) string {
+	def := lease.DefaultRuncRoot
+	if kind, ok := lowLevelKinds[r.name]; ok {
+		def = kind.stateRoot
+	}
+	return parseRuncRoot(append(slices.Clone(r.args), args...), def)
+}
+
+// runtimeStateRoot returns the state directory of the configured low-level
+// runtime, the runc one when it is not found.
+func runtimeStateRoot(cfg *config.Config, args []string) string {
+	r, err := findLowLevelRuntime(cfg.Runtime.LowLevelRuntime)
+	if err != nil {
+		return parseRuncRoot(args, lease.DefaultRuncRoot)
+	}
+	return r.stateRoot(args)
+}
+
+// checkVersion returns an error when the runtime is older than the oldest
+// supported version. Runtimes of unknown kinds are not checked.
+func (r *lowLevelRuntime) checkVersion(logger *slog.Logger) error {
+	kind, ok := lowLevelKinds[r.name]
+	if !ok {
+		logger.Warn("Unknown low-level runtime, version not checked", "path", r.path)
+		return nil
+	}
+	out, err := runtimeVersion(r.path)
+	if err != nil {
+		return fmt.Errorf("getting %s version: %w", r.path, err)
+	}
+	version := parseRuntimeVersion(string(out))
+	if !semver.IsValid(version) {
+		return fmt.Errorf("invalid %s version %q", r.path, strings.TrimSpace(string(out)))
+	}
+	if semver.Compare(version, kind.minVersion) < 0 {
+		return fmt.Errorf("%s version %s is not supported, %s or newer is required", r.name, version, kind.minVersion)
+	}
+	logger.Debug("Low-level runtime version", "path", r.path, "version", version)
+	return nil
+}
+
+// parseRuntimeVersion returns the semver of the "<name> version <version>" line
+// printed by runc, crun and youki.
+func parseRuntimeVersion(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[1] == "version" {
+			return "v" + strings.TrimPrefix(fields[2], "v")
+		}
+	}
+	return ""
+}
+
+// command returns the arguments executing the runtime with the container
+// command arguments.
+func (r *lowLevelRuntime) command(args []string, systemdCgroup bool) []string {
+	cmdArgs := []string{r.path}
+	if systemdCgroup {
+		if kind, ok := lowLevelKinds[r.name]; ok {
+			cmdArgs = append(cmdArgs, kind.systemdCgroup...)
+		} else {
+			cmdArgs = append(cmdArgs, "--systemd-cgroup")
+		}
+	}
+	cmdArgs = append(cmdArgs, r.args...)
+	return append(cmdArgs, args...)
+}
+
+func execRuncFunc(logger *slog.Logger, cfg *config.Config, args []string) error {
+	r, err := findLowLevelRuntime(cfg.Runtime.LowLevelRuntime)
+	if err != nil {
+		return err
+	}
+	logger.Debug("Low-level runtime path", "path", r.path)
+
+	// The version is only checked on create, as the runtime is executed for
+	// every container command.
+	if hasSpecCommand(args) {
+		if err := r.checkVersion(logger); err != nil {
+			return err
+		}
+	}
+
+	cmdArgs := r.command(args, cfg.Runtime.SystemdCgroup)
+	logger.Debug("Executing low-level runtime command", "cmd", cmdArgs)
+
+	return syscall.Exec(r.path, cmdArgs, os.Environ())
+}
+
+// runRuncFunc runs the low-level runtime as a child process, with the
+// container command arguments and the runtime stdio, and waits for it. The
+// error is an *exec.ExitError when it failed.
+func runRuncFunc(logger *slog.Logger, cfg *config.Config, args []string) error {
+	r, err := findLowLevelRuntime(cfg.Runtime.LowLevelRuntime)
+	if err != nil {
+		return err
+	}
+
+	cmdArgs := r.command(args, cfg.Runtime.SystemdCgroup)
+	logger.Debug("Running low-level runtime command", "cmd", cmdArgs)
+
+	cmd := exec.Command(r.path, cmdArgs[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
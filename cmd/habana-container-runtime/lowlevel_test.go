@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/config"
+)
+
+func TestParseRuntimeVersion(t *testing.T) {
+	for out, want := range map[string]string{
+		"runc version 1.1.12\ncommit: v1.1.12-0-g51d5e94\nspec: 1.0.2-dev\n":    "v1.1.12",
+		"crun version 1.14\ncommit: 667e6ebd\nrundir: /run/crun\nspec: 1.0.0\n": "v1.14",
+		"youki version 0.3.0\ncommit: 0.3.0-0-5a8a2b7\n":                        "v0.3.0",
+		"unexpected": "",
+	} {
+		if got := parseRuntimeVersion(out); got != want {
+			t.Errorf("%q: got %q, want %q", out, got, want)
+		}
+	}
+}
+
+func TestFindLowLevelRuntime(t *testing.T) {
+	t.Cleanup(func() {
+		execLookPath = exec.LookPath
+		osStat = os.Stat
+	})
+	execLookPath = func(file string) (string, error) {
+		if file == "runc" {
+			return "/usr/bin/runc", nil
+		}
+		return "", exec.ErrNotFound
+	}
+	osStat = func(name string) (os.FileInfo, error) {
+		if name == "/usr/local/bin/crun" {
+			return nil, nil
+		}
+		return nil, fs.ErrNotExist
+	}
+
+	tests := []struct {
+		paths    []string
+		wantPath string
+		wantName string
+	}{
+		{paths: []string{"docker-runc", "runc"}, wantPath: "/usr/bin/runc", wantName: "runc"},
+		{paths: []string{"/opt/crun", "/usr/local/bin/crun", "runc"}, wantPath: "/usr/local/bin/crun", wantName: "crun"},
+		{paths: []string{"youki"}},
+	}
+	for _, tt := range tests {
+		r, err := findLowLevelRuntime(config.LowLevelRuntimeConfig{Paths: tt.paths})
+		if tt.wantPath == "" {
+			if err == nil {
+				t.Errorf("%v: got %+v, want an error", tt.paths, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", tt.paths, err)
+		}
+		if r.path != tt.wantPath || r.name != tt.wantName {
+			t.Errorf("%v: got %s (%s), want %s (%s)", tt.paths, r.path, r.name, tt.wantPath, tt.wantName)
+		}
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	t.Cleanup(func() { runtimeVersion = runtimeVersionFunc })
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name    string
+		out     string
+		err     error
+		wantErr bool
+	}{
+		{name: "runc", out: "runc version 1.1.12\n"},
+		{name: "runc", out: "runc version 1.0.0-rc10\n", wantErr: true},
+		{name: "crun", out: "crun version 1.14\n"},
+		{name: "crun", out: "crun version 0.13\n", wantErr: true},
+		{name: "crun", err: errors.New("exit status 1"), wantErr: true},
+		{name: "youki", out: "garbage", wantErr: true},
+		{name: "kata-runtime", err: errors.New("not called")},
+	}
+	for _, tt := range tests {
+		runtimeVersion = func(string) ([]byte, error) { return []byte(tt.out), tt.err }
+		r := &lowLevelRuntime{path: "/usr/bin/" + tt.name, name: tt.name}
+		if err := r.checkVersion(logger); (err != nil) != tt.wantErr {
+			t.Errorf("%s %q: got error %v, want error %t", tt.name, tt.out, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLowLevelRuntimeCommand(t *testing.T) {
+	tests := []struct {
+		r             lowLevelRuntime
+		systemdCgroup bool
+		want          []string
+	}{
+		{
+			r:    lowLevelRuntime{path: "/usr/bin/runc", name: "runc"},
+			want: []string{"/usr/bin/runc", "create", "test"},
+		},
+		{
+			r:             lowLevelRuntime{path: "/usr/bin/runc", name: "runc", args: []string{"--debug"}},
+			systemdCgroup: true,
+			want:          []string{"/usr/bin/runc", "--systemd-cgroup", "--debug", "create", "test"},
+		},
+		{
+			r:             lowLevelRuntime{path: "/usr/bin/crun", name: "crun"},
+			systemdCgroup: true,
+			want:          []string{"/usr/bin/crun", "--cgroup-manager=systemd", "create", "test"},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.r.command([]string{"create", "test"}, tt.systemdCgroup); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("got %v, want %v", got, tt.want)
+		}
+	}
+}
+
+func TestLowLevelRuntimeStateRoot(t *testing.T) {
+	crun := &lowLevelRuntime{path: "/usr/bin/crun", name: "crun"}
+	if got, want := crun.stateRoot([]string{"delete", "test"}), "/run/crun"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	crun.args = []string{"--root=/run/k8s/crun"}
+	if got, want := crun.stateRoot([]string{"delete", "test"}), "/run/k8s/crun"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -16,17 +16,24 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path"
+	"slices"
 	"strings"
-	"syscall"
 
+	"github.com/HabanaAI/habana-container-runtime/capability"
 	"github.com/HabanaAI/habana-container-runtime/config"
 	"github.com/HabanaAI/habana-container-runtime/discover"
+	"github.com/HabanaAI/habana-container-runtime/lease"
 	"github.com/HabanaAI/habana-container-runtime/netinfo"
+	"github.com/HabanaAI/habana-container-runtime/policy"
+	"github.com/HabanaAI/habana-container-runtime/request"
+	"github.com/HabanaAI/habana-container-runtime/topology"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
 )
@@ -43,18 +50,40 @@ const (
 )
 
 var (
-	osReadDir    = os.ReadDir
 	execRunc     = execRuncFunc
+	runRunc      = runRuncFunc
 	execLookPath = exec.LookPath
 	osStat       = os.Stat
 	osExecutable = os.Executable
 )
 
 func main() {
-	cfg, err := config.Load()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
-		os.Exit(1)
+	// The config command reports the config errors Load would fail with.
+	if parseCommand(os.Args[1:]) == configCommand {
+		os.Exit(configMain(os.Stdout, os.Args[1:]))
+	}
+
+	// The commands which do not need the config, like the kill and delete of
+	// the running containers, are given to runc with the defaults, so that a
+	// broken config does not break them. Nothing is written on stderr, as
+	// its content is parsed with the output of some of them.
+	cfg, loadErr := config.Load()
+	if loadErr != nil {
+		if needsConfig(os.Args[1:]) {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", loadErr)
+			os.Exit(1)
+		}
+		defaults := config.Default()
+		cfg = &defaults
+	}
+
+	// explain writes nothing, the log included.
+	if parseCommand(os.Args[1:]) == explainCommand {
+		if err := explain(os.Stdout, cfg, os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	logFile, err := os.OpenFile(cfg.Runtime.DebugFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -65,10 +94,34 @@ func main() {
 	defer logFile.Close()
 
 	logger := slog.New(slog.NewJSONHandler(logFile, &slog.HandlerOptions{Level: cfg.Runtime.LogLevel}))
+	if loadErr != nil {
+		logger.Warn("Loading config, using the defaults", "error", loadErr)
+	}
+	for _, w := range cfg.Warnings {
+		logger.Warn(w)
+	}
+
+	// The runtime is the poststop hook of the containers it modified.
+	if parseCommand(os.Args[1:]) == poststopCommand {
+		if err := poststop(logger, cfg, os.Stdin); err != nil {
+			logger.Error(err.Error())
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	if err := run(logger, cfg, os.Args[1:]); err != nil {
 		logger.Error(err.Error())
+		// The low-level runtime printed its own errors, only its exit status
+		// is kept.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		// runc was not executed, the engine must see the container rejected.
 		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(1)
 	}
 }
 
@@ -85,16 +138,29 @@ func run(logger *slog.Logger, cfg *config.Config, args []string) (err error) {
 		return err
 	}
 
-	return execRunc(logger, args, cfg.Runtime.SystemdCgroup)
+	// runc is executed in place of the runtime, except on delete, where the
+	// container is cleaned up once runc deleted it: containers which crashed
+	// did not run their poststop hook yet. A failed delete, i.e of a running
+	// container without --force, leaves it and what it holds in place.
+	if hasDeleteCommand(args) {
+		if err := runRunc(logger, cfg, args); err != nil {
+			return err
+		}
+		cleanupContainer(logger, cfg, parseContainerID(args))
+		return nil
+	}
+
+	return execRunc(logger, cfg, args)
 }
 
 // handleRequest manages the flow of the incoming command. Based on the command type
 // and container environment variable, we either skip everything altogether, or
 // modify the container specs based on the provided environment variables.
 func handleRequest(logger *slog.Logger, cfg *config.Config, args []string) error {
-	// If has 'create' command', then need to modify runc
-	// otherwide, no modification needed
-	if !hasCreateCommand(args) {
+	// Only the commands creating a container from the bundle spec, create, run
+	// and restore, need to modify it. Restored containers get their devices and
+	// hooks again, as the spec is read again from the bundle.
+	if !hasSpecCommand(args) {
 		logger.Debug("Not a create command, skipping", "command", args)
 		return nil
 	}
@@ -120,12 +186,43 @@ func handleRequest(logger *slog.Logger, cfg *config.Config, args []string) error
 		}
 	}()
 
+	return modifySpec(logger, cfg, args, bundleDir, specConfig, nil)
+}
+
+// dryRun records what modifySpec would change outside of the spec.
+type dryRun struct {
+	// Files written in the container rootfs.
+	files []string
+}
+
+// modifySpec adds the requested devices and everything they need to the spec
+// of the bundle. In dry runs, nothing is changed outside of the spec, and the
+// changes are recorded instead.
+func modifySpec(logger *slog.Logger, cfg *config.Config, args []string, bundleDir string, specConfig *specs.Spec, dry *dryRun) error {
 	// If user didn't ask specifically for always trying to mount the devices
 	// to each container, skip. This keeps the environment and runtime flow cleaner,
 	// and skips containers that do not asked for devices.
-	if !cfg.Runtime.AlwaysMount && !IsHabanaContainer(specConfig) {
+	req, err := devicesRequest(specConfig, cfg)
+	if err != nil && cfg.Runtime.Mode != config.ModeLegacy {
+		// The devices are not injected, but the container still starts, and
+		// the reason is recorded in its environment.
+		logger.Warn("Ignoring devices request", "error", err)
+		addErrorEnvVar(specConfig, err.Error())
 		return nil
 	}
+	// In legacy mode, the hook refuses the request itself.
+	if !cfg.Runtime.AlwaysMount && req == nil && err == nil {
+		return nil
+	}
+	if req != nil {
+		logger.Debug("Devices request", "devices", req.Devices, "source", req.Source)
+	}
+
+	root, err := discover.NewRoot(cfg.Runtime.DiscoveryRoot)
+	if err != nil {
+		return fmt.Errorf("loading discovery root: %w", err)
+	}
+	logger.Debug("Discovery root", "path", root.Path())
 
 	// If legacy mode, add habana-hook as a prestart hook, and return to
 	// execute runc. The hook and libhabana takes cares of the devices mounts.
@@ -135,42 +232,163 @@ func handleRequest(logger *slog.Logger, cfg *config.Config, args []string) error
 		if err != nil {
 			return fmt.Errorf("adding habana prestart hook: %s", err)
 		}
+
+		// The prestart hook runs too late to change the container environment,
+		// so the modules are exposed here. Failures are reported by the hook.
+		requestedDevices, err := requestedAccelerators(specConfig, req, root, nil)
+		if err != nil {
+			logger.Warn("Selecting devices for "+EnvHLVisibleModules, "error", err)
+			return nil
+		}
+		if len(requestedDevices) != 0 {
+			if err := checkPolicyMode(specConfig, cfg); err != nil {
+				addErrorEnvVar(specConfig, err.Error())
+				return err
+			}
+			if err := checkRequirementsMode(specConfig, cfg); err != nil {
+				addErrorEnvVar(specConfig, err.Error())
+				return err
+			}
+			addVisibleModules(logger, specConfig, requestedDevices)
+		}
+		return nil
+	}
+
+	// If CDI mode, the devices and everything they need are described by the
+	// CDI spec files, and we only apply their edits.
+	if cfg.Runtime.Mode == config.ModeCDI {
+		logger.Info("In CDI mode")
+		err = applyCDIDevices(logger, specConfig, req, cfg, root)
+		if err != nil {
+			addErrorEnvVar(specConfig, err.Error())
+			return fmt.Errorf("applying CDI devices: %w", err)
+		}
 		return nil
 	}
 
-	// Always add this hook to expose network interfaces information
-	// inside the container
-	err = addCreateRuntimeHook(logger, specConfig, cfg)
+	// The driver capabilities select what is injected with the devices.
+	caps, err := driverCapabilities(specConfig, cfg)
 	if err != nil {
-		return fmt.Errorf("adding createRuntime hook: %w", err)
+		addErrorEnvVar(specConfig, err.Error())
+		return fmt.Errorf("reading driver capabilities: %w", err)
 	}
+	logger.Debug("Driver capabilities", "capabilities", caps.String())
 
 	// We get the available devices based on the user request. If requested device is not
 	// available, we'll return here and log the info. If the options is 'all' or not set,
 	// we get all the devices.
-	requestedDevices := discover.DevicesIDs(filterDevicesByENV(specConfig, discover.AcceleratorDevices()))
+	free := func(devices []discover.Accelerator) ([]discover.Accelerator, error) {
+		return freeDevices(specConfig, cfg, args, devices)
+	}
+	requestedDevices, err := requestedAccelerators(specConfig, req, root, free)
+	if err != nil {
+		if errors.Is(err, discover.ErrNoDevices) {
+			logger.Info("No habanalabs accelerators found")
+			return nil
+		}
+		addErrorEnvVar(specConfig, err.Error())
+		return fmt.Errorf("selecting devices: %w", err)
+	}
 	if len(requestedDevices) == 0 {
-		logger.Info("No habanalabs accelerators found")
+		logger.Info("No requested habanalabs accelerators found")
 		return nil
 	}
-	logger.Debug("Requested devices", "devices", requestedDevices)
+	logger.Debug("Requested devices", "devices", discover.IDs(requestedDevices))
+	if err := topology.Check(requestedDevices); err != nil {
+		logger.Warn("Requested devices cannot use the scale-up links together", "error", err)
+	}
+
+	// The devices are admitted by the first policy rule matching the container.
+	// Denied requests are not injected, but the container still starts, and
+	// the reason is recorded in its environment.
+	decision, err := admitDevices(logger, specConfig, cfg, requestedDevices)
+	if err != nil {
+		logger.Warn("Ignoring devices request", "error", err)
+		addErrorEnvVar(specConfig, err.Error())
+		return nil
+	}
+	if decision.Reason != "" {
+		logger.Warn("Devices request trimmed", "reason", decision.Reason)
+		addErrorEnvVar(specConfig, decision.Reason)
+	}
+	requestedDevices = decision.Devices
+
+	// Containers declaring requirements the node does not meet are rejected,
+	// rather than crashing on an older driver.
+	err = checkRequirements(logger, specConfig, root, requestedDevices)
+	if err != nil {
+		addErrorEnvVar(specConfig, err.Error())
+		return fmt.Errorf("checking requirements: %w", err)
+	}
+
+	// The hook exposes the network interfaces of the admitted devices, it is
+	// only added once they are admitted, and when the policy allows it.
+	if decision.Network {
+		addAdmittedDevices(logger, specConfig, requestedDevices)
+		err = addCreateRuntimeHook(logger, specConfig, cfg)
+		if err != nil {
+			return fmt.Errorf("adding createRuntime hook: %w", err)
+		}
+	}
+
+	// The runtime is called back once the container is stopped, to release
+	// its leases and remove what was created for it.
+	err = addPoststopHook(logger, specConfig)
+	if err != nil {
+		logger.Warn("Adding poststop hook", "error", err)
+	}
+
+	if leasesEnabled(cfg) {
+		err = acquireLeases(logger, specConfig, cfg, args, requestedDevices, dry != nil)
+		if err != nil {
+			addErrorEnvVar(specConfig, err.Error())
+			return fmt.Errorf("acquiring device leases: %w", err)
+		}
+	}
+
+	if cfg.Runtime.NUMAPlacement {
+		err = alignNUMA(logger, specConfig, root, requestedDevices)
+		if err != nil {
+			addErrorEnvVar(specConfig, err.Error())
+			logger.Error(fmt.Sprintf("NUMA placement failed: %v", err))
+		}
+	}
 
 	if cfg.MountAccelerators {
-		err = addAcceleratorDevices(logger, specConfig, requestedDevices)
+		err = addAcceleratorDevices(logger, specConfig, root, requestedDevices, caps)
 		if err != nil {
 			addErrorEnvVar(specConfig, err.Error())
 			return fmt.Errorf("adding accelerator devices: %w", err)
 		}
 	}
 
-	if cfg.MountUverbs {
-		err = addUverbsDevices(logger, specConfig, requestedDevices)
+	addVisibleModules(logger, specConfig, requestedDevices)
+
+	if cfg.MountUverbs && decision.Uverbs && caps.Has(capability.RDMA) {
+		err = addUverbsDevices(logger, specConfig, root, requestedDevices)
 		if err != nil {
 			addErrorEnvVar(specConfig, err.Error())
 			return fmt.Errorf("adding uverb devices: %w", err)
 		}
 	}
 
+	// The site devices and mounts of the config follow the capabilities, and
+	// rdma ones the uverbs decision of the policy.
+	extraCaps := caps
+	if !decision.Uverbs {
+		extraCaps &^= capability.RDMA
+	}
+	err = addConfigDevices(logger, specConfig, cfg, root, extraCaps)
+	if err != nil {
+		addErrorEnvVar(specConfig, err.Error())
+		return fmt.Errorf("adding config devices: %w", err)
+	}
+	err = addConfigMounts(logger, specConfig, cfg, extraCaps)
+	if err != nil {
+		addErrorEnvVar(specConfig, err.Error())
+		return fmt.Errorf("adding config mounts: %w", err)
+	}
+
 	// Docker saves the abolute path while containerd mentions the folder name
 	// relative to the bundle dir.
 	containerRootFS := path.Join(bundleDir, specConfig.Root.Path)
@@ -178,6 +396,40 @@ func handleRequest(logger *slog.Logger, cfg *config.Config, args []string) error
 		containerRootFS = specConfig.Root.Path
 	}
 
+	if caps.Has(capability.Utility) {
+		err = addUtilityFiles(logger, specConfig, cfg, containerRootFS)
+		if err != nil {
+			addErrorEnvVar(specConfig, err.Error())
+			logger.Error(fmt.Sprintf("adding utility files failed: %v", err))
+		}
+	}
+
+	if !decision.Network {
+		logger.Info("Network information not allowed by policy")
+		return nil
+	}
+	if !caps.Has(capability.Network) {
+		logger.Info("Network capability not requested")
+		return nil
+	}
+
+	if dry != nil {
+		dry.files = append(dry.files, path.Join(containerRootFS, netinfo.MACAddrInfoPath))
+		if info, err := os.Stat(cfg.NetworkL3Config.Path); err == nil && info.Size() != 0 {
+			dry.files = append(dry.files, path.Join(containerRootFS, netinfo.GaudinetPath))
+		}
+		return nil
+	}
+
+	// Only the files created here are removed on cleanup, not the ones of
+	// the image.
+	var created []string
+	for _, p := range []string{netinfo.MACAddrInfoPath, netinfo.GaudinetPath} {
+		if _, err := os.Stat(path.Join(containerRootFS, p)); errors.Is(err, fs.ErrNotExist) {
+			created = append(created, path.Join(containerRootFS, p))
+		}
+	}
+
 	err = netinfo.Generate(requestedDevices, containerRootFS)
 	if err != nil {
 		addErrorEnvVar(specConfig, err.Error())
@@ -190,48 +442,184 @@ func handleRequest(logger *slog.Logger, cfg *config.Config, args []string) error
 		logger.Error(fmt.Sprintf("generating gaudinet file failed: %v", err))
 	}
 
+	recordArtifacts(logger, specConfig, cfg, args, containerRootFS, requestedDevices, created)
 	return nil
 }
 
-func execRuncFunc(logger *slog.Logger, args []string, systemdCgroup bool) error {
-	logger.Debug("Looking for 'docker-runc' in PATH")
-	runcPath, err := exec.LookPath("docker-runc")
+// checkPolicyMode refuses the containers a policy rule matches outside of oci
+// mode, where the devices are not injected by the runtime and the rules are
+// not enforced.
+func checkPolicyMode(spec *specs.Spec, cfg *config.Config) error {
+	if cfg.Runtime.Mode == config.ModeOCI {
+		return nil
+	}
+	if rule := policy.Match(cfg.Policies, policy.ContainerFromSpec(spec)); rule != nil {
+		return fmt.Errorf("policy %q matches the container, but policies are only enforced in %s mode, not %s", rule.Name, config.ModeOCI, cfg.Runtime.Mode)
+	}
+	return nil
+}
+
+// checkRequirementsMode refuses the containers declaring requirements outside
+// of oci mode, where the devices are not resolved by the runtime and the
+// requirements are not checked.
+func checkRequirementsMode(spec *specs.Spec, cfg *config.Config) error {
+	if cfg.Runtime.Mode == config.ModeOCI {
+		return nil
+	}
+	reqs, err := request.Requirements(requestContainer(spec))
+	if err != nil || len(reqs) == 0 {
+		return err
+	}
+	return fmt.Errorf("the container declares requirements, but they are only checked in %s mode, not %s", config.ModeOCI, cfg.Runtime.Mode)
+}
+
+// admitDevices applies the first policy rule matching the container to the
+// requested devices.
+func admitDevices(logger *slog.Logger, spec *specs.Spec, cfg *config.Config, devices []discover.Accelerator) (*policy.Decision, error) {
+	rule := policy.Match(cfg.Policies, policy.ContainerFromSpec(spec))
+	if rule == nil {
+		return policy.Allow(devices), nil
+	}
+	logger.Debug("Matched policy", "name", rule.Name)
+	return rule.Admit(devices)
+}
+
+// acquireLeases takes the leases of the devices for the created container. In
+// dry runs, the leases are only checked.
+func acquireLeases(logger *slog.Logger, spec *specs.Spec, cfg *config.Config, args []string, devices []discover.Accelerator, dryRun bool) error {
+	claim, err := newClaim(spec, cfg, args, devices)
 	if err != nil {
-		runcPath, err = exec.LookPath("runc")
-		if err != nil {
-			return err
-		}
+		return err
 	}
-	logger.Debug("runc path", "path", runcPath)
-	cmdArgs := []string{runcPath}
-	if systemdCgroup {
-		cmdArgs = append(cmdArgs, "--systemd-cgroup")
+	registry := lease.NewRegistry(cfg.Runtime.Leases.Dir)
+	if dryRun {
+		logger.Info("Checking device leases", "container", claim.Container, "devices", discover.IDs(devices), "exclusive", claim.Exclusive)
+		return registry.Check(claim)
 	}
-	cmdArgs = append(cmdArgs, args...)
-	logger.Debug("Executing runc command", "cmd", cmdArgs)
+	logger.Info("Acquiring device leases", "container", claim.Container, "devices", discover.IDs(devices), "exclusive", claim.Exclusive)
+	return registry.Acquire(claim)
+}
 
-	return syscall.Exec(runcPath, cmdArgs, os.Environ())
+// leasesEnabled reports whether the devices are leased. An unset mode, in a
+// config not loaded from a file, is none.
+func leasesEnabled(cfg *config.Config) bool {
+	return cfg.Runtime.Leases.Mode != config.LeaseModeNone && cfg.Runtime.Leases.Mode != ""
 }
 
-func hasCreateCommand(args []string) bool {
-	for _, arg := range args {
-		if strings.HasPrefix(arg, "-") {
-			continue
+// freeDevices returns the devices the created container can lease, all of
+// them when the leases are disabled.
+func freeDevices(spec *specs.Spec, cfg *config.Config, args []string, devices []discover.Accelerator) ([]discover.Accelerator, error) {
+	if !leasesEnabled(cfg) {
+		return devices, nil
+	}
+	claim, err := newClaim(spec, cfg, args, devices)
+	if err != nil {
+		return nil, err
+	}
+	available, err := lease.NewRegistry(cfg.Runtime.Leases.Dir).Available(claim)
+	if err != nil {
+		return nil, err
+	}
+
+	var free []discover.Accelerator
+	for i, key := range claim.Devices {
+		if slices.Contains(available, key) {
+			free = append(free, devices[i])
 		}
-		if arg == "create" {
-			return true
+	}
+	return free, nil
+}
+
+// newClaim returns the leases claim of the created container for the devices.
+// In shared mode, the container can mark itself exclusive with an annotation.
+func newClaim(spec *specs.Spec, cfg *config.Config, args []string, devices []discover.Accelerator) (lease.Claim, error) {
+	id := parseContainerID(args)
+	if id == "" {
+		return lease.Claim{}, fmt.Errorf("container ID not found in %v", args)
+	}
+
+	claim := lease.Claim{
+		Container:  id,
+		RuncRoot:   runtimeStateRoot(cfg, args),
+		Devices:    leaseKeys(devices),
+		Exclusive:  true,
+		MaxSharers: cfg.Runtime.Leases.MaxSharers,
+	}
+	if cfg.Runtime.Leases.Mode == config.LeaseModeShared {
+		switch sharing := spec.Annotations[request.AnnotationDeviceSharing]; sharing {
+		case "", request.SharingShared:
+			claim.Exclusive = false
+		case request.SharingExclusive:
+		default:
+			return lease.Claim{}, fmt.Errorf("invalid %s annotation %q", request.AnnotationDeviceSharing, sharing)
 		}
 	}
-	return false
+	return claim, nil
 }
 
-func IsHabanaContainer(spec *specs.Spec) bool {
-	for _, ev := range spec.Process.Env {
-		if strings.HasPrefix(ev, EnvHLVisibleDevices) {
-			return true
+// releaseLeases drops the leases of the container. Failures are only logged,
+// the leases are reclaimed once the container no longer exists.
+func releaseLeases(logger *slog.Logger, cfg *config.Config, id string) {
+	if !leasesEnabled(cfg) {
+		return
+	}
+	logger.Debug("Releasing device leases", "container", id)
+	if err := lease.NewRegistry(cfg.Runtime.Leases.Dir).Release(id); err != nil {
+		logger.Warn("Releasing device leases", "container", id, "error", err)
+	}
+}
+
+// leaseKeys returns the devices lease keys, their PCI addresses which do not
+// change across reboots, or their indexes when unknown.
+func leaseKeys(devices []discover.Accelerator) []string {
+	keys := make([]string, 0, len(devices))
+	for _, acc := range devices {
+		if acc.PCIAddress != "" {
+			keys = append(keys, acc.PCIAddress)
+			continue
 		}
+		keys = append(keys, acc.ID())
+	}
+	return keys
+}
+
+// requestedAccelerators returns the accelerators of the root selected by the
+// devices request and HABANA_VISIBLE_MODULES. Devices requested by count are
+// chosen among the ones returned by free, when set.
+func requestedAccelerators(spec *specs.Spec, req *request.Request, root *discover.Root, free freeFunc) ([]discover.Accelerator, error) {
+	accelerators, err := root.Accelerators()
+	if err != nil {
+		return nil, err
 	}
-	return false
+
+	devices, err := filterDevices(req, accelerators, free)
+	if err != nil {
+		return nil, err
+	}
+	return filterDevicesByModules(spec, devices)
+}
+
+// specCommands are the runc commands creating a container from the bundle spec.
+var specCommands = []string{"create", "run", "restore"}
+
+// hasSpecCommand reports whether the command creates a container from the
+// bundle spec, which is then modified.
+func hasSpecCommand(args []string) bool {
+	return slices.Contains(specCommands, parseCommand(args))
+}
+
+// needsConfig reports whether the command cannot run without the config: the
+// spec commands, the poststop hook and explain.
+func needsConfig(args []string) bool {
+	switch parseCommand(args) {
+	case explainCommand, poststopCommand:
+		return true
+	}
+	return hasSpecCommand(args)
+}
+
+func hasDeleteCommand(args []string) bool {
+	return parseCommand(args) == "delete"
 }
 
 func addErrorEnvVar(spec *specs.Spec, msg string) {
@@ -16,11 +16,28 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/lease"
+	"github.com/HabanaAI/habana-container-runtime/policy"
+	"github.com/HabanaAI/habana-container-runtime/request"
+	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
-func TestHasCreateCommand(t *testing.T) {
+func TestHasSpecCommand(t *testing.T) {
 	t.Parallel()
 
 	createArgs := `--root /run/containerd/runc/k8s.io --log /run/containerd/io.containerd.runtime.v2.task/k8s.io/258cfa8cbc7edee9a846fe691971aa7c35976ea29bc668e7da2692e940032a88/log.json --log-format json create --bundle ./testdata/input --pid-file /run/containerd/io.containerd.runtime.v2.task/k8s.io/258cfa8cbc7edee9a846fe691971aa7c35976ea29bc668e7da2692e940032a88/init.pid 258cfa8cbc7edee9a846fe691971aa7c35976ea29bc668e7da2692e940032a88`
@@ -45,13 +62,827 @@ func TestHasCreateCommand(t *testing.T) {
 			in:   "--bla --create -create test foo bar",
 			want: false,
 		},
+		{
+			name: "with run command",
+			in:   "--root /run/runc run --detach --bundle /bundle test",
+			want: true,
+		},
+		{
+			name: "with restore command",
+			in:   "--root /run/runc restore --image-path /checkpoint --work-path /work --bundle /bundle test",
+			want: true,
+		},
+		{
+			name: "with a container named create",
+			in:   "--log create start create",
+			want: false,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := hasCreateCommand(strings.Fields(tt.in)); got != tt.want {
+			if got := hasSpecCommand(strings.Fields(tt.in)); got != tt.want {
 				t.Errorf("want %t, got %t", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestNeedsConfig(t *testing.T) {
+	for args, want := range map[string]bool{
+		"--root /run/runc create --bundle /bundle test": true,
+		"poststop":                     true,
+		"explain --bundle /bundle":     true,
+		"--root /run/runc state test":  false,
+		"--root /run/runc kill test 9": false,
+		"--root /run/runc delete test": false,
+		"--version":                    false,
+	} {
+		if got := needsConfig(strings.Fields(args)); got != want {
+			t.Errorf("%q: got %t, want %t", args, got, want)
+		}
+	}
+}
+
+// writeBundle creates a bundle directory with a rootfs, and a spec with the
+// annotations and environment variables.
+func writeBundle(t *testing.T, annotations map[string]string, env ...string) string {
+	t.Helper()
+	bundle := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(bundle, "rootfs/etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	spec := specs.Spec{
+		Version:     specs.Version,
+		Process:     &specs.Process{Env: env},
+		Root:        &specs.Root{Path: "rootfs"},
+		Linux:       &specs.Linux{Resources: &specs.LinuxResources{}},
+		Annotations: annotations,
+	}
+	content, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return bundle
+}
+
+func TestHandleRequestFixture(t *testing.T) {
+	t.Cleanup(func() { execLookPath = exec.LookPath })
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+
+	bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=0")
+
+	cfg := &config.Config{
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		MountAccelerators:        true,
+		MountUverbs:              true,
+		NetworkL3Config:          config.NetworkConfig{Path: filepath.Join(bundle, "gaudinet.json")},
+		Runtime: config.RuntimeConfig{
+			Mode:          config.ModeOCI,
+			DiscoveryRoot: "../../discover/testdata/hls2",
+			NUMAPlacement: true,
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := handleRequest(logger, cfg, []string{"create", "--bundle", bundle, "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadSpecs(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, d := range got.Linux.Devices {
+		paths = append(paths, fmt.Sprintf("%s %d:%d", d.Path, d.Major, d.Minor))
+	}
+	want := []string{"/dev/accel/accel0 510:0", "/dev/accel/accel_controlD0 510:1", "/dev/infiniband/uverbs0 231:192"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("got devices %v, want %v", paths, want)
+	}
+	if len(got.Linux.Resources.Devices) != 3 {
+		t.Errorf("got %d allow list rules, want 3", len(got.Linux.Resources.Devices))
+	}
+	wantEnv := []string{"HABANA_VISIBLE_DEVICES=0", "HABANA_VISIBLE_MODULES=1"}
+	if !reflect.DeepEqual(got.Process.Env, wantEnv) {
+		t.Errorf("got env %v, want %v", got.Process.Env, wantEnv)
+	}
+	if _, err := os.Stat(filepath.Join(bundle, "rootfs/etc/habanalabs/macAddrInfo.json")); err != nil {
+		t.Errorf("macAddrInfo not generated: %v", err)
+	}
+	if cpu := got.Linux.Resources.CPU; cpu == nil || cpu.Cpus != "0-39,80-119" || cpu.Mems != "0" {
+		t.Errorf("got cpu resources %+v, want NUMA node 0", cpu)
+	}
+}
+
+func TestHandleRequestDriverCapabilities(t *testing.T) {
+	t.Cleanup(func() { execLookPath = exec.LookPath })
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+
+	tests := []struct {
+		name    string
+		caps    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "control",
+			caps: "control",
+			want: []string{"/dev/accel/accel_controlD0"},
+		},
+		{
+			name: "compute and rdma",
+			caps: "compute,rdma",
+			want: []string{"/dev/accel/accel0", "/dev/infiniband/uverbs0"},
+		},
+		{
+			name:    "invalid",
+			caps:    "graphics",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=0", "HABANA_DRIVER_CAPABILITIES="+tt.caps)
+			cfg := &config.Config{
+				AcceptEnvvar:             true,
+				AcceptEnvvarUnprivileged: true,
+				MountAccelerators:        true,
+				MountUverbs:              true,
+				Runtime: config.RuntimeConfig{
+					Mode:          config.ModeOCI,
+					DiscoveryRoot: "../../discover/testdata/hls2",
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			err := handleRequest(logger, cfg, []string{"create", "--bundle", bundle, "test"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+
+			got, err := loadSpecs(filepath.Join(bundle, "config.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, d := range got.Linux.Devices {
+				paths = append(paths, d.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("got devices %v, want %v", paths, tt.want)
+			}
+			if hasError := slices.ContainsFunc(got.Process.Env, func(e string) bool {
+				return strings.HasPrefix(e, EnvHLRuntimeError+"=")
+			}); hasError != tt.wantErr {
+				t.Errorf("got env %v, want %s set %t", got.Process.Env, EnvHLRuntimeError, tt.wantErr)
+			}
+			if _, err := os.Stat(filepath.Join(bundle, "rootfs/etc/habanalabs/macAddrInfo.json")); err == nil {
+				t.Error("macAddrInfo generated without the network capability")
+			}
+		})
+	}
+}
+
+func TestHandleRequestRequirements(t *testing.T) {
+	t.Cleanup(func() { execLookPath = exec.LookPath })
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+
+	// The fixture has the 1.17.0 driver and gaudi2 devices with the 51.2.0
+	// firmware.
+	tests := []struct {
+		name        string
+		mode        string
+		env         []string
+		annotations map[string]string
+		wantErr     string
+	}{
+		{
+			name: "met",
+			env:  []string{"HABANA_REQUIRE_DRIVER>=1.17", "HABANA_REQUIRE_FIRMWARE=>=51", "HABANA_REQUIRE_DEVICE=gaudi2|gaudi3"},
+		},
+		{
+			name:    "older driver",
+			env:     []string{"HABANA_REQUIRE_DRIVER>=1.18"},
+			wantErr: "requirement driver>=1.18 is not met: driver version 1.17.0-a4e6b6c",
+		},
+		{
+			name:        "device type annotation",
+			annotations: map[string]string{"habana.ai/require-device": "gaudi3"},
+			wantErr:     "requirement device=gaudi3 is not met: device 0 is a gaudi2",
+		},
+		{
+			name: "disabled",
+			env:  []string{"HABANA_REQUIRE_DRIVER>=1.18", "HABANA_DISABLE_REQUIRE=1"},
+		},
+		{
+			name:    "invalid",
+			env:     []string{"HABANA_REQUIRE_DRIVER>=latest"},
+			wantErr: `reading requirements: invalid requirement "DRIVER>=latest": invalid version "latest"`,
+		},
+		{
+			name:    "legacy mode",
+			mode:    config.ModeLegacy,
+			env:     []string{"HABANA_REQUIRE_DRIVER>=1.17"},
+			wantErr: "the container declares requirements, but they are only checked in oci mode, not legacy",
+		},
+		{
+			name:        "cdi mode",
+			mode:        config.ModeCDI,
+			annotations: map[string]string{"habana.ai/require-device": "gaudi2"},
+			wantErr:     "the container declares requirements, but they are only checked in oci mode, not cdi",
+		},
+		{
+			name: "legacy mode disabled",
+			mode: config.ModeLegacy,
+			env:  []string{"HABANA_REQUIRE_DRIVER>=1.17", "HABANA_DISABLE_REQUIRE=1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle := writeBundle(t, tt.annotations, append([]string{"HABANA_VISIBLE_DEVICES=0"}, tt.env...)...)
+			mode := tt.mode
+			if mode == "" {
+				mode = config.ModeOCI
+			}
+			cfg := &config.Config{
+				AcceptEnvvar:             true,
+				AcceptEnvvarUnprivileged: true,
+				MountAccelerators:        true,
+				Runtime: config.RuntimeConfig{
+					Mode:          mode,
+					DiscoveryRoot: "../../discover/testdata/hls2",
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			err := handleRequest(logger, cfg, []string{"create", "--bundle", bundle, "test"})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.HasSuffix(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+
+			got, err := loadSpecs(filepath.Join(bundle, "config.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Linux.Devices) != 0 {
+				t.Errorf("got devices %+v for a rejected container", got.Linux.Devices)
+			}
+			if !slices.Contains(got.Process.Env, EnvHLRuntimeError+"="+strconv.Quote(tt.wantErr)) {
+				t.Errorf("got env %v, want %s set", got.Process.Env, EnvHLRuntimeError)
+			}
+		})
+	}
+}
+
+// testMainEnv runs the test binary as the runtime.
+const testMainEnv = "HABANA_RUNTIME_TEST_MAIN"
+
+// runRuntime runs the runtime with the config and the arguments, and returns
+// its stderr and exit status. The hook binary is found in PATH.
+func runRuntime(t *testing.T, config string, args ...string) (string, int) {
+	t.Helper()
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "habana-container-hook"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := filepath.Abs("../../discover/testdata/hls2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfig(t, fmt.Sprintf(`
+[habana-container-runtime]
+debug = %q
+discovery_root = %q
+`, filepath.Join(t.TempDir(), "runtime.log"), fixture)+config)
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), testMainEnv+"=1", "PATH="+bin+":"+os.Getenv("PATH"))
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+func TestMainRequirementsExitStatus(t *testing.T) {
+	bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=0", "HABANA_REQUIRE_DRIVER=>=1.20")
+	stderr, code := runRuntime(t, "", "create", "--bundle", bundle, "test")
+	if code == 0 || !strings.Contains(stderr, "requirement driver>=1.20 is not met") {
+		t.Errorf("got exit status %d, stderr %q, want the requirement failure", code, stderr)
+	}
+}
+
+func TestMainLeasesExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	held := lease.Claim{Container: "c1", Devices: []string{"0000:33:00.0"}, Exclusive: true}
+	if err := lease.NewRegistry(dir).Acquire(held); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=0")
+	stderr, code := runRuntime(t, fmt.Sprintf(`
+[habana-container-runtime.leases]
+mode = "exclusive"
+dir = %q
+`, dir), "create", "--bundle", bundle, "test")
+	if code == 0 || !strings.Contains(stderr, "is held by container c1") {
+		t.Errorf("got exit status %d, stderr %q, want the lease conflict", code, stderr)
+	}
+}
+
+func TestHandleRequestLegacyModules(t *testing.T) {
+	t.Cleanup(func() { execLookPath = exec.LookPath })
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+
+	bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=1")
+	cfg := &config.Config{
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		Runtime: config.RuntimeConfig{
+			Mode:          config.ModeLegacy,
+			DiscoveryRoot: "../../discover/testdata/hls2",
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := handleRequest(logger, cfg, []string{"create", "--bundle", bundle, "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadSpecs(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Hooks == nil || len(got.Hooks.Prestart) != 1 {
+		t.Errorf("got hooks %+v, want a prestart hook", got.Hooks)
+	}
+	if len(got.Linux.Devices) != 0 {
+		t.Errorf("got devices %+v, want none in legacy mode", got.Linux.Devices)
+	}
+	wantEnv := []string{"HABANA_VISIBLE_DEVICES=1", "HABANA_VISIBLE_MODULES=3"}
+	if !reflect.DeepEqual(got.Process.Env, wantEnv) {
+		t.Errorf("got env %v, want %v", got.Process.Env, wantEnv)
+	}
+
+	// The hook does not enforce the policies, the containers they match are
+	// refused.
+	cfg.Policies = []policy.Rule{{Name: "default", Devices: "0"}}
+	bundle = writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=1")
+	err = handleRequest(logger, cfg, []string{"create", "--bundle", bundle, "test"})
+	if err == nil || !strings.Contains(err.Error(), `policy "default"`) {
+		t.Errorf("got error %v, want the policy refused in legacy mode", err)
+	}
+}
+
+func TestHandleRequestAnnotations(t *testing.T) {
+	t.Cleanup(func() { execLookPath = exec.LookPath })
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+
+	tests := []struct {
+		name         string
+		acceptEnvvar bool
+		annotations  map[string]string
+		env          []string
+		want         []string
+	}{
+		{
+			name:         "annotation takes precedence over the envvar",
+			acceptEnvvar: true,
+			annotations:  map[string]string{request.AnnotationVisibleDevices: "1"},
+			env:          []string{"HABANA_VISIBLE_DEVICES=0"},
+			want:         []string{"/dev/accel/accel1", "/dev/accel/accel_controlD1"},
+		},
+		{
+			name:        "envvar is ignored when not accepted",
+			annotations: map[string]string{request.AnnotationVisibleDevices: "1"},
+			env:         []string{"HABANA_VISIBLE_DEVICES=all"},
+			want:        []string{"/dev/accel/accel1", "/dev/accel/accel_controlD1"},
+		},
+		{
+			name: "envvar only is not a habana container when not accepted",
+			env:  []string{"HABANA_VISIBLE_DEVICES=all"},
+			want: nil,
+		},
+		{
+			name:         "envvar is used when accepted",
+			acceptEnvvar: true,
+			env:          []string{"HABANA_VISIBLE_DEVICES=0"},
+			want:         []string{"/dev/accel/accel0", "/dev/accel/accel_controlD0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle := writeBundle(t, tt.annotations, tt.env...)
+			cfg := &config.Config{
+				AcceptEnvvar:             tt.acceptEnvvar,
+				AcceptEnvvarUnprivileged: true,
+				MountAccelerators:        true,
+				Runtime: config.RuntimeConfig{
+					Mode:          config.ModeOCI,
+					DiscoveryRoot: "../../discover/testdata/hls2",
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			if err := handleRequest(logger, cfg, []string{"create", "--bundle", bundle, "test"}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadSpecs(filepath.Join(bundle, "config.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, d := range got.Linux.Devices {
+				paths = append(paths, d.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("got devices %v, want %v", paths, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequestUnprivileged(t *testing.T) {
+	t.Cleanup(func() { execLookPath = exec.LookPath })
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+
+	tests := []struct {
+		name       string
+		privileged bool
+		want       []string
+		wantEnv    []string
+	}{
+		{
+			name:       "privileged",
+			privileged: true,
+			want:       []string{"/dev/accel/accel0", "/dev/accel/accel_controlD0"},
+			wantEnv:    []string{"HABANA_VISIBLE_DEVICES=0", "HABANA_VISIBLE_MODULES=1"},
+		},
+		{
+			name:    "unprivileged",
+			want:    nil,
+			wantEnv: []string{"HABANA_VISIBLE_DEVICES=0", EnvHLRuntimeError + "=" + strconv.Quote(request.ErrUnprivilegedEnvvar.Error())},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=0")
+			if tt.privileged {
+				spec, err := loadSpecs(filepath.Join(bundle, "config.json"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				spec.Process.Capabilities = &specs.LinuxCapabilities{Bounding: []string{"CAP_SYS_ADMIN"}}
+				if err := saveSpecs(filepath.Join(bundle, "config.json"), spec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := &config.Config{
+				AcceptEnvvar:      true,
+				MountAccelerators: true,
+				Runtime: config.RuntimeConfig{
+					Mode:          config.ModeOCI,
+					DiscoveryRoot: "../../discover/testdata/hls2",
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			if err := handleRequest(logger, cfg, []string{"create", "--bundle", bundle, "test"}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadSpecs(filepath.Join(bundle, "config.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, d := range got.Linux.Devices {
+				paths = append(paths, d.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("got devices %v, want %v", paths, tt.want)
+			}
+			if !reflect.DeepEqual(got.Process.Env, tt.wantEnv) {
+				t.Errorf("got env %v, want %v", got.Process.Env, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestHandleRequestPolicy(t *testing.T) {
+	t.Cleanup(func() { execLookPath = exec.LookPath })
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+
+	no := false
+	policies := []policy.Rule{
+		{Name: "denied", Namespaces: []string{"denied"}, Devices: "none"},
+		{Name: "single", Namespaces: []string{"single"}, MaxDevices: 1, AllowUverbs: &no},
+		{Name: "isolated", Namespaces: []string{"isolated"}, AllowNetwork: &no},
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		want      []string
+		wantError bool
+		// Devices forwarded to the hook, empty when the hook is not added.
+		wantAdmitted string
+	}{
+		{
+			name:         "no matching rule",
+			namespace:    "other",
+			want:         []string{"/dev/accel/accel0", "/dev/accel/accel_controlD0", "/dev/accel/accel1", "/dev/accel/accel_controlD1", "/dev/infiniband/uverbs0", "/dev/infiniband/uverbs1"},
+			wantAdmitted: "0,1",
+		},
+		{
+			name:         "trimmed without uverbs",
+			namespace:    "single",
+			want:         []string{"/dev/accel/accel0", "/dev/accel/accel_controlD0"},
+			wantError:    true,
+			wantAdmitted: "0",
+		},
+		{
+			name:      "denied",
+			namespace: "denied",
+			want:      nil,
+			wantError: true,
+		},
+		{
+			name:      "network not allowed",
+			namespace: "isolated",
+			want:      []string{"/dev/accel/accel0", "/dev/accel/accel_controlD0", "/dev/accel/accel1", "/dev/accel/accel_controlD1", "/dev/infiniband/uverbs0", "/dev/infiniband/uverbs1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{"io.kubernetes.cri.sandbox-namespace": tt.namespace}
+			bundle := writeBundle(t, annotations, "HABANA_VISIBLE_DEVICES=all")
+			cfg := &config.Config{
+				AcceptEnvvar:             true,
+				AcceptEnvvarUnprivileged: true,
+				MountAccelerators:        true,
+				MountUverbs:              true,
+				NetworkL3Config:          config.NetworkConfig{Path: filepath.Join(bundle, "gaudinet.json")},
+				Policies:                 policies,
+				Runtime: config.RuntimeConfig{
+					Mode:          config.ModeOCI,
+					DiscoveryRoot: "../../discover/testdata/hls2",
+				},
+			}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			if err := handleRequest(logger, cfg, []string{"create", "--bundle", bundle, "test"}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadSpecs(filepath.Join(bundle, "config.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, d := range got.Linux.Devices {
+				paths = append(paths, d.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("got devices %v, want %v", paths, tt.want)
+			}
+			hasError := slices.ContainsFunc(got.Process.Env, func(ev string) bool {
+				return strings.HasPrefix(ev, EnvHLRuntimeError+"=")
+			})
+			if hasError != tt.wantError {
+				t.Errorf("got env %v, want %s %t", got.Process.Env, EnvHLRuntimeError, tt.wantError)
+			}
+			hasHook := got.Hooks != nil && slices.ContainsFunc(got.Hooks.CreateRuntime, func(h specs.Hook) bool {
+				return strings.Contains(h.Path, "habana-container-hook")
+			})
+			if hasHook != (tt.wantAdmitted != "") {
+				t.Errorf("got createRuntime hook %t, want %t", hasHook, tt.wantAdmitted != "")
+			}
+			if admitted := got.Annotations[request.AnnotationAdmittedDevices]; admitted != tt.wantAdmitted {
+				t.Errorf("got admitted devices %q, want %q", admitted, tt.wantAdmitted)
+			}
+		})
+	}
+}
+
+func TestHandleRequestRestore(t *testing.T) {
+	t.Cleanup(func() { execLookPath = exec.LookPath })
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+
+	bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=0")
+	cfg := &config.Config{
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		MountAccelerators:        true,
+		MountUverbs:              true,
+		Runtime: config.RuntimeConfig{
+			Mode:          config.ModeOCI,
+			DiscoveryRoot: "../../discover/testdata/hls2",
+			Leases:        config.LeasesConfig{Mode: config.LeaseModeExclusive, Dir: t.TempDir()},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// The checkpointed container was created from the same bundle, which
+	// holds the spec modified on creation.
+	for _, args := range [][]string{
+		{"run", "--detach", "--bundle", bundle, "test"},
+		{"restore", "--image-path", "/checkpoint", "--bundle", bundle, "test"},
+	} {
+		if err := handleRequest(logger, cfg, args); err != nil {
+			t.Fatalf("%s: %v", args[0], err)
+		}
+	}
+
+	got, err := loadSpecs(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, d := range got.Linux.Devices {
+		paths = append(paths, d.Path)
+	}
+	want := []string{"/dev/accel/accel0", "/dev/accel/accel_controlD0", "/dev/infiniband/uverbs0"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("got devices %v, want %v", paths, want)
+	}
+	if len(got.Linux.Resources.Devices) != 3 {
+		t.Errorf("got %d allow list rules, want 3", len(got.Linux.Resources.Devices))
+	}
+	if got.Hooks == nil || len(got.Hooks.CreateRuntime) != 1 {
+		t.Errorf("got hooks %+v, want a createRuntime hook", got.Hooks)
+	}
+	wantEnv := []string{"HABANA_VISIBLE_DEVICES=0", "HABANA_VISIBLE_MODULES=1"}
+	if !reflect.DeepEqual(got.Process.Env, wantEnv) {
+		t.Errorf("got env %v, want %v", got.Process.Env, wantEnv)
+	}
+}
+
+func TestRunExclusiveLeases(t *testing.T) {
+	t.Cleanup(func() {
+		execLookPath = exec.LookPath
+		execRunc = execRuncFunc
+		runRunc = runRuncFunc
+	})
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+	execRunc = func(*slog.Logger, *config.Config, []string) error { return nil }
+	// Only the forced deletes succeed, the containers are running.
+	runRunc = func(_ *slog.Logger, _ *config.Config, args []string) error {
+		if !slices.Contains(args, "--force") {
+			return errors.New("cannot delete container that is not stopped")
+		}
+		return nil
+	}
+
+	cfg := &config.Config{
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		MountAccelerators:        true,
+		Runtime: config.RuntimeConfig{
+			Mode:          config.ModeOCI,
+			DiscoveryRoot: "../../discover/testdata/hls2",
+			Leases:        config.LeasesConfig{Mode: config.LeaseModeExclusive, Dir: t.TempDir()},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	create := func(id, devices string) error {
+		bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES="+devices)
+		return run(logger, cfg, []string{"--root", t.TempDir(), "create", "--bundle", bundle, id})
+	}
+
+	if err := create("first", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("second", "1"); err != nil {
+		t.Fatal(err)
+	}
+	err := create("third", "0,1")
+	if err == nil || !strings.Contains(err.Error(), "held by container first") {
+		t.Fatalf("got error %v, want device held by container first", err)
+	}
+
+	// The leases of a container are kept until it is deleted.
+	if err := run(logger, cfg, []string{"delete", "first"}); err == nil {
+		t.Fatal("got no error, want the delete failure")
+	}
+	if err := create("third", "0"); err == nil {
+		t.Fatal("got no error, want device held by container first")
+	}
+	if err := run(logger, cfg, []string{"delete", "--force", "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := create("third", "0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunSharedLeases(t *testing.T) {
+	t.Cleanup(func() {
+		execLookPath = exec.LookPath
+		execRunc = execRuncFunc
+	})
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+	execRunc = func(*slog.Logger, *config.Config, []string) error { return nil }
+
+	cfg := &config.Config{
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		MountAccelerators:        true,
+		Runtime: config.RuntimeConfig{
+			Mode:          config.ModeOCI,
+			DiscoveryRoot: "../../discover/testdata/hls2",
+			Leases:        config.LeasesConfig{Mode: config.LeaseModeShared, Dir: t.TempDir(), MaxSharers: 2},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	create := func(id, devices, sharing string) error {
+		annotations := map[string]string{}
+		if sharing != "" {
+			annotations[request.AnnotationDeviceSharing] = sharing
+		}
+		bundle := writeBundle(t, annotations, "HABANA_VISIBLE_DEVICES="+devices)
+		return run(logger, cfg, []string{"--root", t.TempDir(), "create", "--bundle", bundle, id})
+	}
+
+	tests := []struct {
+		id      string
+		devices string
+		sharing string
+		wantErr string
+	}{
+		{id: "a", devices: "0"},
+		{id: "b", devices: "0", sharing: request.SharingShared},
+		{id: "c", devices: "0", wantErr: "shared by the maximum of 2 containers: a, b"},
+		{id: "d", devices: "1", sharing: request.SharingExclusive},
+		{id: "e", devices: "1", wantErr: "held by container d"},
+		{id: "f", devices: "1", sharing: "maybe", wantErr: "invalid habana.ai/device-sharing annotation"},
+	}
+	for _, tt := range tests {
+		err := create(tt.id, tt.devices, tt.sharing)
+		if tt.wantErr == "" && err != nil {
+			t.Fatalf("%s: %v", tt.id, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Fatalf("%s: got error %v, want %q", tt.id, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRunCountLeases(t *testing.T) {
+	t.Cleanup(func() {
+		execLookPath = exec.LookPath
+		execRunc = execRuncFunc
+	})
+	execLookPath = func(string) (string, error) { return "/usr/bin/habana-container-hook", nil }
+	execRunc = func(*slog.Logger, *config.Config, []string) error { return nil }
+
+	cfg := &config.Config{
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		MountAccelerators:        true,
+		Runtime: config.RuntimeConfig{
+			Mode:          config.ModeOCI,
+			DiscoveryRoot: "../../discover/testdata/hls2",
+			Leases:        config.LeasesConfig{Mode: config.LeaseModeExclusive, Dir: t.TempDir()},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for i, want := range []string{"/dev/accel/accel0", "/dev/accel/accel1"} {
+		bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=count:1")
+		if err := run(logger, cfg, []string{"create", "--bundle", bundle, filepath.Base(bundle)}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadSpecs(filepath.Join(bundle, "config.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Linux.Devices) == 0 || got.Linux.Devices[0].Path != want {
+			t.Errorf("got devices %+v, want %s", got.Linux.Devices, want)
+		}
+		// The hook is given the allocated device, not the count.
+		if admitted := got.Annotations[request.AnnotationAdmittedDevices]; admitted != strconv.Itoa(i) {
+			t.Errorf("got admitted devices %q, want %d", admitted, i)
+		}
+	}
+
+	bundle := writeBundle(t, nil, "HABANA_VISIBLE_DEVICES=count:1")
+	err := run(logger, cfg, []string{"create", "--bundle", bundle, "last"})
+	if err == nil || !strings.Contains(err.Error(), "1 devices requested, 0 available") {
+		t.Errorf("got error %v, want no available devices", err)
+	}
+}
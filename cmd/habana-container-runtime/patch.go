@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+)
+
+// patchDocument applies the modifications between the orig and mod documents
+// to the raw one, all decoded with decodeDocument. Parts of raw that orig does
+// not have, such as the fields unknown to specs.Spec, are kept. Objects are
+// patched key by key, and arrays of the same length as in orig element by
+// element, so fields unknown in appended arrays elements are kept too. Other
+// values are replaced.
+func patchDocument(raw, orig, mod any) any {
+	if reflect.DeepEqual(orig, mod) {
+		return raw
+	}
+
+	switch mod := mod.(type) {
+	case map[string]any:
+		orig, okOrig := orig.(map[string]any)
+		raw, okRaw := raw.(map[string]any)
+		if !okOrig || !okRaw {
+			return mod
+		}
+		for k, v := range mod {
+			raw[k] = patchDocument(raw[k], orig[k], v)
+		}
+		for k := range orig {
+			if _, ok := mod[k]; !ok {
+				delete(raw, k)
+			}
+		}
+		return raw
+
+	case []any:
+		orig, okOrig := orig.([]any)
+		raw, okRaw := raw.([]any)
+		if !okOrig || !okRaw || len(raw) != len(orig) {
+			return mod
+		}
+		patched := make([]any, len(mod))
+		for i, v := range mod {
+			if i < len(orig) {
+				patched[i] = patchDocument(raw[i], orig[i], v)
+			} else {
+				patched[i] = v
+			}
+		}
+		return patched
+	}
+	return mod
+}
+
+// decodeDocument decodes a JSON document, keeping the numbers as written.
+func decodeDocument(content []byte) (any, error) {
+	var doc any
+	d := json.NewDecoder(bytes.NewReader(content))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
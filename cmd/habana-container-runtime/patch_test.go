@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPatchDocument(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		orig string
+		mod  string
+		want string
+	}{
+		{
+			name: "unchanged",
+			raw:  `{"a":1,"unknown":2}`,
+			orig: `{"a":1}`,
+			mod:  `{"a":1}`,
+			want: `{"a":1,"unknown":2}`,
+		},
+		{
+			name: "nested unknown fields",
+			raw:  `{"process":{"env":["A=1"],"unknown":true},"unknown":{"x":1.50}}`,
+			orig: `{"process":{"env":["A=1"]}}`,
+			mod:  `{"process":{"env":["A=1","B=2"],"cwd":"/"}}`,
+			want: `{"process":{"env":["A=1","B=2"],"cwd":"/","unknown":true},"unknown":{"x":1.50}}`,
+		},
+		{
+			name: "appended array elements",
+			raw:  `{"mounts":[{"destination":"/a","unknown":1}]}`,
+			orig: `{"mounts":[{"destination":"/a"}]}`,
+			mod:  `{"mounts":[{"destination":"/a"},{"destination":"/b"}]}`,
+			want: `{"mounts":[{"destination":"/a","unknown":1},{"destination":"/b"}]}`,
+		},
+		{
+			name: "shorter array and removed field",
+			raw:  `{"env":["A=1","B=2"],"cwd":"/root"}`,
+			orig: `{"env":["A=1","B=2"],"cwd":"/root"}`,
+			mod:  `{"env":["A=1"]}`,
+			want: `{"env":["A=1"]}`,
+		},
+		{
+			name: "replaced value",
+			raw:  `{"linux":{"resources":null}}`,
+			orig: `{"linux":{}}`,
+			mod:  `{"linux":{"resources":{"devices":[]}}}`,
+			want: `{"linux":{"resources":{"devices":[]}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var docs []any
+			for _, s := range []string{tt.raw, tt.orig, tt.mod, tt.want} {
+				doc, err := decodeDocument([]byte(s))
+				if err != nil {
+					t.Fatal(err)
+				}
+				docs = append(docs, doc)
+			}
+			got := patchDocument(docs[0], docs[1], docs[2])
+			if !reflect.DeepEqual(got, docs[3]) {
+				content, _ := json.Marshal(got)
+				t.Errorf("got %s, want %s", content, tt.want)
+			}
+		})
+	}
+}
@@ -22,17 +22,25 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"slices"
 	"strconv"
 	"strings"
 
+	"github.com/HabanaAI/habana-container-runtime/atomicfile"
+	"github.com/HabanaAI/habana-container-runtime/capability"
 	"github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/cpuset"
 	"github.com/HabanaAI/habana-container-runtime/discover"
+	"github.com/HabanaAI/habana-container-runtime/request"
+	"github.com/HabanaAI/habana-container-runtime/require"
+	"github.com/HabanaAI/habana-container-runtime/selector"
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
 )
 
 func loadSpecs(bundleConfigFile string) (*specs.Spec, error) {
-	jsonFile, err := os.OpenFile(filepath.Clean(bundleConfigFile), os.O_RDWR, 0644)
+	jsonFile, err := os.Open(filepath.Clean(bundleConfigFile))
 	if err != nil {
 		return nil, fmt.Errorf("opening OCI spec file: %w", err)
 	}
@@ -47,25 +55,80 @@ func loadSpecs(bundleConfigFile string) (*specs.Spec, error) {
 	return &spec, nil
 }
 
+// saveSpecs applies the modifications of the spec loaded by loadSpecs to the
+// spec file, keeping the fields specs.Spec does not know. The file is replaced
+// atomically, and only when the spec was modified.
 func saveSpecs(bundleConfigFile string, spec *specs.Spec) error {
-	jsonFile, err := os.OpenFile(filepath.Clean(bundleConfigFile), os.O_RDWR, 0644)
+	bundleConfigFile = filepath.Clean(bundleConfigFile)
+	content, err := os.ReadFile(bundleConfigFile)
 	if err != nil {
-		return fmt.Errorf("opening OCI spec file: %w", err)
+		return fmt.Errorf("reading OCI spec file: %w", err)
 	}
-	defer jsonFile.Close()
-
-	jsonOutput, err := json.Marshal(spec)
+	doc, modified, err := patchedSpec(content, spec)
 	if err != nil {
-		return fmt.Errorf("marshaling OCI spec: %w", err)
+		return err
+	}
+	if !modified {
+		return nil
 	}
 
-	_, err = jsonFile.WriteAt(jsonOutput, 0)
+	jsonOutput, err := json.Marshal(doc)
 	if err != nil {
+		return fmt.Errorf("marshaling OCI spec: %w", err)
+	}
+	if err := writeFileAtomic(bundleConfigFile, jsonOutput); err != nil {
 		return fmt.Errorf("writing to OCI spec file: %w", err)
 	}
 	return nil
 }
 
+// patchedSpec returns the document of the spec file content with the
+// modifications of spec applied, and whether there are any.
+func patchedSpec(content []byte, spec *specs.Spec) (any, bool, error) {
+	raw, err := decodeDocument(content)
+	if err != nil {
+		return nil, false, fmt.Errorf("reading OCI spec file: %w", err)
+	}
+
+	// The modifications are found between the file and the spec, both as
+	// encoded from specs.Spec.
+	var loaded specs.Spec
+	if err := json.Unmarshal(content, &loaded); err != nil {
+		return nil, false, fmt.Errorf("reading OCI spec file: %w", err)
+	}
+	orig, err := specDocument(&loaded)
+	if err != nil {
+		return nil, false, err
+	}
+	mod, err := specDocument(spec)
+	if err != nil {
+		return nil, false, err
+	}
+	if reflect.DeepEqual(orig, mod) {
+		return raw, false, nil
+	}
+	return patchDocument(raw, orig, mod), true, nil
+}
+
+// specDocument returns the spec as decoded by decodeDocument.
+func specDocument(spec *specs.Spec) (any, error) {
+	content, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling OCI spec: %w", err)
+	}
+	return decodeDocument(content)
+}
+
+// writeFileAtomic replaces the file, so that it is never seen half written.
+// The file mode is kept.
+func writeFileAtomic(name string, content []byte) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(name, content, info.Mode().Perm())
+}
+
 func addPrestartHook(logger *slog.Logger, spec *specs.Spec, cfg *config.Config) error {
 	// path, err := execLookPath("habana-container-runtime-hook")
 	path, err := hookBinaryPath(cfg)
@@ -133,34 +196,46 @@ func addCreateRuntimeHook(logger *slog.Logger, spec *specs.Spec, cfg *config.Con
 	return nil
 }
 
-func addAcceleratorDevices(logger *slog.Logger, spec *specs.Spec, requestedDevs []string) error {
-	logger.Debug("Discovering accelerators")
+// addPoststopHook adds the runtime itself as poststop hook of the container.
+func addPoststopHook(logger *slog.Logger, spec *specs.Spec) error {
+	path, err := osExecutable()
+	if err != nil {
+		return err
+	}
 
-	// TODO: wait for devs and QA approval
-	// // Extract module id for HABANA_VISIBLE_MODULES environment variables
-	// modulesIDs := make([]string, 0, len(requestedDevs))
-	// for _, acc := range requestedDevs {
-	// 	id, err := discover.AcceleratorModuleID(acc)
-	// 	if err != nil {
-	// 		logger.Debug("discoring modules")
-	// 		return err
-	// 	}
-	// 	modulesIDs = append(modulesIDs, id)
-	// }
-	// addEnvVar(spec, EnvHLVisibleModules, strings.Join(modulesIDs, ","))
+	if spec.Hooks == nil {
+		spec.Hooks = &specs.Hooks{}
+	}
+	for _, hook := range spec.Hooks.Poststop {
+		if hook.Path == path && slices.Contains(hook.Args, poststopCommand) {
+			logger.Info("Existing habana poststop hook in OCI spec file")
+			return nil
+		}
+	}
+
+	spec.Hooks.Poststop = append(spec.Hooks.Poststop, specs.Hook{
+		Path: path,
+		Args: []string{path, poststopCommand},
+	})
+	logger.Info("poststop hook added", "path", path)
+	return nil
+}
+
+// addAcceleratorDevices adds the device nodes of the accelerators allowed by
+// the driver capabilities, accel for compute and accel_controlD for control.
+func addAcceleratorDevices(logger *slog.Logger, spec *specs.Spec, root *discover.Root, requestedDevs []discover.Accelerator, caps capability.Set) error {
+	logger.Debug("Discovering accelerators")
 
 	// Prepare devices in OCI format
 	var devs []*discover.DevInfo
-	for _, u := range requestedDevs {
-		for _, d := range []string{"/dev/accel/accel", "/dev/accel/accel_controlD"} {
-			p := fmt.Sprintf("%s%s", d, u)
+	for _, acc := range requestedDevs {
+		for _, p := range caps.DevicePaths(acc) {
 			logger.Info("Adding accelerator device", "path", p)
-			i, err := discover.DeviceInfo(p)
+			i, err := root.DeviceInfo(p)
 			if err != nil {
 				return err
 			}
 			devs = append(devs, i)
-
 		}
 	}
 
@@ -170,33 +245,22 @@ func addAcceleratorDevices(logger *slog.Logger, spec *specs.Spec, requestedDevs
 	return nil
 }
 
-func addUverbsDevices(logger *slog.Logger, spec *specs.Spec, requestedDevsIDs []string) error {
+func addUverbsDevices(logger *slog.Logger, spec *specs.Spec, root *discover.Root, requestedDevs []discover.Accelerator) error {
 	logger.Debug("Discovering uverbs")
 
 	var devs []*discover.DevInfo
-	for _, v := range requestedDevsIDs {
-		hlib := fmt.Sprintf("/sys/class/infiniband/hlib_%s", v)
-		logger.Debug("Getting uverbs device for hlib", "hlib", hlib)
-
-		// Extract uverb from hlib device
-		uverbs, err := osReadDir(fmt.Sprintf("%s/device/infiniband_verbs", hlib))
-		if err != nil {
-			logger.Error(fmt.Sprintf("Reading hlib directory: %v", err))
-			continue
-		}
-		if len(uverbs) == 0 {
-			logger.Debug("No uverbs devices found for devices", "device", hlib)
+	for _, acc := range requestedDevs {
+		if acc.UverbsPath == "" {
+			logger.Debug("No uverbs devices found for device", "device", acc.ID())
 			continue
 		}
-		uverbDev := fmt.Sprintf("/dev/infiniband/%s", uverbs[0].Name())
 
 		// Prepare devices in OCI format
-		logger.Info("Adding uverb device", "path", uverbDev)
-		i, err := discover.DeviceInfo(uverbDev)
+		logger.Info("Adding uverb device", "path", acc.UverbsPath)
+		i, err := root.DeviceInfo(acc.UverbsPath)
 		if err != nil {
 			return err
 		}
-		logger.Info("Adding uverb device", "path", uverbDev)
 		devs = append(devs, i)
 	}
 
@@ -206,36 +270,340 @@ func addUverbsDevices(logger *slog.Logger, spec *specs.Spec, requestedDevsIDs []
 	return nil
 }
 
-func filterDevicesByENV(spec *specs.Spec, devices []string) []string {
-	var requestedDevs []string
+// addConfigDevices adds the [[devices]] character devices of the config whose
+// capabilities the container has.
+func addConfigDevices(logger *slog.Logger, spec *specs.Spec, cfg *config.Config, root *discover.Root, caps capability.Set) error {
+	var devs []*discover.DevInfo
+	for _, d := range cfg.Devices {
+		if !caps.Has(d.Capabilities) {
+			logger.Debug("Config device not requested", "path", d.Path, "capabilities", d.Capabilities.String())
+			continue
+		}
+		matches, err := root.Glob(d.Path)
+		if err != nil {
+			return fmt.Errorf("config device %s: %w", d.Path, err)
+		}
+		if len(matches) == 0 {
+			if d.Required {
+				return fmt.Errorf("config device %s not found", d.Path)
+			}
+			logger.Debug("Config device not found", "path", d.Path)
+			continue
+		}
+		for _, p := range matches {
+			i, err := root.DeviceInfo(p)
+			if err != nil {
+				return err
+			}
+			if i.Mode&unix.S_IFMT != unix.S_IFCHR {
+				return fmt.Errorf("config device %s is not a character device", p)
+			}
+			logger.Info("Adding config device", "path", p)
+			devs = append(devs, i)
+		}
+	}
+
+	addDevicesToSpec(logger, spec, devs)
+	addAllowList(logger, spec, devs)
+
+	return nil
+}
+
+// addConfigMounts bind mounts the [[mounts]] host paths of the config whose
+// capabilities the container has, read-only unless configured otherwise.
+func addConfigMounts(logger *slog.Logger, spec *specs.Spec, cfg *config.Config, caps capability.Set) error {
+	for _, m := range cfg.Mounts {
+		if !caps.Has(m.Capabilities) {
+			logger.Debug("Config mount not requested", "source", m.Source, "capabilities", m.Capabilities.String())
+			continue
+		}
+		matches, err := filepath.Glob(m.Source)
+		if err != nil {
+			return fmt.Errorf("config mount %s: %w", m.Source, err)
+		}
+		if len(matches) == 0 {
+			if m.Required {
+				return fmt.Errorf("config mount %s not found", m.Source)
+			}
+			logger.Debug("Config mount not found", "source", m.Source)
+			continue
+		}
+
+		options := []string{"rbind", "rprivate", "nosuid", "nodev"}
+		if m.ReadOnly == nil || *m.ReadOnly {
+			options = append(options, "ro")
+		}
+		for _, src := range matches {
+			// The matches of a pattern are mounted in the destination directory.
+			dst := src
+			if m.Destination != "" && src != m.Source {
+				dst = path.Join(m.Destination, path.Base(src))
+			} else if m.Destination != "" {
+				dst = path.Clean(m.Destination)
+			}
+			if slices.ContainsFunc(spec.Mounts, func(sm specs.Mount) bool { return path.Clean(sm.Destination) == dst }) {
+				logger.Debug("Config mount already mounted", "destination", dst)
+				continue
+			}
+			logger.Info("Adding config mount", "source", src, "destination", dst)
+			spec.Mounts = append(spec.Mounts, specs.Mount{
+				Destination: dst,
+				Source:      src,
+				Type:        "bind",
+				Options:     options,
+			})
+		}
+	}
+	return nil
+}
+
+// addUtilityFiles bind mounts the configured host files read-only at the same
+// path in the container. When libraries are mounted, a createContainer hook runs
+// ldconfig in the container root before pivot_root, so its ld.so.cache has their
+// directories.
+func addUtilityFiles(logger *slog.Logger, spec *specs.Spec, cfg *config.Config, rootfs string) error {
+	var files []string
+	for _, pattern := range cfg.Runtime.Utility.Files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("utility files: %w", err)
+		}
+		if len(matches) == 0 {
+			logger.Debug("Utility file not found", "pattern", pattern)
+		}
+		files = append(files, matches...)
+	}
+
+	var libDirs []string
+	for _, f := range files {
+		if slices.ContainsFunc(spec.Mounts, func(m specs.Mount) bool { return path.Clean(m.Destination) == f }) {
+			logger.Debug("Utility file already mounted", "path", f)
+			continue
+		}
+		logger.Info("Adding utility file", "path", f)
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: f,
+			Source:      f,
+			Type:        "bind",
+			Options:     []string{"rbind", "rprivate", "ro", "nosuid", "nodev"},
+		})
+		if strings.Contains(path.Base(f), ".so") && !slices.Contains(libDirs, path.Dir(f)) {
+			libDirs = append(libDirs, path.Dir(f))
+		}
+	}
+
+	ldconfig := cfg.Runtime.Utility.Ldconfig
+	if ldconfig == "" || len(libDirs) == 0 {
+		return nil
+	}
+	rootfs, err := filepath.Abs(rootfs)
+	if err != nil {
+		return err
+	}
+	if spec.Hooks == nil {
+		spec.Hooks = &specs.Hooks{}
+	}
+	hook := specs.Hook{
+		Path: ldconfig,
+		Args: append([]string{ldconfig, "-r", rootfs}, libDirs...),
+	}
+	for _, h := range spec.Hooks.CreateContainer {
+		if h.Path == hook.Path && slices.Equal(h.Args, hook.Args) {
+			logger.Info("Existing ldconfig createContainer hook in OCI spec file")
+			return nil
+		}
+	}
+	spec.Hooks.CreateContainer = append(spec.Hooks.CreateContainer, hook)
+	logger.Info("ldconfig createContainer hook added", "dirs", libDirs)
+	return nil
+}
+
+// devicesRequest returns the devices requested by the container, from the
+// sources trusted by the config. nil means the container did not request any.
+func devicesRequest(spec *specs.Spec, cfg *config.Config) (*request.Request, error) {
+	return request.Resolve(requestContainer(spec), requestOptions(cfg))
+}
+
+// driverCapabilities returns the driver capabilities of the container, from
+// the sources trusted by the config.
+func driverCapabilities(spec *specs.Spec, cfg *config.Config) (capability.Set, error) {
+	return request.DriverCapabilities(requestContainer(spec), requestOptions(cfg))
+}
+
+// checkRequirements returns a *require.UnmetError when the node and the
+// devices do not meet the requirements declared by the container.
+func checkRequirements(logger *slog.Logger, spec *specs.Spec, root *discover.Root, devices []discover.Accelerator) error {
+	reqs, err := request.Requirements(requestContainer(spec))
+	if err != nil || len(reqs) == 0 {
+		return err
+	}
+
+	node := require.Node{Devices: devices}
+	node.Driver, err = root.DriverVersion()
+	if err != nil {
+		logger.Warn("Reading driver version", "error", err)
+	}
+	decls := make([]string, 0, len(reqs))
+	for _, r := range reqs {
+		decls = append(decls, r.String())
+	}
+	logger.Debug("Checking requirements", "requirements", decls, "driver", node.Driver)
+	return require.Check(reqs, node)
+}
+
+func requestContainer(spec *specs.Spec) request.Container {
+	c := request.Container{
+		Env:         request.EnvMap(spec.Process.Env),
+		Annotations: spec.Annotations,
+		Privileged:  isPrivileged(spec),
+	}
+	for _, m := range spec.Mounts {
+		c.Mounts = append(c.Mounts, m.Destination)
+	}
+	return c
+}
+
+func requestOptions(cfg *config.Config) request.Options {
+	return request.Options{
+		AcceptEnvvar:             cfg.AcceptEnvvar,
+		AcceptVolumeMounts:       cfg.AcceptVolumeMounts,
+		AcceptEnvvarUnprivileged: cfg.AcceptEnvvarUnprivileged,
+	}
+}
+
+// isPrivileged reports whether the container has CAP_SYS_ADMIN in its bounding
+// capabilities set, as the hook does.
+func isPrivileged(spec *specs.Spec) bool {
+	if spec.Process == nil || spec.Process.Capabilities == nil {
+		return false
+	}
+	return request.IsPrivileged(spec.Process.Capabilities.Bounding)
+}
+
+// freeFunc returns the devices a container can be given.
+type freeFunc func(devices []discover.Accelerator) ([]discover.Accelerator, error)
+
+// filterDevices returns the accelerators selected by the devices request. All
+// the accelerators are returned without a request, as we only get here for
+// habana containers or when always mounting the devices. Devices requested by
+// count are chosen among the ones returned by free, when set.
+func filterDevices(req *request.Request, devices []discover.Accelerator, free freeFunc) ([]discover.Accelerator, error) {
+	value := selector.All
+	if req != nil {
+		value = req.Devices
+	}
+
+	sel, err := selector.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if sel.Count() != 0 && free != nil {
+		devices, err = free(devices)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sel.Select(devices)
+}
+
+// filterDevicesByModules returns the devices selected by a user provided
+// HABANA_VISIBLE_MODULES, or all of them when the variable is not set.
+func filterDevicesByModules(spec *specs.Spec, devices []discover.Accelerator) ([]discover.Accelerator, error) {
 	for _, ev := range spec.Process.Env {
-		if strings.HasPrefix(ev, "HABANA_VISIBLE_DEVICES") {
-			_, values, found := strings.Cut(ev, "=")
-			if found {
-				if values == "all" {
-					return devices
-				} else {
-					requestedDevs = strings.Split(values, ",")
-				}
+		if k, v, found := strings.Cut(ev, "="); found && k == EnvHLVisibleModules && v != "" {
+			sel, err := selector.ParseModules(v)
+			if err != nil {
+				return nil, err
 			}
-			break
+			return sel.Select(devices)
 		}
 	}
+	return devices, nil
+}
+
+// addVisibleModules exposes the module IDs of the devices in HABANA_VISIBLE_MODULES,
+// in the same order as the devices, so ranks can be mapped to physical modules.
+func addVisibleModules(logger *slog.Logger, spec *specs.Spec, devices []discover.Accelerator) {
+	modules := discover.ModuleIDs(devices)
+	if len(modules) != len(devices) {
+		logger.Warn("Module ID not reported for all devices, skipping " + EnvHLVisibleModules)
+		return
+	}
+	logger.Debug("Visible modules", "modules", modules)
+	setEnvVar(spec, EnvHLVisibleModules, strings.Join(modules, ","))
+}
 
-	// Case when alwaysMatch is true, and user didn't provide the environment variable
-	if len(requestedDevs) == 0 {
-		return devices
+// addAdmittedDevices records the devices admitted for the container, so the
+// hook does not resolve the request again.
+func addAdmittedDevices(logger *slog.Logger, spec *specs.Spec, devices []discover.Accelerator) {
+	ids := strings.Join(discover.IDs(devices), ",")
+	logger.Debug("Admitted devices", "devices", ids)
+	if spec.Annotations == nil {
+		spec.Annotations = map[string]string{}
 	}
+	spec.Annotations[request.AnnotationAdmittedDevices] = ids
+}
 
-	var filteredDevices []string
-	for _, dev := range devices {
-		devID := string(dev[len(dev)-1])
-		if slices.Contains(requestedDevs, devID) {
-			filteredDevices = append(filteredDevices, dev)
+// alignNUMA restricts the container CPUs and memory nodes to the NUMA nodes of
+// the devices. An existing cpuset is intersected with them, and is kept when
+// the intersection is empty.
+func alignNUMA(logger *slog.Logger, spec *specs.Spec, root *discover.Root, devices []discover.Accelerator) error {
+	var cpus, mems cpuset.Set
+	for _, acc := range devices {
+		if acc.NUMANode < 0 {
+			logger.Warn("NUMA node not reported, skipping NUMA placement", "device", acc.ID())
+			return nil
+		}
+		list, err := root.NodeCPUs(acc.NUMANode)
+		if err != nil {
+			return fmt.Errorf("reading NUMA node %d cpus: %w", acc.NUMANode, err)
 		}
+		nodeCPUs, err := cpuset.Parse(list)
+		if err != nil {
+			return fmt.Errorf("reading NUMA node %d cpus: %w", acc.NUMANode, err)
+		}
+		cpus = cpus.Union(nodeCPUs)
+		mems = mems.Union(cpuset.Of(acc.NUMANode))
+	}
+	if len(cpus) == 0 {
+		return nil
+	}
+
+	if spec.Linux.Resources.CPU == nil {
+		spec.Linux.Resources.CPU = &specs.LinuxCPU{}
+	}
+	cpu := spec.Linux.Resources.CPU
+
+	newCPUs, err := intersectCpuset(cpu.Cpus, cpus)
+	if err != nil {
+		return err
+	}
+	newMems, err := intersectCpuset(cpu.Mems, mems)
+	if err != nil {
+		return err
+	}
+	if len(newCPUs) == 0 || len(newMems) == 0 {
+		logger.Warn("Container cpuset is outside the devices NUMA nodes, keeping it", "cpus", cpu.Cpus, "mems", cpu.Mems)
+		return nil
 	}
 
-	return filteredDevices
+	logger.Debug("NUMA placement", "cpus", newCPUs.String(), "mems", newMems.String())
+	cpu.Cpus = newCPUs.String()
+	cpu.Mems = newMems.String()
+	return nil
+}
+
+// intersectCpuset returns the set of the container list intersected with set,
+// or set when the container has no list.
+func intersectCpuset(list string, set cpuset.Set) (cpuset.Set, error) {
+	if list == "" {
+		return set, nil
+	}
+	current, err := cpuset.Parse(list)
+	if err != nil {
+		return nil, fmt.Errorf("container cpuset: %w", err)
+	}
+	return current.Intersect(set), nil
 }
 
 // addDevicesToSpec adds list of devices nodes to be created for container.
@@ -305,6 +673,19 @@ func addEnvVar(spec *specs.Spec, key string, value string) {
 	spec.Process.Env = append(spec.Process.Env, fmt.Sprintf("%s=%v", key, strconv.Quote(value)))
 }
 
+// setEnvVar sets the variable in the container environment, replacing any
+// existing value.
+func setEnvVar(spec *specs.Spec, key string, value string) {
+	entry := fmt.Sprintf("%s=%s", key, value)
+	for i, ev := range spec.Process.Env {
+		if k, _, _ := strings.Cut(ev, "="); k == key {
+			spec.Process.Env[i] = entry
+			return
+		}
+	}
+	spec.Process.Env = append(spec.Process.Env, entry)
+}
+
 // hookBinaryPath looks for the binary in the following locations by order:
 //
 // 1. $PATH environment variable
@@ -16,24 +16,49 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
 	"testing"
 
+	"github.com/HabanaAI/habana-container-runtime/capability"
 	"github.com/HabanaAI/habana-container-runtime/config"
+	"github.com/HabanaAI/habana-container-runtime/discover"
+	"github.com/HabanaAI/habana-container-runtime/request"
 	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
-func TestFilterDevicesByENV(t *testing.T) {
+// testAccelerators returns accelerators with the requested indexes. Their
+// module ID is the reverse of the index on a 8 devices node.
+func testAccelerators(indexes ...int) []discover.Accelerator {
+	var accelerators []discover.Accelerator
+	for _, i := range indexes {
+		accelerators = append(accelerators, discover.Accelerator{
+			Index:       i,
+			ModuleID:    fmt.Sprint(7 - i),
+			AccelPath:   fmt.Sprintf("/dev/accel/accel%d", i),
+			ControlPath: fmt.Sprintf("/dev/accel/accel_controlD%d", i),
+		})
+	}
+	return accelerators
+}
+
+func TestFilterDevices(t *testing.T) {
 	tests := []struct {
 		name       string
 		spec       specs.Spec
-		devices    []string
-		expDevices []string
+		devices    []discover.Accelerator
+		expDevices []discover.Accelerator
+		expErr     bool
 	}{
 		{
 			name: "no env var return all devices",
@@ -42,20 +67,8 @@ func TestFilterDevicesByENV(t *testing.T) {
 					Env: []string{},
 				},
 			},
-			devices: []string{
-				"/dev/accel/accel0",
-				"/dev/accel/accel_controlD0",
-				"/dev/accel/accel1",
-				"/dev/accel/accel_controlD1",
-				"/dev/infiniband/uverbs1",
-			},
-			expDevices: []string{
-				"/dev/accel/accel0",
-				"/dev/accel/accel_controlD0",
-				"/dev/accel/accel1",
-				"/dev/accel/accel_controlD1",
-				"/dev/infiniband/uverbs1",
-			},
+			devices:    testAccelerators(0, 1),
+			expDevices: testAccelerators(0, 1),
 		},
 		{
 			name: "env var without values returns all devices",
@@ -66,20 +79,8 @@ func TestFilterDevicesByENV(t *testing.T) {
 					},
 				},
 			},
-			devices: []string{
-				"/dev/accel/accel0",
-				"/dev/accel/accel_controlD0",
-				"/dev/accel/accel1",
-				"/dev/accel/accel_controlD1",
-				"/dev/infiniband/uverbs1",
-			},
-			expDevices: []string{
-				"/dev/accel/accel0",
-				"/dev/accel/accel_controlD0",
-				"/dev/accel/accel1",
-				"/dev/accel/accel_controlD1",
-				"/dev/infiniband/uverbs1",
-			},
+			devices:    testAccelerators(0, 1),
+			expDevices: testAccelerators(0, 1),
 		},
 		{
 			name: "env var with 'all' returns all devices",
@@ -90,20 +91,8 @@ func TestFilterDevicesByENV(t *testing.T) {
 					},
 				},
 			},
-			devices: []string{
-				"/dev/accel/accel0",
-				"/dev/accel/accel_controlD0",
-				"/dev/accel/accel1",
-				"/dev/accel/accel_controlD1",
-				"/dev/infiniband/uverbs1",
-			},
-			expDevices: []string{
-				"/dev/accel/accel0",
-				"/dev/accel/accel_controlD0",
-				"/dev/accel/accel1",
-				"/dev/accel/accel_controlD1",
-				"/dev/infiniband/uverbs1",
-			},
+			devices:    testAccelerators(0, 1),
+			expDevices: testAccelerators(0, 1),
 		},
 		{
 			name: "env var with single value returns only requested device",
@@ -114,52 +103,94 @@ func TestFilterDevicesByENV(t *testing.T) {
 					},
 				},
 			},
-			devices: []string{
-				"/dev/accel/accel0",
-				"/dev/accel/accel_controlD0",
-				"/dev/accel/accel1",
-				"/dev/accel/accel_controlD1",
-				"/dev/infiniband/uverbs1",
+			devices:    testAccelerators(0, 1),
+			expDevices: testAccelerators(0),
+		},
+		{
+			name: "env var with multiple values returns only requested device",
+			spec: specs.Spec{
+				Process: &specs.Process{
+					Env: []string{
+						fmt.Sprintf("%s=0,1,2", EnvHLVisibleDevices),
+					},
+				},
 			},
-			expDevices: []string{
-				"/dev/accel/accel0",
-				"/dev/accel/accel_controlD0",
+			devices:    testAccelerators(0, 1, 2, 3),
+			expDevices: testAccelerators(0, 1, 2),
+		},
+		{
+			name: "multi digit indexes",
+			spec: specs.Spec{
+				Process: &specs.Process{
+					Env: []string{
+						fmt.Sprintf("%s=1,10", EnvHLVisibleDevices),
+					},
+				},
 			},
+			devices:    testAccelerators(0, 1, 10, 11),
+			expDevices: testAccelerators(1, 10),
 		},
 		{
-			name: "env var with multiple values returns only requested device",
+			name: "range with exclusion",
+			spec: specs.Spec{
+				Process: &specs.Process{
+					Env: []string{
+						fmt.Sprintf("%s=0-3,-2", EnvHLVisibleDevices),
+					},
+				},
+			},
+			devices:    testAccelerators(0, 1, 2, 3),
+			expDevices: testAccelerators(0, 1, 3),
+		},
+		{
+			name: "none returns no devices",
 			spec: specs.Spec{
 				Process: &specs.Process{
 					Env: []string{
-						fmt.Sprintf("%s,=0,1,2", EnvHLVisibleDevices),
+						fmt.Sprintf("%s=none", EnvHLVisibleDevices),
 					},
 				},
 			},
-			devices: []string{
-				"/dev/accel/accel0",
-				"/dev/accel/accel_controlD0",
-				"/dev/accel/accel1",
-				"/dev/accel/accel_controlD1",
-				"/dev/accel/accel2",
-				"/dev/accel/accel_controlD2",
-				"/dev/accel/accel3",
-				"/dev/accel/accel_controlD3",
+			devices:    testAccelerators(0, 1),
+			expDevices: nil,
+		},
+		{
+			name: "unknown device fails",
+			spec: specs.Spec{
+				Process: &specs.Process{
+					Env: []string{
+						fmt.Sprintf("%s=0,5", EnvHLVisibleDevices),
+					},
+				},
 			},
-			expDevices: []string{
-				"/dev/accel/accel0",
-				"/dev/accel/accel_controlD0",
-				"/dev/accel/accel1",
-				"/dev/accel/accel_controlD1",
-				"/dev/accel/accel2",
-				"/dev/accel/accel_controlD2",
+			devices: testAccelerators(0, 1),
+			expErr:  true,
+		},
+		{
+			name: "invalid value fails",
+			spec: specs.Spec{
+				Process: &specs.Process{
+					Env: []string{
+						fmt.Sprintf("%s=0,x", EnvHLVisibleDevices),
+					},
+				},
 			},
+			devices: testAccelerators(0, 1),
+			expErr:  true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := tt.spec
-			got := filterDevicesByENV(&s, tt.devices)
+			req, err := devicesRequest(&s, &config.Config{AcceptEnvvar: true, AcceptEnvvarUnprivileged: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := filterDevices(req, tt.devices, nil)
+			if (err != nil) != tt.expErr {
+				t.Fatalf("got error %v, want error %t", err, tt.expErr)
+			}
 			if len(got) != len(tt.expDevices) {
 				t.Errorf("got=%d devices, want %d devices", len(got), len(tt.expDevices))
 			}
@@ -170,6 +201,224 @@ func TestFilterDevicesByENV(t *testing.T) {
 	}
 }
 
+func TestDevicesRequest(t *testing.T) {
+	spec := &specs.Spec{
+		Process: &specs.Process{Env: []string{"HABANA_VISIBLE_DEVICES=all"}},
+		Mounts: []specs.Mount{
+			{Destination: "/etc/hosts"},
+			{Destination: "/var/run/habana-container-devices/3"},
+			{Destination: "/var/run/habana-container-devices/1"},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		cfg        config.Config
+		privileged bool
+		want       *request.Request
+		wantErr    error
+	}{
+		{
+			name: "volume mounts",
+			cfg:  config.Config{AcceptEnvvar: true, AcceptVolumeMounts: true},
+			want: &request.Request{Devices: "3,1", Source: request.SourceVolumeMounts},
+		},
+		{
+			name: "volume mounts not accepted",
+			cfg:  config.Config{AcceptEnvvar: true, AcceptEnvvarUnprivileged: true},
+			want: &request.Request{Devices: "all", Source: request.SourceEnvvar},
+		},
+		{
+			name:       "envvar in privileged container",
+			cfg:        config.Config{AcceptEnvvar: true},
+			privileged: true,
+			want:       &request.Request{Devices: "all", Source: request.SourceEnvvar},
+		},
+		{
+			name:    "envvar in unprivileged container",
+			cfg:     config.Config{AcceptEnvvar: true},
+			wantErr: request.ErrUnprivilegedEnvvar,
+		},
+		{
+			name: "no trusted source",
+			cfg:  config.Config{},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := *spec
+			spec.Process = &specs.Process{Env: spec.Process.Env}
+			if tt.privileged {
+				spec.Process.Capabilities = &specs.LinuxCapabilities{Bounding: []string{"CAP_SYS_ADMIN"}}
+			}
+			got, err := devicesRequest(&spec, &tt.cfg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterDevicesByModules(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        []string
+		expDevices []discover.Accelerator
+		expErr     bool
+	}{
+		{
+			name:       "no env var returns all devices",
+			expDevices: testAccelerators(0, 1, 2, 3),
+		},
+		{
+			name:       "empty env var returns all devices",
+			env:        []string{EnvHLVisibleModules + "="},
+			expDevices: testAccelerators(0, 1, 2, 3),
+		},
+		{
+			name:       "modules are selected in devices order",
+			env:        []string{EnvHLVisibleModules + "=4,6"},
+			expDevices: testAccelerators(1, 3),
+		},
+		{
+			name:       "modules range",
+			env:        []string{EnvHLVisibleModules + "=5-7"},
+			expDevices: testAccelerators(0, 1, 2),
+		},
+		{
+			name:   "module of a device not requested fails",
+			env:    []string{EnvHLVisibleModules + "=1"},
+			expErr: true,
+		},
+		{
+			name:   "invalid value fails",
+			env:    []string{EnvHLVisibleModules + "=module:1"},
+			expErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &specs.Spec{Process: &specs.Process{Env: tt.env}}
+			got, err := filterDevicesByModules(spec, testAccelerators(0, 1, 2, 3))
+			if (err != nil) != tt.expErr {
+				t.Fatalf("got error %v, want error %t", err, tt.expErr)
+			}
+			if !reflect.DeepEqual(got, tt.expDevices) {
+				t.Errorf("got=%v, want %v", got, tt.expDevices)
+			}
+		})
+	}
+}
+
+func TestAddVisibleModules(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	spec := &specs.Spec{Process: &specs.Process{Env: []string{EnvHLVisibleModules + "=4,6"}}}
+	addVisibleModules(logger, spec, testAccelerators(3, 1))
+	want := []string{EnvHLVisibleModules + "=4,6"}
+	if !reflect.DeepEqual(spec.Process.Env, want) {
+		t.Errorf("got env %v, want %v", spec.Process.Env, want)
+	}
+
+	spec = &specs.Spec{Process: &specs.Process{}}
+	addVisibleModules(logger, spec, testAccelerators(2, 0))
+	want = []string{EnvHLVisibleModules + "=5,7"}
+	if !reflect.DeepEqual(spec.Process.Env, want) {
+		t.Errorf("got env %v, want %v", spec.Process.Env, want)
+	}
+
+	t.Run("skipped when a module ID is missing", func(t *testing.T) {
+		devices := testAccelerators(0, 1)
+		devices[1].ModuleID = ""
+		spec := &specs.Spec{Process: &specs.Process{}}
+		addVisibleModules(logger, spec, devices)
+		if len(spec.Process.Env) != 0 {
+			t.Errorf("got env %v, want none", spec.Process.Env)
+		}
+	})
+}
+
+func TestAlignNUMA(t *testing.T) {
+	root, err := discover.NewRoot("../../discover/testdata/hls2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	numa := func(nodes ...int) []discover.Accelerator {
+		var accelerators []discover.Accelerator
+		for i, node := range nodes {
+			accelerators = append(accelerators, discover.Accelerator{Index: i, NUMANode: node})
+		}
+		return accelerators
+	}
+
+	tests := []struct {
+		name     string
+		cpu      *specs.LinuxCPU
+		devices  []discover.Accelerator
+		wantCPUs string
+		wantMems string
+	}{
+		{
+			name:     "no cpuset",
+			devices:  numa(1),
+			wantCPUs: "40-79,120-159",
+			wantMems: "1",
+		},
+		{
+			name:     "both nodes",
+			devices:  numa(1, 0),
+			wantCPUs: "0-159",
+			wantMems: "0-1",
+		},
+		{
+			name:     "intersected with the container cpuset",
+			cpu:      &specs.LinuxCPU{Cpus: "30-50", Mems: "0-1"},
+			devices:  numa(0),
+			wantCPUs: "30-39",
+			wantMems: "0",
+		},
+		{
+			name:     "container cpuset on the other node is kept",
+			cpu:      &specs.LinuxCPU{Cpus: "0-3"},
+			devices:  numa(1),
+			wantCPUs: "0-3",
+		},
+		{
+			name:    "unknown NUMA node",
+			cpu:     &specs.LinuxCPU{},
+			devices: numa(0, -1),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{CPU: tt.cpu}}}
+			if err := alignNUMA(logger, spec, root, tt.devices); err != nil {
+				t.Fatal(err)
+			}
+			cpu := spec.Linux.Resources.CPU
+			if cpu.Cpus != tt.wantCPUs || cpu.Mems != tt.wantMems {
+				t.Errorf("got cpus=%q mems=%q, want cpus=%q mems=%q", cpu.Cpus, cpu.Mems, tt.wantCPUs, tt.wantMems)
+			}
+		})
+	}
+
+	t.Run("missing node", func(t *testing.T) {
+		spec := &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{}}}
+		if err := alignNUMA(logger, spec, root, numa(5)); err == nil {
+			t.Error("got no error")
+		}
+	})
+}
+
 func TestHookBinaryPath(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -266,3 +515,238 @@ func TestHookBinaryPath(t *testing.T) {
 		}
 	})
 }
+
+func TestAddUtilityFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"bin/hl-smi", "lib/habanalabs/libhlml.so", "lib/habanalabs/libhl-thunk.so.1"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	libDir := filepath.Join(dir, "lib/habanalabs")
+
+	cfg := &config.Config{Runtime: config.RuntimeConfig{Utility: config.UtilityConfig{
+		Files: []string{
+			filepath.Join(dir, "bin/hl-smi"),
+			filepath.Join(libDir, "libhlml.so"),
+			filepath.Join(libDir, "libhl-thunk.so*"),
+			filepath.Join(dir, "missing"),
+		},
+		Ldconfig: "/sbin/ldconfig",
+	}}}
+	spec := &specs.Spec{Mounts: []specs.Mount{{Destination: filepath.Join(libDir, "libhlml.so")}}}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := addUtilityFiles(logger, spec, cfg, "/bundle/rootfs"); err != nil {
+		t.Fatal(err)
+	}
+
+	var mounts []string
+	for _, m := range spec.Mounts[1:] {
+		mounts = append(mounts, m.Destination)
+		if m.Source != m.Destination || !slices.Contains(m.Options, "ro") {
+			t.Errorf("got mount %+v, want a read-only bind mount of the same path", m)
+		}
+	}
+	wantMounts := []string{filepath.Join(dir, "bin/hl-smi"), filepath.Join(libDir, "libhl-thunk.so.1")}
+	if !reflect.DeepEqual(mounts, wantMounts) {
+		t.Errorf("got mounts %v, want %v", mounts, wantMounts)
+	}
+
+	wantHooks := []specs.Hook{{Path: "/sbin/ldconfig", Args: []string{"/sbin/ldconfig", "-r", "/bundle/rootfs", libDir}}}
+	if spec.Hooks == nil || !reflect.DeepEqual(spec.Hooks.CreateContainer, wantHooks) {
+		t.Errorf("got hooks %+v, want %+v", spec.Hooks, wantHooks)
+	}
+
+	// A restored spec keeps a single hook.
+	if err := addUtilityFiles(logger, spec, cfg, "/bundle/rootfs"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spec.Hooks.CreateContainer, wantHooks) {
+		t.Errorf("got hooks %+v after a restore, want %+v", spec.Hooks.CreateContainer, wantHooks)
+	}
+
+	// Without libraries, the cache is not refreshed.
+	cfg.Runtime.Utility.Files = cfg.Runtime.Utility.Files[:1]
+	spec = &specs.Spec{}
+	if err := addUtilityFiles(logger, spec, cfg, "/bundle/rootfs"); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Mounts) != 1 || spec.Hooks != nil {
+		t.Errorf("got mounts %v and hooks %+v, want hl-smi without hooks", spec.Mounts, spec.Hooks)
+	}
+}
+
+func TestAddConfigDevices(t *testing.T) {
+	root, err := discover.NewRoot("../../discover/testdata/hls2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{Devices: []config.DeviceConfig{
+		{Path: "/dev/infiniband/rdma_cm", Capabilities: capability.RDMA},
+		{Path: "/dev/accel/accel_controlD*"},
+		{Path: "/dev/missing"},
+	}}
+
+	tests := []struct {
+		name    string
+		caps    capability.Set
+		missing bool
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "rdma",
+			caps: capability.Compute | capability.RDMA,
+			want: []string{"/dev/infiniband/rdma_cm", "/dev/accel/accel_controlD0", "/dev/accel/accel_controlD1"},
+		},
+		{
+			name: "without rdma",
+			caps: capability.Compute,
+			want: []string{"/dev/accel/accel_controlD0", "/dev/accel/accel_controlD1"},
+		},
+		{
+			name:    "required missing",
+			caps:    capability.Compute,
+			missing: true,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Devices[2].Required = tt.missing
+			spec := &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{}}}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			err := addConfigDevices(logger, spec, cfg, root, tt.caps)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			var paths []string
+			for _, d := range spec.Linux.Devices {
+				paths = append(paths, d.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("got devices %v, want %v", paths, tt.want)
+			}
+			if len(spec.Linux.Resources.Devices) != len(tt.want) {
+				t.Errorf("got device rules %+v, want %d", spec.Linux.Resources.Devices, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestAddConfigMounts(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"habanalabs/gaudi2.conf", "habanalabs/gaudi3.conf", "pki/site-ca.pem"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readWrite := false
+	cfg := &config.Config{Mounts: []config.MountConfig{
+		{Source: filepath.Join(dir, "habanalabs/*.conf"), Destination: "/etc/habanalabs"},
+		{Source: filepath.Join(dir, "pki/site-ca.pem"), Destination: "/etc/ssl/site-ca.crt", ReadOnly: &readWrite},
+		{Source: filepath.Join(dir, "scratch"), Capabilities: capability.RDMA},
+		{Source: filepath.Join(dir, "missing")},
+	}}
+	spec := &specs.Spec{Mounts: []specs.Mount{{Destination: "/etc/habanalabs/gaudi3.conf"}}}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := addConfigMounts(logger, spec, cfg, capability.Compute); err != nil {
+		t.Fatal(err)
+	}
+	want := []specs.Mount{
+		{Destination: "/etc/habanalabs/gaudi3.conf"},
+		{
+			Destination: "/etc/habanalabs/gaudi2.conf",
+			Source:      filepath.Join(dir, "habanalabs/gaudi2.conf"),
+			Type:        "bind",
+			Options:     []string{"rbind", "rprivate", "nosuid", "nodev", "ro"},
+		},
+		{
+			Destination: "/etc/ssl/site-ca.crt",
+			Source:      filepath.Join(dir, "pki/site-ca.pem"),
+			Type:        "bind",
+			Options:     []string{"rbind", "rprivate", "nosuid", "nodev"},
+		},
+	}
+	if !reflect.DeepEqual(spec.Mounts, want) {
+		t.Errorf("got mounts %+v, want %+v", spec.Mounts, want)
+	}
+
+	// A required source must exist, for the capabilities of the container.
+	cfg.Mounts[2].Required = true
+	if err := addConfigMounts(logger, &specs.Spec{}, cfg, capability.Compute); err != nil {
+		t.Errorf("got error %v for a mount of another capability", err)
+	}
+	cfg.Mounts[3].Required = true
+	if err := addConfigMounts(logger, &specs.Spec{}, cfg, capability.Compute); err == nil {
+		t.Error("got no error for a missing required mount")
+	}
+}
+
+func TestSaveSpecs(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	content := `{
+  "ociVersion": "1.2.0",
+  "process": {"env": ["A=1", "B=2"], "cwd": "/", "ioPriority": {"class": "IOPRIO_CLASS_IDLE"}},
+  "root": {"path": "rootfs"},
+  "linux": {"devices": [{"path": "/dev/fuse", "type": "c", "major": 10, "minor": 229, "future": true}]},
+  "future": {"size": 12345678901234567890}
+}`
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unmodified specs are not written.
+	spec, err := loadSpecs(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSpecs(file, spec); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(file); string(got) != content {
+		t.Errorf("got %s, want the file unchanged", got)
+	}
+
+	// The spec is shorter, with a device added.
+	spec.Process.Env = spec.Process.Env[:1]
+	spec.Linux.Devices = append(spec.Linux.Devices, specs.LinuxDevice{Path: "/dev/accel/accel0", Type: "c", Major: 510})
+	if err := saveSpecs(file, spec); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]any
+	d := json.NewDecoder(strings.NewReader(string(got)))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		t.Fatalf("invalid spec %s: %v", got, err)
+	}
+	if d.More() {
+		t.Errorf("trailing data in spec %s", got)
+	}
+	for _, want := range []string{
+		`"ioPriority":{"class":"IOPRIO_CLASS_IDLE"}`,
+		`"future":true`,
+		`"future":{"size":12345678901234567890}`,
+		`"env":["A=1"]`,
+		`"path":"/dev/accel/accel0"`,
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("got spec %s, want %s", got, want)
+		}
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("got file mode %v (%v), want 0600", info.Mode(), err)
+	}
+}
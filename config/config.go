@@ -16,10 +16,20 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
+	"github.com/HabanaAI/habana-container-runtime/artifact"
+	"github.com/HabanaAI/habana-container-runtime/capability"
+	"github.com/HabanaAI/habana-container-runtime/lease"
+	"github.com/HabanaAI/habana-container-runtime/policy"
 	"github.com/pelletier/go-toml/v2"
 )
 
@@ -28,6 +38,7 @@ const (
 	driverPath        = "/run/habana/driver"
 	configOverride    = "XDG_CONFIG_HOME"
 	configFilePath    = "habana-container-runtime/config.toml"
+	dropInDir         = "config.d"
 
 	hookDefaultFilePath = "/usr/bin/habana-container-hook"
 	defaultL3Config     = "/etc/habanalabs/gaudinet.json"
@@ -36,8 +47,13 @@ const (
 const (
 	ModeOCI    string = "oci"
 	ModeLegacy string = "legacy"
-	// TDB
-	ModeCDI string = "cdi"
+	ModeCDI    string = "cdi"
+)
+
+const (
+	LeaseModeNone      string = "none"
+	LeaseModeExclusive string = "exclusive"
+	LeaseModeShared    string = "shared"
 )
 
 var configDir = "/etc/"
@@ -47,9 +63,73 @@ type Config struct {
 	CLI                      CLIConfig     `toml:"habana-container-cli"`
 	Runtime                  RuntimeConfig `toml:"habana-container-runtime"`
 	AcceptEnvvarUnprivileged bool          `toml:"accept-habana-visible-devices-envvar-when-unprivileged"`
+	AcceptEnvvar             bool          `toml:"accept-habana-visible-devices-envvar"`
+	AcceptVolumeMounts       bool          `toml:"accept-habana-visible-devices-as-volume-mounts"`
 	MountAccelerators        bool          `toml:"mount_accelerators"`
 	MountUverbs              bool          `toml:"mount_uverbs"`
 	BinariesDir              string        `toml:"binaries-dir"`
+	// Device admission rules, evaluated in order. See the policy package.
+	Policies []policy.Rule `toml:"policy"`
+	// Extra device nodes and mounts of the containers given accelerators.
+	Devices []DeviceConfig `toml:"devices"`
+	Mounts  []MountConfig  `toml:"mounts"`
+
+	// Deprecated: ignored, the requirements are disabled with the
+	// HABANA_DISABLE_REQUIRE variable of the containers.
+	DisableRequire *bool `toml:"disable-require"`
+
+	// Warnings about the unknown and deprecated keys of the loaded files,
+	// reported by the binaries once they can log.
+	Warnings []string `toml:"-"`
+	// Files read, the config file and its drop-ins.
+	Files []string `toml:"-"`
+	// Files or environment variables setting the keys, by key, i.e
+	// "habana-container-runtime.mode" or "policy[0]". The keys missing from
+	// it have their default value.
+	Sources map[string]string `toml:"-"`
+}
+
+// DeviceConfig is a [[devices]] device node added to the containers given
+// accelerators, in oci mode.
+type DeviceConfig struct {
+	// Character device path, i.e "/dev/infiniband/rdma_cm". Glob patterns are
+	// expanded.
+	Path string `toml:"path"`
+	// Driver capabilities the container must have, i.e "rdma". Unset adds the
+	// device to all of them.
+	Capabilities capability.Set `toml:"capabilities"`
+	// Whether a missing device fails the container creation, instead of being
+	// skipped.
+	Required bool `toml:"required"`
+}
+
+// MountConfig is a [[mounts]] bind mount added to the containers given
+// accelerators, in oci mode.
+type MountConfig struct {
+	// Host path. Glob patterns are expanded.
+	Source string `toml:"source"`
+	// Container path, the host path when unset. With a glob pattern source,
+	// the directory the matches are mounted in.
+	Destination string `toml:"destination"`
+	// Defaults to true.
+	ReadOnly *bool `toml:"read_only"`
+	// Driver capabilities the container must have. Unset adds the mount to all
+	// of them.
+	Capabilities capability.Set `toml:"capabilities"`
+	// Whether a missing source fails the container creation, instead of being
+	// skipped.
+	Required bool `toml:"required"`
+}
+
+// validatePath checks a path or glob pattern of the config section.
+func validatePath(section, key, p string) error {
+	if !path.IsAbs(p) {
+		return fmt.Errorf("%s: %s must be an absolute path, got %q", section, key, p)
+	}
+	if _, err := filepath.Match(p, ""); err != nil {
+		return fmt.Errorf("%s: invalid %s pattern %q: %w", section, key, p, err)
+	}
+	return nil
 }
 
 type NetworkConfig struct {
@@ -62,6 +142,58 @@ type RuntimeConfig struct {
 	LogLevel      slog.Level `toml:"log_level"`
 	AlwaysMount   bool       `toml:"visible_devices_all_as_default"`
 	SystemdCgroup bool       `toml:"systemd_cgroup"`
+	CDI           CDIConfig  `toml:"cdi"`
+	// Root of the file system the accelerators are discovered from. Defaults
+	// to "/", other values are used with fixtures captured from real nodes.
+	DiscoveryRoot string `toml:"discovery_root"`
+	// Host-side record of the devices held by containers.
+	Leases LeasesConfig `toml:"leases"`
+	// Restrict the container CPUs and memory nodes to the NUMA nodes of its
+	// accelerators.
+	NUMAPlacement bool `toml:"numa_placement"`
+	// Host driver files injected with the utility driver capability.
+	Utility UtilityConfig `toml:"utility"`
+	// Low-level OCI runtime the container commands are passed to.
+	LowLevelRuntime LowLevelRuntimeConfig `toml:"low_level_runtime"`
+	// Directory of the records of what is created for the containers outside
+	// of their spec, removed when they are stopped or deleted.
+	ArtifactsDir string `toml:"artifacts_dir"`
+}
+
+type LowLevelRuntimeConfig struct {
+	// Binaries searched in PATH, or absolute paths. The first one found is
+	// used, i.e "runc", "crun" or "youki".
+	Paths []string `toml:"paths"`
+	// Extra global arguments, passed before the command arguments.
+	Args []string `toml:"args"`
+}
+
+type UtilityConfig struct {
+	// Host files bind mounted read-only at the same path in the containers.
+	// Glob patterns are expanded, and missing files are skipped.
+	Files []string `toml:"files"`
+	// ldconfig run in the container to add the directories of the libraries
+	// to its ld.so.cache. Empty disables the refresh.
+	Ldconfig string `toml:"ldconfig"`
+}
+
+type LeasesConfig struct {
+	// "exclusive" gives a device to one container at a time, and "shared" to
+	// at most MaxSharers containers. Defaults to "none", where containers can be
+	// given the same devices.
+	Mode string `toml:"mode"`
+	// Directory of the leases registry.
+	Dir string `toml:"dir"`
+	// Maximum number of containers sharing a device, in shared mode.
+	MaxSharers int `toml:"max_sharers"`
+}
+
+type CDIConfig struct {
+	// Directories scanned for CDI spec files, by increasing priority.
+	SpecDirs []string `toml:"spec_dirs"`
+	// Device kind used to qualify HABANA_VISIBLE_DEVICES values, i.e "0" is
+	// resolved as "habana.ai/gaudi=0".
+	DefaultKind string `toml:"default_kind"`
 }
 
 type CLIConfig struct {
@@ -69,35 +201,206 @@ type CLIConfig struct {
 	Path        *string  `toml:"path"`
 	Debug       string   `toml:"debug"`
 	Environment []string `toml:"environment"`
+
+	// Deprecated: moved to the top-level mount_accelerators key.
+	MountAccelerators *bool `toml:"mount_accelerators"`
+	// Deprecated: moved to the top-level mount_uverbs key.
+	MountUverbs *bool `toml:"mount_uverbs"`
+}
+
+// Paths returns the config files searched by Load, by decreasing priority:
+// under XDG_CONFIG_HOME when set, under the driver root, and under /etc.
+func Paths() []string {
+	var dirs []string
+	if XDGConfigDir := os.Getenv(configOverride); len(XDGConfigDir) != 0 {
+		dirs = append(dirs, XDGConfigDir)
+	}
+	dirs = append(dirs, path.Join(driverPath, configDir), configDir)
+
+	var paths []string
+	for _, dir := range dirs {
+		paths = append(paths, path.Join(dir, configFilePath))
+	}
+	return paths
 }
 
+// Load loads the first config file of Paths found. The error wraps
+// fs.ErrNotExist when there is none.
 func Load() (*Config, error) {
-	cfg := defaultConfig()
+	return load(false)
+}
 
-	if XDGConfigDir := os.Getenv(configOverride); len(XDGConfigDir) != 0 {
-		configDir = XDGConfigDir
+// LoadStrict is Load, failing on the unknown keys Load only warns about.
+func LoadStrict() (*Config, error) {
+	return load(true)
+}
+
+func load(strict bool) (*Config, error) {
+	paths := Paths()
+	for _, p := range paths {
+		_, err := os.Stat(p)
+		if err == nil {
+			return loadFile(p, strict)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
 	}
-	configFilePath := path.Join(configDir, configFilePath)
+	return nil, fmt.Errorf("no config file in %s: %w", strings.Join(paths, ", "), fs.ErrNotExist)
+}
+
+// LoadFile loads the config file, then the drop-in files of the config.d
+// directory next to it, in lexical order, and the HABANA_RUNTIME_* environment
+// variables. Each of them overrides the keys it sets, while its [[policy]],
+// [[devices]] and [[mounts]] tables are added to the ones read before.
+// Unknown keys are ignored with a warning.
+func LoadFile(file string) (*Config, error) {
+	return loadFile(file, false)
+}
 
-	f, err := os.Open(configFilePath)
+func loadFile(file string, strict bool) (*Config, error) {
+	cfg := Default()
+	cfg.Sources = make(map[string]string)
+
+	err := decodeFile(&cfg, file, strict)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	err = toml.NewDecoder(f).Decode(&cfg)
+	dropIns, err := filepath.Glob(filepath.Join(filepath.Dir(file), dropInDir, "*.toml"))
 	if err != nil {
 		return nil, err
 	}
+	for _, f := range dropIns {
+		if err := decodeFile(&cfg, f, strict); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(&cfg, os.Environ()); err != nil {
+		return nil, err
+	}
 
+	cfg.Warnings = append(cfg.Warnings, cfg.migrateDeprecated()...)
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
-func defaultConfig() Config {
+// decodeFile decodes the config file onto cfg. Unknown keys are most likely
+// typos of the ones expected: they are errors when strict, and warnings
+// otherwise, so that a typo does not stop the binaries.
+func decodeFile(cfg *Config, file string, strict bool) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	err = toml.NewDecoder(bytes.NewReader(content)).DisallowUnknownFields().Decode(cfg)
+	var missing *toml.StrictMissingError
+	if errors.As(err, &missing) {
+		var keys []string
+		for _, e := range missing.Errors {
+			keys = append(keys, strings.Join(e.Key(), "."))
+		}
+		if strict {
+			return fmt.Errorf("%s: unknown keys: %s", file, strings.Join(keys, ", "))
+		}
+		cfg.Warnings = append(cfg.Warnings, fmt.Sprintf("%s: unknown keys ignored: %s", file, strings.Join(keys, ", ")))
+	} else if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	cfg.Files = append(cfg.Files, file)
+	return cfg.addSources(content, file)
+}
+
+// migrateDeprecated moves the values of the deprecated keys to the keys
+// replacing them, and returns the warnings to report.
+func (c *Config) migrateDeprecated() []string {
+	var warnings []string
+	if c.DisableRequire != nil {
+		warnings = append(warnings, "disable-require is deprecated and ignored, set "+
+			"HABANA_DISABLE_REQUIRE in the containers instead")
+		c.DisableRequire = nil
+		delete(c.Sources, "disable-require")
+	}
+	if c.CLI.MountAccelerators != nil {
+		warnings = append(warnings, "habana-container-cli.mount_accelerators is deprecated, "+
+			"use mount_accelerators instead")
+		c.MountAccelerators = *c.CLI.MountAccelerators
+		c.CLI.MountAccelerators = nil
+		c.moveSource("habana-container-cli.mount_accelerators", "mount_accelerators")
+	}
+	if c.CLI.MountUverbs != nil {
+		warnings = append(warnings, "habana-container-cli.mount_uverbs is deprecated, "+
+			"use mount_uverbs instead")
+		c.MountUverbs = *c.CLI.MountUverbs
+		c.CLI.MountUverbs = nil
+		c.moveSource("habana-container-cli.mount_uverbs", "mount_uverbs")
+	}
+	return warnings
+}
+
+// validate checks the values of the loaded config.
+func (c *Config) validate() error {
+	if c.Runtime.Leases.Mode == LeaseModeShared && c.Runtime.Leases.MaxSharers < 1 {
+		return fmt.Errorf("leases: max_sharers must be at least 1, got %d", c.Runtime.Leases.MaxSharers)
+	}
+
+	switch c.Runtime.Mode {
+	case ModeOCI, ModeLegacy, ModeCDI:
+	default:
+		return fmt.Errorf("mode must be %q, %q or %q, got %q", ModeOCI, ModeLegacy, ModeCDI, c.Runtime.Mode)
+	}
+
+	switch c.Runtime.Leases.Mode {
+	case "", LeaseModeNone, LeaseModeExclusive, LeaseModeShared:
+	default:
+		return fmt.Errorf("leases: mode must be %q, %q or %q, got %q", LeaseModeNone, LeaseModeExclusive, LeaseModeShared, c.Runtime.Leases.Mode)
+	}
+	// The leases are taken by the runtime, which only resolves the devices
+	// in oci mode.
+	if c.Runtime.Leases.Mode != "" && c.Runtime.Leases.Mode != LeaseModeNone && c.Runtime.Mode != ModeOCI {
+		return fmt.Errorf("leases: mode %q is only enforced in %s mode, not %s", c.Runtime.Leases.Mode, ModeOCI, c.Runtime.Mode)
+	}
+
+	if len(c.Runtime.LowLevelRuntime.Paths) == 0 {
+		return fmt.Errorf("low_level_runtime: paths must not be empty")
+	}
+
+	for _, rule := range c.Policies {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range c.Devices {
+		if err := validatePath("devices", "path", d.Path); err != nil {
+			return err
+		}
+	}
+	for _, m := range c.Mounts {
+		if err := validatePath("mounts", "source", m.Source); err != nil {
+			return err
+		}
+		if m.Destination != "" && !path.IsAbs(m.Destination) {
+			return fmt.Errorf("mounts: destination must be an absolute path, got %q", m.Destination)
+		}
+	}
+
+	return nil
+}
+
+// Default returns the config used without config file.
+func Default() Config {
 	return Config{
-		MountAccelerators: true,
-		MountUverbs:       true,
-		BinariesDir:       "/usr/local/bin",
+		MountAccelerators:        true,
+		MountUverbs:              true,
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		BinariesDir:              "/usr/local/bin",
 		NetworkL3Config: NetworkConfig{
 			Path: defaultL3Config,
 		},
@@ -107,6 +410,28 @@ func defaultConfig() Config {
 			LogLevel:      slog.LevelInfo,
 			SystemdCgroup: false,
 			Mode:          ModeOCI,
+			CDI: CDIConfig{
+				SpecDirs:    []string{"/etc/cdi", "/var/run/cdi"},
+				DefaultKind: "habana.ai/gaudi",
+			},
+			DiscoveryRoot: "/",
+			Leases: LeasesConfig{
+				Mode:       LeaseModeNone,
+				Dir:        lease.DefaultDir,
+				MaxSharers: 2,
+			},
+			Utility: UtilityConfig{
+				Files: []string{
+					"/usr/bin/hl-smi",
+					"/usr/lib/habanalabs/libhlml.so",
+					"/usr/lib/habanalabs/libhl-thunk.so*",
+				},
+				Ldconfig: "/sbin/ldconfig",
+			},
+			LowLevelRuntime: LowLevelRuntimeConfig{
+				Paths: []string{"docker-runc", "runc"},
+			},
+			ArtifactsDir: artifact.DefaultDir,
 		},
 		CLI: CLIConfig{
 			Root:        nil,
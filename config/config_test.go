@@ -16,9 +16,17 @@
 package config
 
 import (
+	"errors"
+	"io/fs"
 	"log/slog"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/capability"
+	"github.com/HabanaAI/habana-container-runtime/policy"
 )
 
 func TestGetConfig(t *testing.T) {
@@ -27,16 +35,56 @@ func TestGetConfig(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Load() err=%q, want nil", err)
 	}
+	file := "testdata/input/habana-container-runtime/config.toml"
+	if !reflect.DeepEqual(cfg.Files, []string{file}) {
+		t.Errorf("got files %v, want %s", cfg.Files, file)
+	}
+	for key, want := range map[string]string{
+		"habana-container-runtime.mode":       file,
+		"habana-container-runtime.leases.dir": "default",
+		"policy[0]":                           file,
+	} {
+		if got := cfg.Source(key); got != want {
+			t.Errorf("got source %q of %s, want %q", got, key, want)
+		}
+	}
+	cfg.Files, cfg.Sources = nil, nil
+
+	allowUverbs := false
 	want := &Config{
-		MountAccelerators: true,
-		MountUverbs:       true,
-		BinariesDir:       "/usr/local/bin",
+		MountAccelerators:        true,
+		MountUverbs:              true,
+		AcceptEnvvar:             true,
+		AcceptEnvvarUnprivileged: true,
+		BinariesDir:              "/usr/local/bin",
 		Runtime: RuntimeConfig{
 			AlwaysMount:   false,
 			DebugFilePath: "/tmp/runtime-test",
 			LogLevel:      slog.LevelDebug,
 			SystemdCgroup: true,
 			Mode:          ModeLegacy,
+			CDI: CDIConfig{
+				SpecDirs:    []string{"/etc/cdi", "/var/run/cdi"},
+				DefaultKind: "habana.ai/gaudi",
+			},
+			DiscoveryRoot: "/",
+			Leases: LeasesConfig{
+				Mode:       LeaseModeNone,
+				Dir:        "/run/habana-container-runtime",
+				MaxSharers: 2,
+			},
+			Utility: UtilityConfig{
+				Files: []string{
+					"/usr/bin/hl-smi",
+					"/usr/lib/habanalabs/libhlml.so",
+					"/usr/lib/habanalabs/libhl-thunk.so*",
+				},
+				Ldconfig: "/sbin/ldconfig",
+			},
+			LowLevelRuntime: LowLevelRuntimeConfig{
+				Paths: []string{"docker-runc", "runc"},
+			},
+			ArtifactsDir: "/run/habana-container-runtime/containers",
 		},
 		CLI: CLIConfig{
 			Debug:       "/dev/null",
@@ -47,8 +95,228 @@ func TestGetConfig(t *testing.T) {
 		NetworkL3Config: NetworkConfig{
 			"/tmp/testdata.json",
 		},
+		Policies: []policy.Rule{
+			{
+				Name:        "team-a",
+				Namespaces:  []string{"team-a"},
+				Devices:     "0-3",
+				MaxDevices:  2,
+				AllowUverbs: &allowUverbs,
+			},
+		},
+		Devices: []DeviceConfig{
+			{Path: "/dev/infiniband/rdma_cm", Capabilities: capability.RDMA},
+		},
+		Mounts: []MountConfig{
+			{
+				Source:      "/etc/pki/site-ca.pem",
+				Destination: "/usr/local/share/ca-certificates/site-ca.crt",
+				Required:    true,
+			},
+		},
 	}
 	if !reflect.DeepEqual(cfg, want) {
 		t.Errorf("got %+v\nwant %+v", cfg, want)
 	}
 }
+
+// writeFile writes the file, and the directories holding it.
+func writeFile(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	t.Cleanup(func() { configDir = "/etc/" })
+	for name, content := range map[string]string{
+		"relative device":      "[[devices]]\npath = \"dev/infiniband/rdma_cm\"\n",
+		"device pattern":       "[[devices]]\npath = \"/dev/[infiniband\"\n",
+		"device capabilities":  "[[devices]]\npath = \"/dev/infiniband/rdma_cm\"\ncapabilities = \"graphics\"\n",
+		"relative source":      "[[mounts]]\nsource = \"site-ca.pem\"\n",
+		"relative destination": "[[mounts]]\nsource = \"/etc/pki/site-ca.pem\"\ndestination = \"ca.crt\"\n",
+		"unknown key":          "[habana-container-runtime]\nlog-level = \"debug\"\n",
+		"unknown mode":         "[habana-container-runtime]\nmode = \"lagacy\"\n",
+		"unknown lease mode":   "[habana-container-runtime.leases]\nmode = \"exclusiv\"\n",
+		"leases in cdi mode":   "[habana-container-runtime]\nmode = \"cdi\"\n[habana-container-runtime.leases]\nmode = \"exclusive\"\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			configDir = t.TempDir()
+			writeFile(t, filepath.Join(configDir, configFilePath), content)
+			if _, err := LoadStrict(); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestLoadNotFound(t *testing.T) {
+	t.Cleanup(func() { configDir = "/etc/" })
+	configDir = t.TempDir()
+	t.Setenv(configOverride, t.TempDir())
+	if _, err := Load(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	t.Setenv(configOverride, "/home/user/.config")
+	want := []string{
+		"/home/user/.config/habana-container-runtime/config.toml",
+		"/run/habana/driver/etc/habana-container-runtime/config.toml",
+		"/etc/habana-container-runtime/config.toml",
+	}
+	if got := Paths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLoadFileDropIns(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.toml")
+	writeFile(t, file, `
+mount_uverbs = false
+
+[habana-container-runtime]
+mode = "legacy"
+log_level = "debug"
+
+[habana-container-runtime.utility]
+files = ["/usr/bin/hl-smi"]
+
+[[policy]]
+name = "team-a"
+namespaces = ["team-a"]
+`)
+	writeFile(t, filepath.Join(dir, "config.d/20-site.toml"), `
+[habana-container-runtime]
+mode = "cdi"
+
+[[policy]]
+name = "default"
+devices = "none"
+`)
+	writeFile(t, filepath.Join(dir, "config.d/10-utility.toml"), `
+[habana-container-runtime]
+mode = "oci"
+
+[habana-container-runtime.utility]
+files = ["/usr/lib/habanalabs/libhlml.so"]
+`)
+	writeFile(t, filepath.Join(dir, "config.d/README"), "not a drop-in")
+
+	cfg, err := LoadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MountUverbs || cfg.Runtime.LogLevel != slog.LevelDebug {
+		t.Errorf("got mount_uverbs %t and log level %v, want the keys of the config file", cfg.MountUverbs, cfg.Runtime.LogLevel)
+	}
+	if cfg.Runtime.Mode != ModeCDI {
+		t.Errorf("got mode %q, want the one of the last drop-in %q", cfg.Runtime.Mode, ModeCDI)
+	}
+	if want := []string{"/usr/lib/habanalabs/libhlml.so"}; !reflect.DeepEqual(cfg.Runtime.Utility.Files, want) {
+		t.Errorf("got utility files %v, want %v", cfg.Runtime.Utility.Files, want)
+	}
+	var policies []string
+	for _, p := range cfg.Policies {
+		policies = append(policies, p.Name)
+	}
+	if want := []string{"team-a", "default"}; !reflect.DeepEqual(policies, want) {
+		t.Errorf("got policies %v, want %v", policies, want)
+	}
+
+	// Drop-ins are checked like the config file. Unknown keys are only
+	// errors when strict.
+	writeFile(t, filepath.Join(dir, "config.d/30-typo.toml"), "mount-uverbs = true\nmount_uverbs = true\n")
+	if _, err := loadFile(file, true); err == nil || !strings.Contains(err.Error(), "mount-uverbs") {
+		t.Errorf("got error %v, want the unknown key", err)
+	}
+	cfg, err = LoadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Warnings) != 1 || !strings.Contains(cfg.Warnings[0], "mount-uverbs") {
+		t.Errorf("got warnings %q, want the unknown key", cfg.Warnings)
+	}
+	if !cfg.MountUverbs {
+		t.Errorf("got mount_uverbs %t, want the known key of the drop-in decoded", cfg.MountUverbs)
+	}
+}
+
+func TestLoadFileDeprecated(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.toml")
+	writeFile(t, file, `
+disable-require = false
+
+[habana-container-cli]
+mount_accelerators = false
+`)
+	cfg, err := LoadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Source("mount_accelerators"); got != file {
+		t.Errorf("got source %q of mount_accelerators, want %q", got, file)
+	}
+	if cfg.MountAccelerators || !cfg.MountUverbs {
+		t.Errorf("got mount_accelerators %t and mount_uverbs %t, want false and true", cfg.MountAccelerators, cfg.MountUverbs)
+	}
+	if cfg.DisableRequire != nil || cfg.CLI.MountAccelerators != nil {
+		t.Errorf("deprecated keys kept: %+v", cfg)
+	}
+	if len(cfg.Warnings) != 2 {
+		t.Errorf("got warnings %q, want 2", cfg.Warnings)
+	}
+}
+
+func TestDump(t *testing.T) {
+	t.Setenv("HABANA_RUNTIME_LOG_LEVEL", "warn")
+	cfg, err := LoadFile("testdata/input/habana-container-runtime/config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := cfg.Dump(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"mode = 'legacy' # testdata/input/habana-container-runtime/config.toml\n",
+		"log_level = 'WARN' # $HABANA_RUNTIME_LOG_LEVEL\n",
+		"max_sharers = 2 # default\n",
+		"[[policy]] # testdata/input/habana-container-runtime/config.toml\n",
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("dump is missing %q:\n%s", line, b.String())
+		}
+	}
+
+	// The dump is a config file of the same config, its values dumped the
+	// same from any source.
+	file := filepath.Join(t.TempDir(), "config.toml")
+	writeFile(t, file, b.String())
+	got, err := LoadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d strings.Builder
+	if err := got.Dump(&d); err != nil {
+		t.Fatal(err)
+	}
+	if values(d.String()) != values(b.String()) {
+		t.Errorf("got dump\n%s\nwant\n%s", d.String(), b.String())
+	}
+}
+
+// values strips the source comments of a dump.
+func values(dump string) string {
+	lines := strings.Split(dump, "\n")
+	for i, l := range lines {
+		lines[i], _, _ = strings.Cut(l, " # ")
+	}
+	return strings.Join(lines, "\n")
+}
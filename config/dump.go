@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// sourceDefault is the source of the keys no file or variable sets.
+const sourceDefault = "default"
+
+// addSources records the file as the source of the keys of its content. The
+// tables of its arrays of tables follow the ones read before.
+func (c *Config) addSources(content []byte, file string) error {
+	var doc map[string]any
+	if err := toml.Unmarshal(content, &doc); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	c.addTableSources(doc, nil, file)
+	return nil
+}
+
+func (c *Config) addTableSources(table map[string]any, parent []string, file string) {
+	for k, v := range table {
+		key := strings.Join(append(append([]string{}, parent...), k), ".")
+		switch v := v.(type) {
+		case map[string]any:
+			c.addTableSources(v, append(parent, k), file)
+		case []any:
+			if len(v) == 0 || !isTable(v[0]) {
+				c.Sources[key] = file
+				continue
+			}
+			n := 0
+			for s := range c.Sources {
+				if strings.HasPrefix(s, key+"[") {
+					n++
+				}
+			}
+			for i := range v {
+				c.Sources[fmt.Sprintf("%s[%d]", key, n+i)] = file
+			}
+		default:
+			c.Sources[key] = file
+		}
+	}
+}
+
+func isTable(v any) bool {
+	_, ok := v.(map[string]any)
+	return ok
+}
+
+// moveSource records the source of a deprecated key for the key replacing it.
+func (c *Config) moveSource(from, to string) {
+	if s, ok := c.Sources[from]; ok {
+		c.Sources[to] = s
+		delete(c.Sources, from)
+	}
+}
+
+// Source returns the file or environment variable setting the key, or
+// "default".
+func (c *Config) Source(key string) string {
+	if s, ok := c.Sources[key]; ok {
+		return s
+	}
+	return sourceDefault
+}
+
+// Dump writes the config in the TOML format, with the source of each value in
+// a comment. The unset optional keys are omitted.
+func (c *Config) Dump(w io.Writer) error {
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+	var tables []string
+	entries := make(map[string][]entry)
+	_ = walkKeys(reflect.ValueOf(c).Elem(), nil, func(key []string, v reflect.Value) error {
+		table := strings.Join(key[:len(key)-1], ".")
+		if _, ok := entries[table]; !ok {
+			tables = append(tables, table)
+		}
+		entries[table] = append(entries[table], entry{strings.Join(key, "."), v})
+		return nil
+	})
+	// The keys of the root table come first, before any table header.
+	for i, t := range tables {
+		if t == "" {
+			tables = append(append([]string{""}, tables[:i]...), tables[i+1:]...)
+			break
+		}
+	}
+
+	for _, t := range tables {
+		if t != "" {
+			fmt.Fprintf(w, "\n[%s]\n", t)
+		}
+		for _, e := range entries[t] {
+			if e.value.Kind() == reflect.Pointer && e.value.IsNil() {
+				continue
+			}
+			value, err := encodeValue(e.value.Interface())
+			if err != nil {
+				return fmt.Errorf("%s: %w", e.key, err)
+			}
+			name := e.key[strings.LastIndex(e.key, ".")+1:]
+			fmt.Fprintf(w, "%s = %s # %s\n", name, value, c.Source(e.key))
+		}
+	}
+
+	// The arrays of tables are only set by files.
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("toml"), ",")
+		if f.Kind() != reflect.Slice || f.Type().Elem().Kind() != reflect.Struct || name == "-" {
+			continue
+		}
+		for j := 0; j < f.Len(); j++ {
+			content, err := toml.Marshal(f.Index(j).Interface())
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			fmt.Fprintf(w, "\n[[%s]] # %s\n%s", name, c.Source(fmt.Sprintf("%s[%d]", name, j)), content)
+		}
+	}
+	return nil
+}
+
+// encodeValue returns the TOML encoding of a value.
+func encodeValue(v any) (string, error) {
+	content, err := toml.Marshal(map[string]any{"v": v})
+	if err != nil {
+		return "", err
+	}
+	value, ok := bytes.CutPrefix(bytes.TrimSpace(content), []byte("v = "))
+	if !ok {
+		return "", fmt.Errorf("unexpected encoding %q", content)
+	}
+	return string(value), nil
+}
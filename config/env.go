@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix prefixes the environment variables overriding the config keys.
+const EnvPrefix = "HABANA_RUNTIME_"
+
+// envSections are the names of the config sections in the environment
+// variables. The keys of the runtime section are named without section.
+var envSections = map[string]string{
+	"habana-container-runtime": "",
+	"habana-container-cli":     "cli",
+}
+
+// deprecatedKeys are not overridden by environment variables.
+var deprecatedKeys = map[string]bool{
+	"disable-require":                         true,
+	"habana-container-cli.mount_accelerators": true,
+	"habana-container-cli.mount_uverbs":       true,
+}
+
+// EnvName returns the environment variable overriding the key, i.e
+// HABANA_RUNTIME_LEASES_MODE for habana-container-runtime.leases.mode.
+func EnvName(key []string) string {
+	var parts []string
+	for i, k := range key {
+		if s, ok := envSections[k]; ok && i == 0 {
+			k = s
+		}
+		if k != "" {
+			parts = append(parts, k)
+		}
+	}
+	name := strings.ToUpper(strings.Join(parts, "_"))
+	return EnvPrefix + strings.ReplaceAll(name, "-", "_")
+}
+
+// EnvNames returns the environment variables overriding config keys, by key.
+// The arrays of tables are not overridden.
+func EnvNames() map[string]string {
+	names := make(map[string]string)
+	_ = walkKeys(reflect.ValueOf(&Config{}).Elem(), nil, func(key []string, _ reflect.Value) error {
+		names[strings.Join(key, ".")] = EnvName(key)
+		return nil
+	})
+	return names
+}
+
+// applyEnv sets the keys of the environment variables of environ, in the
+// "key=value" form. Lists are comma separated.
+func applyEnv(cfg *Config, environ []string) error {
+	vars := make(map[string]string)
+	for _, kv := range environ {
+		k, v, ok := strings.Cut(kv, "=")
+		if ok && strings.HasPrefix(k, EnvPrefix) {
+			vars[k] = v
+		}
+	}
+	if len(vars) == 0 {
+		return nil
+	}
+
+	return walkKeys(reflect.ValueOf(cfg).Elem(), nil, func(key []string, v reflect.Value) error {
+		name := EnvName(key)
+		value, ok := vars[name]
+		if !ok {
+			return nil
+		}
+		if err := setValue(v, value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if cfg.Sources != nil {
+			cfg.Sources[strings.Join(key, ".")] = "$" + name
+		}
+		return nil
+	})
+}
+
+// walkKeys calls fn with the key of each value of the struct v, the ones of
+// its tables included. The arrays of tables are skipped.
+func walkKeys(v reflect.Value, parent []string, fn func(key []string, v reflect.Value) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("toml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := append(append([]string{}, parent...), name)
+		if deprecatedKeys[strings.Join(key, ".")] {
+			continue
+		}
+
+		f := v.Field(i)
+		_, text := f.Addr().Interface().(encoding.TextUnmarshaler)
+		switch {
+		case f.Kind() == reflect.Struct && !text:
+			err := walkKeys(f, key, fn)
+			if err != nil {
+				return err
+			}
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct:
+			continue
+		default:
+			err := fn(key, f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setValue sets v from the string s.
+func setValue(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		p := reflect.New(v.Type().Elem())
+		if err := setValue(p.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		list := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package config
+
+import (
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		key  []string
+		want string
+	}{
+		{[]string{"mount_uverbs"}, "HABANA_RUNTIME_MOUNT_UVERBS"},
+		{[]string{"accept-habana-visible-devices-envvar"}, "HABANA_RUNTIME_ACCEPT_HABANA_VISIBLE_DEVICES_ENVVAR"},
+		{[]string{"habana-container-runtime", "debug"}, "HABANA_RUNTIME_DEBUG"},
+		{[]string{"habana-container-runtime", "leases", "mode"}, "HABANA_RUNTIME_LEASES_MODE"},
+		{[]string{"habana-container-cli", "debug"}, "HABANA_RUNTIME_CLI_DEBUG"},
+		{[]string{"network-layer-routes", "path"}, "HABANA_RUNTIME_NETWORK_LAYER_ROUTES_PATH"},
+	}
+	for _, tt := range tests {
+		if got := EnvName(tt.key); got != tt.want {
+			t.Errorf("EnvName(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestEnvNamesUnique(t *testing.T) {
+	keys := make(map[string]string)
+	for key, name := range EnvNames() {
+		if other, ok := keys[name]; ok {
+			t.Errorf("keys %s and %s are both overridden by %s", key, other, name)
+		}
+		keys[name] = key
+	}
+	if _, ok := EnvNames()["disable-require"]; ok {
+		t.Error("deprecated key overridden")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	cfg := Default()
+	err := applyEnv(&cfg, []string{
+		"PATH=/usr/bin",
+		"HABANA_RUNTIME_MOUNT_UVERBS=false",
+		"HABANA_RUNTIME_LOG_LEVEL=debug",
+		"HABANA_RUNTIME_LEASES_MAX_SHARERS=4",
+		"HABANA_RUNTIME_UTILITY_FILES=/usr/bin/hl-smi, /usr/lib/habanalabs/libhlml.so",
+		"HABANA_RUNTIME_CLI_ROOT=/run/habana/driver",
+		"HABANA_RUNTIME_UNKNOWN=1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Default()
+	want.MountUverbs = false
+	want.Runtime.LogLevel = slog.LevelDebug
+	want.Runtime.Leases.MaxSharers = 4
+	want.Runtime.Utility.Files = []string{"/usr/bin/hl-smi", "/usr/lib/habanalabs/libhlml.so"}
+	root := "/run/habana/driver"
+	want.CLI.Root = &root
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v\nwant %+v", cfg, want)
+	}
+
+	for _, env := range []string{
+		"HABANA_RUNTIME_MOUNT_UVERBS=maybe",
+		"HABANA_RUNTIME_LEASES_MAX_SHARERS=two",
+		"HABANA_RUNTIME_LOG_LEVEL=verbose",
+	} {
+		cfg := Default()
+		if err := applyEnv(&cfg, []string{env}); err == nil {
+			t.Errorf("%s: got no error", env)
+		}
+	}
+}
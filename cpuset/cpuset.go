@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cpuset handles the CPU and memory node lists of the kernel, as in
+// sysfs cpulist files and the cpuset cgroup, i.e "0-3,8,10-11".
+package cpuset
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Set is a sorted set of CPUs or memory nodes.
+type Set []int
+
+// Parse parses a list. An empty list is an empty set.
+func Parse(list string) (Set, error) {
+	var s Set
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return s, nil
+	}
+	for _, r := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(r), "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid cpu list %q", list)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpu list %q", list)
+			}
+		}
+		for i := start; i <= end; i++ {
+			s = append(s, i)
+		}
+	}
+	slices.Sort(s)
+	return slices.Compact(s), nil
+}
+
+// Of returns the set of the ids.
+func Of(ids ...int) Set {
+	s := slices.Clone(Set(ids))
+	slices.Sort(s)
+	return slices.Compact(s)
+}
+
+// Union returns the ids in s or o.
+func (s Set) Union(o Set) Set {
+	return Of(append(slices.Clone(s), o...)...)
+}
+
+// Intersect returns the ids in both s and o.
+func (s Set) Intersect(o Set) Set {
+	var r Set
+	for _, id := range s {
+		if _, found := slices.BinarySearch(o, id); found {
+			r = append(r, id)
+		}
+	}
+	return r
+}
+
+// String returns the list of the set, with ranges, i.e "0-3,8".
+func (s Set) String() string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		j := i
+		for j+1 < len(s) && s[j+1] == s[j]+1 {
+			j++
+		}
+		if b.Len() != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Itoa(s[i]))
+		if j != i {
+			b.WriteByte('-')
+			b.WriteString(strconv.Itoa(s[j]))
+		}
+		i = j
+	}
+	return b.String()
+}
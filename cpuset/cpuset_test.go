@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cpuset
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for list, want := range map[string]string{
+		"":              "",
+		"0":             "0",
+		"0-3,8,10-11\n": "0-3,8,10-11",
+		"3,1,2,2":       "1-3",
+		"0-1,1-4":       "0-4",
+	} {
+		s, err := Parse(list)
+		if err != nil {
+			t.Fatalf("%q: %v", list, err)
+		}
+		if s.String() != want {
+			t.Errorf("%q: got %q, want %q", list, s.String(), want)
+		}
+	}
+
+	for _, list := range []string{"a", "1-", "3-1", "-1", "1,,2"} {
+		if _, err := Parse(list); err == nil {
+			t.Errorf("%q: got no error", list)
+		}
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	a, _ := Parse("0-39,80-119")
+	b, _ := Parse("30-50,100")
+
+	if got, want := a.Intersect(b).String(), "30-39,100"; got != want {
+		t.Errorf("intersect: got %q, want %q", got, want)
+	}
+	if got, want := a.Union(b).String(), "0-50,80-119"; got != want {
+		t.Errorf("union: got %q, want %q", got, want)
+	}
+	if got := a.Intersect(Of(200)); len(got) != 0 {
+		t.Errorf("got %v, want an empty set", got)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package diff formats the differences between two texts as a unified diff.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// context is the number of unchanged lines around the changes.
+const context = 3
+
+type op struct {
+	kind byte // ' ', '-' or '+'
+	line string
+	// Lines of a and b before the op.
+	a, b int
+}
+
+// Unified returns the unified diff from a to b, or "" when they are equal.
+func Unified(aName, bName, a, b string) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	var sb strings.Builder
+	for _, hunk := range hunks(ops) {
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+		}
+		first := hunk[0]
+		aLen, bLen := 0, 0
+		for _, o := range hunk {
+			if o.kind != '+' {
+				aLen++
+			}
+			if o.kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(first.a, aLen), hunkRange(first.b, bLen))
+		for _, o := range hunk {
+			fmt.Fprintf(&sb, "%c%s\n", o.kind, o.line)
+		}
+	}
+	return sb.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// hunkRange returns the start,length range of a hunk starting after line,
+// where an empty range starts at the line before it.
+func hunkRange(line, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", line)
+	}
+	return fmt.Sprintf("%d,%d", line+1, length)
+}
+
+// diffLines returns the ops turning a into b, from their longest common
+// subsequence.
+func diffLines(a, b []string) []op {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var ops []op
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, op{kind: ' ', line: a[i], a: i, b: j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, op{kind: '-', line: a[i], a: i, b: j})
+			i++
+		default:
+			ops = append(ops, op{kind: '+', line: b[j], a: i, b: j})
+			j++
+		}
+	}
+	return ops
+}
+
+// hunks groups the changes with their context lines. Changes separated by
+// less than twice the context are in the same hunk.
+func hunks(ops []op) [][]op {
+	var groups [][]op
+	i := 0
+	for i < len(ops) {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		start := max(0, i-context)
+
+		end := i
+		for {
+			for end < len(ops) && ops[end].kind != ' ' {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next < len(ops) && next-end <= 2*context {
+				end = next
+				continue
+			}
+			end = min(len(ops), end+context)
+			break
+		}
+		groups = append(groups, ops[start:end])
+		i = end
+	}
+	return groups
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package discover
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Accelerator is a Habanalabs accelerator with everything attached to it.
+type Accelerator struct {
+	// Index of the accelerator, N in /dev/accel/accelN.
+	Index int
+	// PCI address, i.e 0000:4d:00.0
+	PCIAddress string
+	// Module ID (OAM) of the accelerator. Empty when not reported by the driver.
+	ModuleID string
+	// Serial number of the board. Empty when not reported by the driver.
+	Serial string
+	// Lower case device type, i.e gaudi2.
+	Type string
+	// Firmware version string, i.e hl-gaudi2-1.17.0-fw-51.2.0-sec-9. Empty
+	// when not reported by the driver.
+	Firmware string
+	// NUMA node of the PCI device, -1 when unknown.
+	NUMANode int
+	// Accelerator device node.
+	AccelPath string
+	// Control device node.
+	ControlPath string
+	// Infiniband verbs device node. Empty when the device has no uverbs.
+	UverbsPath string
+	// Name of the infiniband device, i.e hlib_0. Empty when not found.
+	Hlib string
+	// External network interfaces of the accelerator.
+	NetDevs []NetDev
+}
+
+// NetDev is an external network interface of an accelerator.
+type NetDev struct {
+	Name    string
+	Address string
+	Port    int
+}
+
+// ID returns the accelerator index as used by HABANA_VISIBLE_DEVICES.
+func (a Accelerator) ID() string {
+	return strconv.Itoa(a.Index)
+}
+
+// DevicePaths returns the accelerator device nodes, accel and control.
+func (a Accelerator) DevicePaths() []string {
+	return []string{a.AccelPath, a.ControlPath}
+}
+
+// accelerators returns the accelerators found in the sysAccel class
+// directory, sorted by index.
+func accelerators(sysAccel string) ([]Accelerator, error) {
+	entries, err := os.ReadDir(sysAccel)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNoDevices
+		}
+		return nil, fmt.Errorf("discover accelerators: %w", err)
+	}
+
+	var accelerators []Accelerator
+	for _, e := range entries {
+		id, ok := strings.CutPrefix(e.Name(), "accel")
+		if !ok {
+			continue
+		}
+		index, err := strconv.Atoi(id)
+		if err != nil {
+			// accel_controlDN entries
+			continue
+		}
+
+		acc, err := readAccelerator(path.Join(sysAccel, e.Name(), "device"), index)
+		if err != nil {
+			return nil, fmt.Errorf("discover accelerator %s: %w", e.Name(), err)
+		}
+		accelerators = append(accelerators, acc)
+	}
+
+	if len(accelerators) == 0 {
+		return nil, ErrNoDevices
+	}
+
+	sort.Slice(accelerators, func(i, j int) bool {
+		return accelerators[i].Index < accelerators[j].Index
+	})
+	return accelerators, nil
+}
+
+func readAccelerator(devDir string, index int) (Accelerator, error) {
+	acc := Accelerator{
+		Index:       index,
+		NUMANode:    -1,
+		AccelPath:   fmt.Sprintf("/dev/accel/accel%d", index),
+		ControlPath: fmt.Sprintf("/dev/accel/accel_controlD%d", index),
+	}
+
+	var err error
+	acc.PCIAddress, err = readValue(path.Join(devDir, "pci_addr"))
+	if err != nil {
+		return acc, err
+	}
+
+	acc.ModuleID, err = readValue(path.Join(devDir, "module_id"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return acc, err
+	}
+
+	acc.Serial, err = readValue(path.Join(devDir, "serial_number"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return acc, err
+	}
+
+	devType, err := readValue(path.Join(devDir, "device_type"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return acc, err
+	}
+	acc.Type = parseDeviceType(devType)
+
+	// Older drivers name the firmware ArmCP.
+	for _, name := range []string{"cpucp_ver", "armcp_ver"} {
+		acc.Firmware, err = readValue(path.Join(devDir, name))
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return acc, err
+		}
+	}
+
+	numa, err := readValue(path.Join(devDir, "numa_node"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return acc, err
+	}
+	if n, err := strconv.Atoi(numa); err == nil {
+		acc.NUMANode = n
+	}
+
+	uverbs, err := readDirNames(path.Join(devDir, "infiniband_verbs"))
+	if err != nil {
+		return acc, err
+	}
+	if len(uverbs) != 0 {
+		acc.UverbsPath = "/dev/infiniband/" + uverbs[0]
+	}
+
+	hlibs, err := readDirNames(path.Join(devDir, "infiniband"))
+	if err != nil {
+		return acc, err
+	}
+	if len(hlibs) != 0 {
+		acc.Hlib = hlibs[0]
+	}
+
+	acc.NetDevs, err = readNetDevs(path.Join(devDir, "net"))
+	if err != nil {
+		return acc, err
+	}
+
+	return acc, nil
+}
+
+func readNetDevs(netDir string) ([]NetDev, error) {
+	names, err := readDirNames(netDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var netDevs []NetDev
+	for _, name := range names {
+		address, err := readValue(path.Join(netDir, name, "address"))
+		if err != nil {
+			return nil, err
+		}
+		devPort, err := readValue(path.Join(netDir, name, "dev_port"))
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(devPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dev_port for %s: %w", name, err)
+		}
+		netDevs = append(netDevs, NetDev{Name: name, Address: address, Port: port})
+	}
+	return netDevs, nil
+}
+
+// parseDeviceType returns the lower case device type from the content of the
+// device_type sysfs file, i.e "GAUDI2" --> "gaudi2".
+func parseDeviceType(content string) string {
+	parts := strings.Fields(content)
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.ToLower(parts[0])
+}
+
+func readValue(file string) (string, error) {
+	content, err := os.ReadFile(path.Clean(file))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// readDirNames returns the sorted entries names of dir, or none if it does
+// not exist.
+func readDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+// ModuleIDs returns the module IDs of the accelerators, as used by
+// HABANA_VISIBLE_MODULES. Accelerators without a module ID are skipped.
+func ModuleIDs(accelerators []Accelerator) []string {
+	ids := make([]string, 0, len(accelerators))
+	for _, acc := range accelerators {
+		if acc.ModuleID != "" {
+			ids = append(ids, acc.ModuleID)
+		}
+	}
+	return ids
+}
+
+// IDs returns the indexes of the accelerators, as used by HABANA_VISIBLE_DEVICES.
+func IDs(accelerators []Accelerator) []string {
+	ids := make([]string, 0, len(accelerators))
+	for _, acc := range accelerators {
+		ids = append(ids, acc.ID())
+	}
+	return ids
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package discover
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDeviceType(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "happy path",
+			input: "GAUDI2",
+			want:  "gaudi2",
+		},
+		{
+			name:  "file contains new line",
+			input: "GAUDI2\n",
+			want:  "gaudi2",
+		},
+		{
+			name:  "file contains new line and space char",
+			input: " GAUDI2\t\n",
+			want:  "gaudi2",
+		},
+		{
+			name:  "empty file",
+			input: "",
+			want:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseDeviceType(tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAccelerators(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"sys/class/accel/accel2/device/pci_addr":                   "0000:b3:00.0\n",
+		"sys/class/accel/accel2/device/module_id":                  "6\n",
+		"sys/class/accel/accel2/device/device_type":                "GAUDI2\n",
+		"sys/class/accel/accel2/device/numa_node":                  "1\n",
+		"sys/class/accel/accel2/device/armcp_ver":                  "hl-gaudi2-1.15.0-fw-49.0.0-sec-4\n",
+		"sys/class/accel/accel2/device/infiniband_verbs/uverbs3/x": "",
+		"sys/class/accel/accel2/device/infiniband/hlib_3/x":        "",
+		"sys/class/accel/accel2/device/net/eth5/address":           "b0:fd:0b:00:00:05\n",
+		"sys/class/accel/accel2/device/net/eth5/dev_port":          "22\n",
+		"sys/class/accel/accel_controlD2/device/pci_addr":          "0000:b3:00.0\n",
+		"sys/class/accel/accel10/device/pci_addr":                  "0000:1a:00.0\n",
+		"sys/class/accel/accel10/device/device_type":               "GAUDI2\n",
+		"sys/class/accel/accel10/device/numa_node":                 "-1\n",
+		"sys/class/accel/accel_controlD10/device/device_type":      "GAUDI2\n",
+	})
+
+	r, err := NewRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.Accelerators()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Accelerator{
+		{
+			Index:       2,
+			PCIAddress:  "0000:b3:00.0",
+			ModuleID:    "6",
+			Type:        "gaudi2",
+			Firmware:    "hl-gaudi2-1.15.0-fw-49.0.0-sec-4",
+			NUMANode:    1,
+			AccelPath:   "/dev/accel/accel2",
+			ControlPath: "/dev/accel/accel_controlD2",
+			UverbsPath:  "/dev/infiniband/uverbs3",
+			Hlib:        "hlib_3",
+			NetDevs:     []NetDev{{Name: "eth5", Address: "b0:fd:0b:00:00:05", Port: 22}},
+		},
+		{
+			Index:       10,
+			PCIAddress:  "0000:1a:00.0",
+			Type:        "gaudi2",
+			NUMANode:    -1,
+			AccelPath:   "/dev/accel/accel10",
+			ControlPath: "/dev/accel/accel_controlD10",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+
+	if ids := IDs(got); !reflect.DeepEqual(ids, []string{"2", "10"}) {
+		t.Errorf("got ids %v", ids)
+	}
+}
+
+func TestAcceleratorsNoDevices(t *testing.T) {
+	r := &Root{path: t.TempDir()}
+	if _, err := r.Accelerators(); !errors.Is(err, ErrNoDevices) {
+		t.Errorf("got error %v, want %v", err, ErrNoDevices)
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package discover
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// FixtureDevicesFile holds the device nodes of a fixture directory, since
+// device nodes cannot be created without privileges.
+const FixtureDevicesFile = "devices.json"
+
+// Root is the file system root holding the sysfs and devfs trees the devices
+// are discovered from. It is "/" on a real node, or a fixture directory
+// created by Capture.
+type Root struct {
+	path string
+	// Device nodes of a fixture, by absolute path. nil for a real root.
+	nodes map[string]*DevInfo
+}
+
+// HostRoot is the root of the host file system.
+var HostRoot = &Root{path: "/"}
+
+// NewRoot returns the root at dir. If dir holds a devices file, it is loaded
+// as a fixture and the device nodes are read from it.
+func NewRoot(dir string) (*Root, error) {
+	if dir == "" || dir == "/" {
+		return HostRoot, nil
+	}
+
+	r := &Root{path: dir}
+
+	content, err := os.ReadFile(filepath.Join(dir, FixtureDevicesFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return r, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &r.nodes); err != nil {
+		return nil, fmt.Errorf("reading fixture devices: %w", err)
+	}
+	for p, info := range r.nodes {
+		info.Path = p
+	}
+	return r, nil
+}
+
+// Path returns the root directory.
+func (r *Root) Path() string {
+	return r.path
+}
+
+// Join returns the location of the absolute host path p under the root.
+func (r *Root) Join(p string) string {
+	return path.Join(r.path, p)
+}
+
+// DeviceInfo returns the information of the device node at the absolute host
+// path p. The returned path is p, not its location under the root.
+func (r *Root) DeviceInfo(p string) (*DevInfo, error) {
+	if r.nodes != nil {
+		info, ok := r.nodes[path.Clean(p)]
+		if !ok {
+			return nil, fmt.Errorf("device info: %s: %w", p, fs.ErrNotExist)
+		}
+		i := *info
+		return &i, nil
+	}
+
+	info, err := DeviceInfo(r.Join(p))
+	if err != nil {
+		return nil, err
+	}
+	info.Path = p
+	return info, nil
+}
+
+// Glob returns the absolute host paths of the device nodes matching the
+// filepath.Match pattern, sorted. The device nodes of a fixture are the ones
+// of its devices file.
+func (r *Root) Glob(pattern string) ([]string, error) {
+	if r.nodes == nil {
+		matches, err := filepath.Glob(r.Join(pattern))
+		if err != nil {
+			return nil, err
+		}
+		for i, m := range matches {
+			matches[i] = path.Join("/", rel(r, m))
+		}
+		return matches, nil
+	}
+
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	var matches []string
+	for p := range r.nodes {
+		if ok, _ := filepath.Match(pattern, p); ok {
+			matches = append(matches, p)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// Accelerators returns the accelerators found under the root, sorted by index.
+func (r *Root) Accelerators() ([]Accelerator, error) {
+	return accelerators(r.Join("/sys/class/accel"))
+}
+
+// NodeCPUs returns the CPU list of the NUMA node, i.e "0-39,80-119".
+func (r *Root) NodeCPUs(node int) (string, error) {
+	return readValue(r.Join(fmt.Sprintf("/sys/devices/system/node/node%d/cpulist", node)))
+}
+
+// DriverVersion returns the version of the loaded habanalabs driver, i.e
+// "1.17.0-a4e6b6c".
+func (r *Root) DriverVersion() (string, error) {
+	return readValue(r.Join("/sys/module/habanalabs/version"))
+}
+
+// captureGlobs are the sysfs files read during discovery, copied by Capture.
+var captureGlobs = []string{
+	"/sys/class/accel/accel*/device/pci_addr",
+	"/sys/class/accel/accel*/device/module_id",
+	"/sys/class/accel/accel*/device/serial_number",
+	"/sys/class/accel/accel*/device/device_type",
+	"/sys/class/accel/accel*/device/cpucp_ver",
+	"/sys/class/accel/accel*/device/armcp_ver",
+	"/sys/class/accel/accel*/device/numa_node",
+	"/sys/class/accel/accel*/device/net/*/address",
+	"/sys/class/accel/accel*/device/net/*/dev_port",
+	"/sys/devices/system/node/node*/cpulist",
+	"/sys/module/habanalabs/version",
+}
+
+// captureDirGlobs are the sysfs directories discovery lists. Capture recreates
+// them with a .keep file only, so they can be committed.
+var captureDirGlobs = []string{
+	"/sys/class/accel/accel*/device/infiniband_verbs/*",
+	"/sys/class/accel/accel*/device/infiniband/*",
+}
+
+// Capture copies the sysfs files used for discovery from the root into dst,
+// and writes the accelerators device nodes into the fixture devices file.
+// Symbolic links are resolved, so the fixture holds regular files only.
+func Capture(r *Root, dst string) error {
+	accelerators, err := r.Accelerators()
+	if err != nil {
+		return err
+	}
+
+	for _, pattern := range captureGlobs {
+		matches, err := filepath.Glob(r.Join(pattern))
+		if err != nil {
+			return err
+		}
+		for _, src := range matches {
+			content, err := os.ReadFile(src)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(dst, rel(r, src))
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(target, content, 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, pattern := range captureDirGlobs {
+		matches, err := filepath.Glob(r.Join(pattern))
+		if err != nil {
+			return err
+		}
+		for _, src := range matches {
+			target := filepath.Join(dst, rel(r, src))
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(target, ".keep"), nil, 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	nodes := make(map[string]*DevInfo)
+	for _, acc := range accelerators {
+		paths := acc.DevicePaths()
+		if acc.UverbsPath != "" {
+			paths = append(paths, acc.UverbsPath)
+		}
+		for _, p := range paths {
+			info, err := r.DeviceInfo(p)
+			if err != nil {
+				return err
+			}
+			nodes[p] = info
+		}
+	}
+
+	content, err := json.MarshalIndent(nodes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dst, FixtureDevicesFile), content, 0644)
+}
+
+func rel(r *Root, p string) string {
+	rp, err := filepath.Rel(r.path, p)
+	if err != nil {
+		return p
+	}
+	return rp
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package discover
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+func TestRootFixture(t *testing.T) {
+	r, err := NewRoot("testdata/hls2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accelerators, err := r.Accelerators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Accelerator{
+		{
+			Index:       0,
+			PCIAddress:  "0000:33:00.0",
+			ModuleID:    "1",
+			Serial:      "AN00012345",
+			Type:        "gaudi2",
+			Firmware:    "hl-gaudi2-1.17.0-fw-51.2.0-sec-9",
+			NUMANode:    0,
+			AccelPath:   "/dev/accel/accel0",
+			ControlPath: "/dev/accel/accel_controlD0",
+			UverbsPath:  "/dev/infiniband/uverbs0",
+			Hlib:        "hlib_0",
+			NetDevs: []NetDev{
+				{Name: "eth0", Address: "b0:fd:0b:d8:33:01", Port: 21},
+				{Name: "eth1", Address: "b0:fd:0b:d8:33:02", Port: 22},
+			},
+		},
+		{
+			Index:       1,
+			PCIAddress:  "0000:9a:00.0",
+			ModuleID:    "3",
+			Serial:      "AN00012399",
+			Type:        "gaudi2",
+			Firmware:    "hl-gaudi2-1.17.0-fw-51.2.0-sec-9",
+			NUMANode:    1,
+			AccelPath:   "/dev/accel/accel1",
+			ControlPath: "/dev/accel/accel_controlD1",
+			UverbsPath:  "/dev/infiniband/uverbs1",
+			Hlib:        "hlib_1",
+		},
+	}
+	if !reflect.DeepEqual(accelerators, want) {
+		t.Errorf("got  %+v\nwant %+v", accelerators, want)
+	}
+
+	info, err := r.DeviceInfo("/dev/accel/accel_controlD1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Path != "/dev/accel/accel_controlD1" || info.Major != 510 || info.Minor != 3 {
+		t.Errorf("got device info %+v", info)
+	}
+
+	if _, err := r.DeviceInfo("/dev/accel/accel7"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v, want %v", err, fs.ErrNotExist)
+	}
+
+	if cpus, err := r.NodeCPUs(1); err != nil || cpus != "40-79,120-159" {
+		t.Errorf("got node cpus %q, %v", cpus, err)
+	}
+
+	if version, err := r.DriverVersion(); err != nil || version != "1.17.0-a4e6b6c" {
+		t.Errorf("got driver version %q, %v", version, err)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	src, err := NewRoot("testdata/hls2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := Capture(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := NewRoot(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := src.Accelerators()
+	got, err := replay.Accelerators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+
+	for _, acc := range want {
+		for _, p := range append(acc.DevicePaths(), acc.UverbsPath) {
+			wantInfo, _ := src.DeviceInfo(p)
+			gotInfo, err := replay.DeviceInfo(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotInfo, wantInfo) {
+				t.Errorf("%s: got %+v, want %+v", p, gotInfo, wantInfo)
+			}
+		}
+	}
+
+	if cpus, err := replay.NodeCPUs(0); err != nil || cpus != "0-39,80-119" {
+		t.Errorf("got node cpus %q, %v", cpus, err)
+	}
+	if version, err := replay.DriverVersion(); err != nil || version != "1.17.0-a4e6b6c" {
+		t.Errorf("got driver version %q, %v", version, err)
+	}
+}
+
+func TestNewRootHost(t *testing.T) {
+	for _, dir := range []string{"", "/"} {
+		r, err := NewRoot(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != HostRoot {
+			t.Errorf("NewRoot(%q) is not the host root", dir)
+		}
+	}
+	if got := HostRoot.Join("/sys/class/accel"); got != "/sys/class/accel" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	fixture, err := NewRoot("testdata/hls2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fixture.Glob("/dev/accel/accel_controlD*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/dev/accel/accel_controlD0", "/dev/accel/accel_controlD1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := fixture.Glob("/dev/[accel"); err == nil {
+		t.Error("got no error for a malformed pattern")
+	}
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"dev/infiniband/rdma_cm": "", "dev/infiniband/uverbs0": ""})
+	r, err := NewRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = r.Glob("/dev/infiniband/rdma_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/dev/infiniband/rdma_cm"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -3,7 +3,6 @@ module github.com/HabanaAI/habana-container-runtime
 go 1.21
 
 require (
-	github.com/BurntSushi/toml v1.3.2
 	github.com/cilium/ebpf v0.12.3
 	github.com/containernetworking/plugins v1.4.0
 	github.com/google/uuid v1.5.0
@@ -11,11 +10,13 @@ require (
 	github.com/sirupsen/logrus v1.9.3
 	github.com/urfave/cli/v2 v2.27.1
 	github.com/vishvananda/netlink v1.2.1-beta.2
-	golang.org/x/exp v0.0.0-20240112132812-db7319d0e0e3
 	golang.org/x/mod v0.14.0
 	golang.org/x/sys v0.15.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
+require golang.org/x/exp v0.0.0-20240112132812-db7319d0e0e3 // indirect
+
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
 	github.com/pelletier/go-toml/v2 v2.1.1
@@ -0,0 +1,295 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package lease records on the host which containers hold which devices, so
+// a device is not given to two containers at once, or is shared by a bounded
+// number of containers.
+//
+// The leases are stored in a single file, and every change is made under an
+// exclusive lock of the registry directory, so concurrent runtime processes see
+// a consistent state.
+package lease
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/HabanaAI/habana-container-runtime/atomicfile"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultDir is the default registry directory.
+	DefaultDir = "/run/habana-container-runtime"
+	// DefaultRuncRoot is the default runc state directory.
+	DefaultRuncRoot = "/run/runc"
+
+	leasesFile = "leases.json"
+	lockFile   = "leases.lock"
+
+	// Leases are not reclaimed right after being taken, as runc creates the
+	// container state after the runtime took them.
+	staleAfter = time.Minute
+)
+
+// Lease is a device held by a container.
+type Lease struct {
+	Device    string `json:"device"`
+	Container string `json:"container"`
+	// runc state directory of the container, used to find stale leases.
+	RuncRoot string    `json:"runcRoot,omitempty"`
+	Created  time.Time `json:"created"`
+	// Whether the device cannot be shared with other containers.
+	Exclusive bool `json:"exclusive"`
+}
+
+// Claim is a request for the leases of devices.
+type Claim struct {
+	Container string
+	RuncRoot  string
+	Devices   []string
+	// Whether the devices cannot be shared with other containers.
+	Exclusive bool
+	// Maximum number of containers sharing a device, for shareable claims.
+	MaxSharers int
+}
+
+// HeldError is returned when a requested device is held by other containers.
+type HeldError struct {
+	Device  string
+	Holders []string
+	// Set when the device is shared by the maximum number of containers.
+	MaxSharers int
+}
+
+func (e *HeldError) Error() string {
+	if e.MaxSharers != 0 {
+		return fmt.Sprintf("device %s is shared by the maximum of %d containers: %s", e.Device, e.MaxSharers, strings.Join(e.Holders, ", "))
+	}
+	return fmt.Sprintf("device %s is held by container %s", e.Device, strings.Join(e.Holders, ", "))
+}
+
+// Registry is the leases registry of the host.
+type Registry struct {
+	dir string
+	now func() time.Time
+	// containerExists reports whether the owner of the lease still exists.
+	containerExists func(l Lease) bool
+}
+
+// NewRegistry returns the registry stored in dir, created on first use.
+func NewRegistry(dir string) *Registry {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Registry{dir: dir, now: time.Now, containerExists: runcContainerExists}
+}
+
+// runcContainerExists checks the runc state directory of the container.
+func runcContainerExists(l Lease) bool {
+	root := l.RuncRoot
+	if root == "" {
+		root = DefaultRuncRoot
+	}
+	_, err := os.Stat(filepath.Join(root, l.Container))
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// Acquire takes the leases of the claimed devices, all of them or none. Stale
+// leases are reclaimed first. A *HeldError is returned when a device is held
+// exclusively by another container, when the claim is exclusive and the device
+// is held, or when the device is shared by the maximum number of containers.
+// Devices already held by the container are kept.
+func (r *Registry) Acquire(c Claim) error {
+	return r.update(func(leases []Lease) ([]Lease, error) {
+		for _, d := range c.Devices {
+			if err := c.check(d, leases); err != nil {
+				return nil, err
+			}
+		}
+		for _, d := range c.Devices {
+			if slices.ContainsFunc(leases, func(l Lease) bool { return l.Device == d && l.Container == c.Container }) {
+				continue
+			}
+			leases = append(leases, Lease{
+				Device:    d,
+				Container: c.Container,
+				RuncRoot:  c.RuncRoot,
+				Created:   r.now(),
+				Exclusive: c.Exclusive,
+			})
+		}
+		return leases, nil
+	})
+}
+
+// check returns a *HeldError when the device cannot be leased by the claim.
+func (c *Claim) check(device string, leases []Lease) error {
+	var holders []string
+	exclusive := c.Exclusive
+	for _, l := range leases {
+		if l.Device != device || l.Container == c.Container {
+			continue
+		}
+		holders = append(holders, l.Container)
+		exclusive = exclusive || l.Exclusive
+	}
+	switch {
+	case len(holders) == 0:
+		return nil
+	case exclusive:
+		return &HeldError{Device: device, Holders: holders}
+	case len(holders) >= c.MaxSharers:
+		return &HeldError{Device: device, Holders: holders, MaxSharers: c.MaxSharers}
+	}
+	return nil
+}
+
+// Check returns the error Acquire would return for the claim, without taking
+// the leases.
+func (r *Registry) Check(c Claim) error {
+	leases, err := r.view()
+	if err != nil {
+		return err
+	}
+	for _, d := range c.Devices {
+		if err := c.check(d, leases); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Available returns the claimed devices which can be leased by the claim now.
+func (r *Registry) Available(c Claim) ([]string, error) {
+	leases, err := r.view()
+	if err != nil {
+		return nil, err
+	}
+	var available []string
+	for _, d := range c.Devices {
+		if c.check(d, leases) == nil {
+			available = append(available, d)
+		}
+	}
+	return available, nil
+}
+
+// Release drops the leases of the container.
+func (r *Registry) Release(container string) error {
+	return r.update(func(leases []Lease) ([]Lease, error) {
+		return slices.DeleteFunc(leases, func(l Lease) bool { return l.Container == container }), nil
+	})
+}
+
+// List returns the current leases, without the stale ones.
+func (r *Registry) List() ([]Lease, error) {
+	return r.view()
+}
+
+// view returns the current leases, without the stale ones, and without
+// writing to the registry. The lock file is created with the first lease, so
+// without it the registry is empty.
+func (r *Registry) view() ([]Lease, error) {
+	lock, err := os.Open(filepath.Join(r.dir, lockFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening leases lock: %w", err)
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_SH); err != nil {
+		return nil, fmt.Errorf("locking leases: %w", err)
+	}
+
+	leases, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(leases, r.isStale), nil
+}
+
+// update applies fn to the leases under the registry lock, after reclaiming
+// the stale ones, and saves its result.
+func (r *Registry) update(fn func([]Lease) ([]Lease, error)) error {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return fmt.Errorf("creating leases directory: %w", err)
+	}
+	lock, err := os.OpenFile(filepath.Join(r.dir, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("opening leases lock: %w", err)
+	}
+	// The lock is released when the file is closed.
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("locking leases: %w", err)
+	}
+
+	leases, err := r.load()
+	if err != nil {
+		return err
+	}
+	leases = slices.DeleteFunc(leases, r.isStale)
+
+	leases, err = fn(leases)
+	if err != nil {
+		return err
+	}
+	return r.save(leases)
+}
+
+func (r *Registry) isStale(l Lease) bool {
+	return r.now().Sub(l.Created) > staleAfter && !r.containerExists(l)
+}
+
+func (r *Registry) load() ([]Lease, error) {
+	content, err := os.ReadFile(filepath.Join(r.dir, leasesFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading leases: %w", err)
+	}
+	var leases []Lease
+	if err := json.Unmarshal(content, &leases); err != nil {
+		return nil, fmt.Errorf("decoding leases: %w", err)
+	}
+	return leases, nil
+}
+
+// save writes the leases to a temporary file renamed over the previous one,
+// so the file is never seen half written.
+func (r *Registry) save(leases []Lease) error {
+	if leases == nil {
+		leases = []Lease{}
+	}
+	content, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding leases: %w", err)
+	}
+	if err := atomicfile.WriteFile(filepath.Join(r.dir, leasesFile), content, 0600); err != nil {
+		return fmt.Errorf("writing leases: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package lease
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func holders(t *testing.T, r *Registry) map[string]string {
+	t.Helper()
+	leases, err := r.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string)
+	for _, l := range leases {
+		m[l.Device] = l.Container
+	}
+	return m
+}
+
+func TestAcquireRelease(t *testing.T) {
+	r := NewRegistry(t.TempDir())
+
+	if err := r.Acquire(Claim{Container: "a", Devices: []string{"0", "1"}, Exclusive: true}); err != nil {
+		t.Fatal(err)
+	}
+	// Taking the same devices again is allowed for the holder.
+	if err := r.Acquire(Claim{Container: "a", Devices: []string{"1"}, Exclusive: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	var held *HeldError
+	if err := r.Check(Claim{Container: "b", Devices: []string{"1"}, Exclusive: true}); !errors.As(err, &held) {
+		t.Fatalf("got error %v, want device 1 held by a", err)
+	}
+	if err := r.Check(Claim{Container: "b", Devices: []string{"2"}, Exclusive: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := r.Acquire(Claim{Container: "b", Devices: []string{"2", "1"}, Exclusive: true})
+	if !errors.As(err, &held) || held.Device != "1" || !reflect.DeepEqual(held.Holders, []string{"a"}) {
+		t.Fatalf("got error %v, want device 1 held by a", err)
+	}
+	if got := holders(t, r); len(got) != 2 || got["2"] != "" {
+		t.Errorf("got leases %v, want only the ones of a", got)
+	}
+
+	if err := r.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Acquire(Claim{Container: "b", Devices: []string{"2", "1"}, Exclusive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := holders(t, r); got["1"] != "b" || got["2"] != "b" || len(got) != 2 {
+		t.Errorf("got leases %v, want 1 and 2 held by b", got)
+	}
+}
+
+func TestSharedLeases(t *testing.T) {
+	r := NewRegistry(t.TempDir())
+	shared := func(container string, devices ...string) error {
+		return r.Acquire(Claim{Container: container, Devices: devices, MaxSharers: 2})
+	}
+
+	if err := shared("a", "0", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := shared("b", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var held *HeldError
+	if err := shared("c", "1", "0"); !errors.As(err, &held) || held.Device != "0" || held.MaxSharers != 2 {
+		t.Fatalf("got error %v, want device 0 shared by the maximum of containers", err)
+	}
+	if err := r.Acquire(Claim{Container: "c", Devices: []string{"1"}, Exclusive: true}); !errors.As(err, &held) || held.MaxSharers != 0 {
+		t.Fatalf("got error %v, want device 1 held by a", err)
+	}
+	if err := r.Acquire(Claim{Container: "c", Devices: []string{"2"}, Exclusive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := shared("d", "2"); !errors.As(err, &held) || !reflect.DeepEqual(held.Holders, []string{"c"}) {
+		t.Fatalf("got error %v, want device 2 held by c", err)
+	}
+	if err := shared("d", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	available, err := r.Available(Claim{Container: "e", Devices: []string{"0", "1", "2", "3"}, MaxSharers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"3"}; !reflect.DeepEqual(available, want) {
+		t.Errorf("got available %v, want %v", available, want)
+	}
+}
+
+func TestViewWithoutRegistry(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "leases")
+	r := NewRegistry(dir)
+	if leases, err := r.List(); err != nil || len(leases) != 0 {
+		t.Fatalf("got leases %v, error %v, want none", leases, err)
+	}
+	if err := r.Check(Claim{Container: "a", Devices: []string{"0"}, Exclusive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); err == nil {
+		t.Error("registry created by a read")
+	}
+
+	// Nor are the files of an existing directory.
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Available(Claim{Container: "a", Devices: []string{"0"}, MaxSharers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("got entries %v, error %v, want the directory left empty", entries, err)
+	}
+
+	// The lock is taken on a read-only file.
+	if err := r.Acquire(Claim{Container: "a", Devices: []string{"0"}, Exclusive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, lockFile), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if leases, err := r.List(); err != nil || len(leases) != 1 {
+		t.Errorf("got leases %v, error %v, want the one acquired", leases, err)
+	}
+}
+
+func TestStaleLeases(t *testing.T) {
+	runcRoot := t.TempDir()
+	if err := os.Mkdir(filepath.Join(runcRoot, "alive"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRegistry(t.TempDir())
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	if err := r.Acquire(Claim{Container: "alive", RuncRoot: runcRoot, Devices: []string{"0"}, Exclusive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Acquire(Claim{Container: "gone", RuncRoot: runcRoot, Devices: []string{"1"}, Exclusive: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recent leases are kept, runc did not create the container yet.
+	if err := r.Acquire(Claim{Container: "new", RuncRoot: runcRoot, Devices: []string{"1"}, Exclusive: true}); err == nil {
+		t.Fatal("got no error for a recent lease")
+	}
+
+	now = now.Add(2 * staleAfter)
+	if err := r.Acquire(Claim{Container: "new", RuncRoot: runcRoot, Devices: []string{"1"}, Exclusive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Acquire(Claim{Container: "new", RuncRoot: runcRoot, Devices: []string{"0"}, Exclusive: true}); err == nil {
+		t.Fatal("got no error for the lease of an existing container")
+	}
+}
+
+func TestConcurrentAcquire(t *testing.T) {
+	dir := t.TempDir()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- NewRegistry(dir).Acquire(Claim{Container: fmt.Sprint(i), Devices: []string{"0"}, Exclusive: true})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	acquired := 0
+	for err := range errs {
+		if err == nil {
+			acquired++
+		}
+	}
+	if acquired != 1 {
+		t.Errorf("device acquired %d times, want once", acquired)
+	}
+}
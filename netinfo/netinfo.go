@@ -24,12 +24,10 @@ import (
 	"log/slog"
 	"os"
 	"path"
-	"strconv"
 	"strings"
-)
 
-// osReadFile is overwritten in tests.
-var osReadFile = os.ReadFile
+	"github.com/HabanaAI/habana-container-runtime/discover"
+)
 
 // hlsNumInterfaceByType hold the known number of network ports (internal+external)
 // for each Gaudi device we have
@@ -42,6 +40,12 @@ var hlsNumInterfaceByType = map[string]int{
 	"gaudi3":  24,
 }
 
+// Paths of the files written in the container rootfs.
+const (
+	MACAddrInfoPath = "/etc/habanalabs/macAddrInfo.json"
+	GaudinetPath    = "/etc/habanalabs/gaudinet.json"
+)
+
 type MACInfo struct {
 	PCI_ID        string
 	MAC_ADDR_LIST []string
@@ -52,9 +56,9 @@ type NetJSON struct {
 }
 
 // Generates creates the mac address information for the requested accelerator devices.
-func Generate(devicesIDs []string, containerRootFS string) error {
-	basePath := path.Join(containerRootFS, "/etc/habanalabs/")
-	netFilePath := path.Join(basePath, "macAddrInfo.json")
+func Generate(accelerators []discover.Accelerator, containerRootFS string) error {
+	netFilePath := path.Join(containerRootFS, MACAddrInfoPath)
+	basePath := path.Dir(netFilePath)
 
 	if _, err := os.Stat(basePath); os.IsNotExist(err) {
 		if err := os.Mkdir(basePath, 0750); err != nil {
@@ -62,7 +66,7 @@ func Generate(devicesIDs []string, containerRootFS string) error {
 		}
 	}
 
-	netData, err := netConfig(devicesIDs)
+	netData, err := netConfig(accelerators)
 	if err != nil {
 		return err
 	}
@@ -86,7 +90,7 @@ func Generate(devicesIDs []string, containerRootFS string) error {
 
 func GaudinetFile(logger *slog.Logger, containerRootFS, source string) error {
 	// Destination inside the container file system.
-	destFile := path.Join(containerRootFS, "etc", "habanalabs", "gaudinet.json")
+	destFile := path.Join(containerRootFS, GaudinetPath)
 
 	info, err := os.Stat(source)
 	if err != nil {
@@ -126,131 +130,50 @@ func GaudinetFile(logger *slog.Logger, containerRootFS, source string) error {
 	return nil
 }
 
-func netConfig(devices []string) (string, error) {
-	if len(devices) == 0 {
+func netConfig(accelerators []discover.Accelerator) (string, error) {
+	if len(accelerators) == 0 {
 		return "", nil
 	}
 
-	deviceType, err := deviceType(devices[0])
-	if err != nil {
-		return "", fmt.Errorf("netConfig: %w", err)
-	}
-
-	devicesPCI, err := devicesPCIAddresses(devices)
-	if err != nil {
-		return "", err
+	deviceType := accelerators[0].Type
+	if deviceType == "" {
+		return "", fmt.Errorf("netConfig: deviceType info not found")
 	}
 
-	netInfo, err := devicesMACAddress(devicesPCI, deviceType)
-	if err != nil {
-		return "", err
-	}
+	netInfo := devicesMACAddress(accelerators, deviceType)
 
 	jsondat := &NetJSON{MAC_ADDR_INFO: netInfo}
 	encjson, _ := json.MarshalIndent(jsondat, "", "    ")
 	return string(encjson), nil
 }
 
-func deviceType(deviceID string) (string, error) {
-	content, err := osReadFile(fmt.Sprintf("/sys/class/accel/accel%s/device/device_type", deviceID))
-	if err != nil {
-		return "", fmt.Errorf("deviceType: %w", err)
-	}
-
-	data := strings.TrimSpace(string(content))
-
-	parts := strings.Fields(data)
-	if len(parts) == 0 {
-		return "", fmt.Errorf("deviceType info not found")
-	}
-
-	return strings.ToLower(parts[0]), nil
-}
-
-// returns a map of requested Habana devices in the form of map[hlID]pciAddress
-func devicesPCIAddresses(devices []string) (map[string]string, error) {
-	pciInfo := make(map[string]string)
-
-	for _, devID := range devices {
-		devName := "accel" + devID
-		content, err := osReadFile(path.Clean(path.Join("/sys/class/accel", devName, "device", "pci_addr")))
-		if err != nil {
-			return nil, err
-		}
-		pciAddr := strings.TrimSpace(string(content))
-		pciInfo[devID] = pciAddr
-	}
-
-	return pciInfo, nil
-}
-
-func devicesMACAddress(pciDevices map[string]string, devType string) ([]MACInfo, error) {
+func devicesMACAddress(accelerators []discover.Accelerator, devType string) []MACInfo {
 	var devInfo []MACInfo
 
-	// Collect external ports mac addresses
-	extPorts, err := extPortsMACAddress(pciDevices)
-	if err != nil {
-		return devInfo, err
-	}
-
 	// Fill MAC addresses data based on port type external or internal
-	for hlID, pciID := range pciDevices {
-		var macAddressList []string
+	for _, acc := range accelerators {
+		// External ports mac addresses by device port
+		extPorts := make(map[int]string)
+		for _, netDev := range acc.NetDevs {
+			extPorts[netDev.Port] = netDev.Address
+		}
 
+		var macAddressList []string
 		for i := 0; i < hlsNumInterfaceByType[devType]; i++ {
 			// If the port is recognized as external, we add the readl mac addresss,
 			// otherwise, we add a broadcast mac address for each internal port
-			if _, exists := extPorts[hlID][i]; exists {
-				macAddressList = append(macAddressList, extPorts[hlID][i])
+			if mac, exists := extPorts[i]; exists {
+				macAddressList = append(macAddressList, mac)
 			} else {
 				macAddressList = append(macAddressList, "ff:ff:ff:ff:ff:ff")
 			}
 		}
 
 		devInfo = append(devInfo, MACInfo{
-			PCI_ID:        pciID,
+			PCI_ID:        acc.PCIAddress,
 			MAC_ADDR_LIST: macAddressList,
 		})
 	}
 
-	return devInfo, nil
-}
-
-// getExtPorts receives Habana list of devices, and returns their MacAddress and device port
-// of their external interfaces. Returns map[hlID]map[devPort]PciAddr
-func extPortsMACAddress(pciDevices map[string]string) (map[string]map[int]string, error) {
-	extInfo := make(map[string]map[int]string)
-
-	for hlID, pci := range pciDevices {
-		netPath := fmt.Sprintf("%s/%s/net", "/sys/bus/pci/devices", pci)
-
-		ifaces, err := os.ReadDir(netPath)
-		if err != nil {
-			return nil, err
-		}
-
-		netinfo := make(map[int]string)
-		for _, inet := range ifaces {
-			// Get MAC Address
-			mac, err := os.ReadFile(path.Clean(path.Join(netPath, inet.Name(), "address")))
-			if err != nil {
-				return nil, err
-			}
-
-			// Get dev port
-			devPort, err := os.ReadFile(path.Clean(path.Join(netPath, inet.Name(), "dev_port")))
-			if err != nil {
-				return nil, err
-			}
-			devPortInt, err := strconv.Atoi(strings.TrimSpace(string(devPort)))
-			if err != nil {
-				return nil, err
-			}
-			macAddr := strings.TrimSpace(string(mac))
-			netinfo[devPortInt] = macAddr
-		}
-		extInfo[hlID] = netinfo
-
-	}
-	return extInfo, nil
+	return devInfo
 }
@@ -16,82 +16,63 @@
 package netinfo
 
 import (
-	"errors"
+	"encoding/json"
 	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/discover"
 )
 
-func TestDeviceType(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    string
-		rfFunc   func(name string) ([]byte, error)
-		want     string
-		expError bool
-	}{
+func TestNetConfig(t *testing.T) {
+	accelerators := []discover.Accelerator{
 		{
-			name:  "happy path",
-			input: "0",
-			rfFunc: func(name string) ([]byte, error) {
-				return []byte("GAUDI2"), nil
+			Index:      0,
+			PCIAddress: "0000:4d:00.0",
+			Type:       "gaudi2",
+			NetDevs: []discover.NetDev{
+				{Name: "eth0", Address: "b0:fd:0b:00:00:01", Port: 1},
+				{Name: "eth1", Address: "b0:fd:0b:00:00:08", Port: 8},
 			},
-			want:     "gaudi2",
-			expError: false,
 		},
 		{
-			name:  "file contains new line",
-			input: "0",
-			rfFunc: func(name string) ([]byte, error) {
-				return []byte("GAUDI2\n"), nil
-			},
-			want:     "gaudi2",
-			expError: false,
-		},
-		{
-			name:  "file contains new line and space char",
-			input: "0",
-			rfFunc: func(name string) ([]byte, error) {
-				return []byte(" GAUDI2\t\n"), nil
-			},
-			want:     "gaudi2",
-			expError: false,
-		},
-		{
-			name:  "empty file returns an error",
-			input: "0",
-			rfFunc: func(name string) ([]byte, error) {
-				return []byte(""), nil
-			},
-			want:     "",
-			expError: true,
-		},
-		{
-			name:  "failed to open file",
-			input: "0",
-			rfFunc: func(name string) ([]byte, error) {
-				return nil, errors.New("foo")
-			},
-			want:     "",
-			expError: true,
+			Index:      1,
+			PCIAddress: "0000:b3:00.0",
+			Type:       "gaudi2",
 		},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			osReadFile = tt.rfFunc
+	got, err := netConfig(accelerators)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-			got, err := deviceType(tt.input)
-			if tt.expError && err == nil {
-				t.Fatal("expected and error, got none")
-			}
-			if !tt.expError && err != nil {
-				t.Fatalf("expected no error, got: %v", err)
-			}
-			if got != tt.want {
-				t.Errorf("got %q, want %q", got, tt.want)
-			}
-		})
+	var data NetJSON
+	if err := json.Unmarshal([]byte(got), &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.MAC_ADDR_INFO) != 2 {
+		t.Fatalf("got %d devices, want 2", len(data.MAC_ADDR_INFO))
+	}
+
+	first := data.MAC_ADDR_INFO[0]
+	if first.PCI_ID != "0000:4d:00.0" || len(first.MAC_ADDR_LIST) != 24 {
+		t.Errorf("unexpected device info %+v", first)
+	}
+	for i, mac := range first.MAC_ADDR_LIST {
+		want := "ff:ff:ff:ff:ff:ff"
+		switch i {
+		case 1:
+			want = "b0:fd:0b:00:00:01"
+		case 8:
+			want = "b0:fd:0b:00:00:08"
+		}
+		if mac != want {
+			t.Errorf("port %d: got %q, want %q", i, mac, want)
+		}
 	}
-}
 
-func TestExpPortsMACAddresses(t *testing.T) {
+	t.Run("unknown device type returns an error", func(t *testing.T) {
+		if _, err := netConfig([]discover.Accelerator{{Index: 0}}); err == nil {
+			t.Error("expected an error, got none")
+		}
+	})
 }
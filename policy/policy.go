@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package policy admits the devices requested by containers, with rules
+// matching the container user, image and Kubernetes namespace.
+//
+// Rules are evaluated in order, and the first matching rule applies. A rule
+// without matchers matches all the containers, so it can be used last as the
+// default. Containers no rule matches are not restricted.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/discover"
+	"github.com/HabanaAI/habana-container-runtime/selector"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// ErrDenied is returned when a rule does not allow any of the requested devices.
+var ErrDenied = errors.New("devices request denied")
+
+// Annotations holding the image name, by container engine.
+var imageAnnotations = []string{
+	"io.kubernetes.cri.image-name",      // containerd
+	"io.kubernetes.cri-o.ImageName",     // CRI-O
+	"org.opencontainers.image.ref.name", // OCI image layout
+}
+
+// Annotations holding the Kubernetes namespace, by container engine.
+var namespaceAnnotations = []string{
+	"io.kubernetes.cri.sandbox-namespace", // containerd
+	"io.kubernetes.pod.namespace",         // CRI-O
+}
+
+// Rule is a [[policy]] rule of the runtime config.
+type Rule struct {
+	Name string `toml:"name"`
+
+	// Matchers. A container matches when it matches all the set matchers.
+	// Images and namespaces are path.Match patterns, i.e "vault.habana.ai/*".
+	UIDs       []uint32 `toml:"uids"`
+	GIDs       []uint32 `toml:"gids"`
+	Images     []string `toml:"images"`
+	Namespaces []string `toml:"namespaces"`
+
+	// Devices allowed, in the HABANA_VISIBLE_DEVICES format. Empty allows all
+	// of them, and "none" denies all the requests.
+	Devices string `toml:"devices"`
+	// Maximum number of devices. Zero is unlimited.
+	MaxDevices int `toml:"max_devices"`
+	// Whether the uverbs devices and the network information are exposed.
+	// Both default to true.
+	AllowUverbs  *bool `toml:"allow_uverbs"`
+	AllowNetwork *bool `toml:"allow_network"`
+}
+
+// Container holds the parts of the container spec rules match.
+type Container struct {
+	UID       uint32
+	GIDs      []uint32
+	Image     string
+	Namespace string
+}
+
+// ContainerFromSpec returns the container of the spec.
+func ContainerFromSpec(spec *specs.Spec) Container {
+	var c Container
+	if spec.Process != nil {
+		c.UID = spec.Process.User.UID
+		c.GIDs = append([]uint32{spec.Process.User.GID}, spec.Process.User.AdditionalGids...)
+	}
+	c.Image = firstAnnotation(spec.Annotations, imageAnnotations)
+	c.Namespace = firstAnnotation(spec.Annotations, namespaceAnnotations)
+	return c
+}
+
+func firstAnnotation(annotations map[string]string, keys []string) string {
+	for _, k := range keys {
+		if v, ok := annotations[k]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// Match returns the first rule matching the container, or nil.
+func Match(rules []Rule, c Container) *Rule {
+	for i := range rules {
+		if rules[i].matches(c) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func (r *Rule) matches(c Container) bool {
+	if len(r.UIDs) != 0 && !slices.Contains(r.UIDs, c.UID) {
+		return false
+	}
+	if len(r.GIDs) != 0 && !slices.ContainsFunc(c.GIDs, func(gid uint32) bool { return slices.Contains(r.GIDs, gid) }) {
+		return false
+	}
+	if len(r.Images) != 0 && !matchesAny(r.Images, c.Image) {
+		return false
+	}
+	if len(r.Namespaces) != 0 && !matchesAny(r.Namespaces, c.Namespace) {
+		return false
+	}
+	return true
+}
+
+func matchesAny(patterns []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the rule devices selector and maximum count.
+func (r *Rule) Validate() error {
+	if r.Devices != "" {
+		sel, err := selector.Parse(r.Devices)
+		if err != nil {
+			return fmt.Errorf("policy %q: %w", r.Name, err)
+		}
+		if sel.Count() != 0 {
+			return fmt.Errorf("policy %q: devices cannot be a count", r.Name)
+		}
+	}
+	if r.MaxDevices < 0 {
+		return fmt.Errorf("policy %q: negative max_devices", r.Name)
+	}
+	return nil
+}
+
+// Decision is the outcome of a rule for a devices request.
+type Decision struct {
+	// Devices admitted, in the requested order.
+	Devices []discover.Accelerator
+	Uverbs  bool
+	Network bool
+	// Why the request was trimmed. Empty when all the devices were admitted.
+	Reason string
+}
+
+// Allow returns the decision admitting all the requested devices, the one of
+// the containers no rule matches.
+func Allow(requested []discover.Accelerator) *Decision {
+	return &Decision{Devices: requested, Uverbs: true, Network: true}
+}
+
+// Admit applies the rule to the requested devices. Devices the rule does not
+// allow are trimmed, and so are the devices over the maximum count. The rule
+// devices missing on the node are ignored. ErrDenied is returned when no
+// device is left.
+func (r *Rule) Admit(requested []discover.Accelerator) (*Decision, error) {
+	d := Allow(requested)
+	if r.AllowUverbs != nil {
+		d.Uverbs = *r.AllowUverbs
+	}
+	if r.AllowNetwork != nil {
+		d.Network = *r.AllowNetwork
+	}
+
+	var reasons []string
+	if r.Devices != "" {
+		sel, err := selector.Parse(r.Devices)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", r.Name, err)
+		}
+		var admitted, trimmed []discover.Accelerator
+		for _, acc := range d.Devices {
+			if sel.Matches(acc) {
+				admitted = append(admitted, acc)
+			} else {
+				trimmed = append(trimmed, acc)
+			}
+		}
+		if len(trimmed) != 0 {
+			reasons = append(reasons, fmt.Sprintf("devices %s not allowed", strings.Join(discover.IDs(trimmed), ",")))
+		}
+		d.Devices = admitted
+	}
+
+	if r.MaxDevices > 0 && len(d.Devices) > r.MaxDevices {
+		reasons = append(reasons, fmt.Sprintf("devices %s over the maximum of %d", strings.Join(discover.IDs(d.Devices[r.MaxDevices:]), ","), r.MaxDevices))
+		d.Devices = d.Devices[:r.MaxDevices]
+	}
+
+	if len(reasons) != 0 {
+		d.Reason = fmt.Sprintf("policy %q: %s", r.Name, strings.Join(reasons, ", "))
+	}
+	if len(d.Devices) == 0 && len(requested) != 0 {
+		return nil, fmt.Errorf("%w by policy %q: %s", ErrDenied, r.Name, strings.Join(reasons, ", "))
+	}
+	return d, nil
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package policy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/discover"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func testAccelerators(indexes ...int) []discover.Accelerator {
+	var accelerators []discover.Accelerator
+	for _, i := range indexes {
+		accelerators = append(accelerators, discover.Accelerator{Index: i})
+	}
+	return accelerators
+}
+
+func TestContainerFromSpec(t *testing.T) {
+	spec := &specs.Spec{
+		Process: &specs.Process{User: specs.User{UID: 1000, GID: 100, AdditionalGids: []uint32{10}}},
+		Annotations: map[string]string{
+			"io.kubernetes.cri.image-name":        "vault.habana.ai/gaudi-docker/pytorch:latest",
+			"io.kubernetes.cri.sandbox-namespace": "team-a",
+		},
+	}
+	want := Container{UID: 1000, GIDs: []uint32{100, 10}, Image: "vault.habana.ai/gaudi-docker/pytorch:latest", Namespace: "team-a"}
+	if got := ContainerFromSpec(spec); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	rules := []Rule{
+		{Name: "uid", UIDs: []uint32{1000}},
+		{Name: "gid", GIDs: []uint32{200}},
+		{Name: "image and namespace", Images: []string{"vault.habana.ai/*"}, Namespaces: []string{"team-*"}},
+		{Name: "namespace", Namespaces: []string{"team-b"}},
+		{Name: "default"},
+	}
+
+	tests := []struct {
+		name string
+		c    Container
+		want string
+	}{
+		{name: "uid", c: Container{UID: 1000}, want: "uid"},
+		{name: "additional gid", c: Container{UID: 1, GIDs: []uint32{100, 200}}, want: "gid"},
+		{name: "image and namespace", c: Container{Image: "vault.habana.ai/pytorch", Namespace: "team-a"}, want: "image and namespace"},
+		{name: "image does not match", c: Container{Image: "docker.io/pytorch", Namespace: "team-b"}, want: "namespace"},
+		{name: "no annotations", c: Container{}, want: "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Match(rules, tt.c)
+			if got == nil || got.Name != tt.want {
+				t.Errorf("got %+v, want rule %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := Match(rules[:1], Container{UID: 1}); got != nil {
+		t.Errorf("got %+v, want no rule", got)
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	no := false
+
+	tests := []struct {
+		name       string
+		rule       *Rule
+		requested  []discover.Accelerator
+		want       []int
+		wantReason bool
+		wantUverbs bool
+		wantErr    error
+	}{
+		{
+			name:       "no rule",
+			requested:  testAccelerators(0, 1),
+			want:       []int{0, 1},
+			wantUverbs: true,
+		},
+		{
+			name:       "all allowed",
+			rule:       &Rule{Name: "r", Devices: "0-2"},
+			requested:  testAccelerators(2, 0),
+			want:       []int{2, 0},
+			wantUverbs: true,
+		},
+		{
+			name:       "trimmed by devices",
+			rule:       &Rule{Name: "r", Devices: "0,1"},
+			requested:  testAccelerators(0, 1, 2, 3),
+			want:       []int{0, 1},
+			wantReason: true,
+			wantUverbs: true,
+		},
+		{
+			name:       "trimmed by count",
+			rule:       &Rule{Name: "r", MaxDevices: 2, AllowUverbs: &no},
+			requested:  testAccelerators(3, 2, 1),
+			want:       []int{3, 2},
+			wantReason: true,
+		},
+		{
+			name:      "denied",
+			rule:      &Rule{Name: "r", Devices: "none"},
+			requested: testAccelerators(0),
+			wantErr:   ErrDenied,
+		},
+		{
+			name:      "devices missing on the node",
+			rule:      &Rule{Name: "r", Devices: "4-7"},
+			requested: testAccelerators(0),
+			wantErr:   ErrDenied,
+		},
+		{
+			name:       "some devices missing on the node",
+			rule:       &Rule{Name: "r", Devices: "0-7,-1"},
+			requested:  testAccelerators(0, 1, 3),
+			want:       []int{0, 3},
+			wantReason: true,
+			wantUverbs: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Containers no rule matches get the allow-all decision.
+			got, err := Allow(tt.requested), error(nil)
+			if tt.rule != nil {
+				got, err = tt.rule.Admit(tt.requested)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var indexes []int
+			for _, acc := range got.Devices {
+				indexes = append(indexes, acc.Index)
+			}
+			if !reflect.DeepEqual(indexes, tt.want) {
+				t.Errorf("got devices %v, want %v", indexes, tt.want)
+			}
+			if (got.Reason != "") != tt.wantReason {
+				t.Errorf("got reason %q, want reason %t", got.Reason, tt.wantReason)
+			}
+			if got.Uverbs != tt.wantUverbs || !got.Network {
+				t.Errorf("got uverbs=%t network=%t, want uverbs=%t network=true", got.Uverbs, got.Network, tt.wantUverbs)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, rule := range []Rule{
+		{Name: "devices", Devices: "a"},
+		{Name: "count", MaxDevices: -1},
+		{Name: "count selector", Devices: "count:2"},
+	} {
+		if err := rule.Validate(); err == nil {
+			t.Errorf("%s: got no error", rule.Name)
+		}
+	}
+	if err := (&Rule{Devices: "0-3,-2", MaxDevices: 2}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
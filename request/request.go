@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package request resolves the devices requested by a container from the
+// sources the runtime trusts. It is shared by the runtime and the hook, so
+// both give the same answer for the same container.
+package request
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/capability"
+	"github.com/HabanaAI/habana-container-runtime/require"
+)
+
+const (
+	// EnvVisibleDevices is the environment variable requesting devices.
+	EnvVisibleDevices = "HABANA_VISIBLE_DEVICES"
+	// AnnotationVisibleDevices is the spec annotation requesting devices, set
+	// by the device plugin or the container engine.
+	AnnotationVisibleDevices = "habana.ai/visible-devices"
+	// AnnotationAdmittedDevices is the spec annotation set by the runtime to
+	// the indices of the devices it admitted, forwarded by the hook instead of
+	// the request.
+	AnnotationAdmittedDevices = "habana.ai/admitted-devices"
+	// VolumeMountsRoot is the directory of the volume mounts requesting devices,
+	// i.e the device plugin mounts /var/run/habana-container-devices/0 for device 0.
+	VolumeMountsRoot = "/var/run/habana-container-devices"
+	// AnnotationDeviceSharing marks the container devices as SharingExclusive
+	// or SharingShared, when the runtime leases the devices in shared mode.
+	AnnotationDeviceSharing = "habana.ai/device-sharing"
+	SharingExclusive        = "exclusive"
+	SharingShared           = "shared"
+	// EnvDriverCapabilities is the environment variable selecting the classes
+	// of driver files injected with the devices, see package capability.
+	EnvDriverCapabilities = "HABANA_DRIVER_CAPABILITIES"
+	// AnnotationDriverCapabilities is the spec annotation selecting them.
+	AnnotationDriverCapabilities = "habana.ai/driver-capabilities"
+	// EnvRequirePrefix prefixes the environment variables declaring the
+	// requirements of the container on the node, i.e HABANA_REQUIRE_DRIVER=>=1.17,
+	// see package require.
+	EnvRequirePrefix = "HABANA_REQUIRE_"
+	// AnnotationRequirePrefix prefixes the spec annotations declaring them,
+	// i.e habana.ai/require-driver.
+	AnnotationRequirePrefix = "habana.ai/require-"
+	// EnvDisableRequire skips the requirements checks when true.
+	EnvDisableRequire = "HABANA_DISABLE_REQUIRE"
+
+	capSysAdmin = "CAP_SYS_ADMIN"
+)
+
+// ErrUnprivilegedEnvvar is returned when an unprivileged container requests
+// devices with HABANA_VISIBLE_DEVICES, and the config does not allow it.
+var ErrUnprivilegedEnvvar = errors.New("insufficient privileges to read device list from HABANA_VISIBLE_DEVICES envvar")
+
+// Source is where a device request comes from.
+type Source string
+
+const (
+	SourceAnnotation   Source = "annotation"
+	SourceVolumeMounts Source = "volume-mounts"
+	SourceEnvvar       Source = "envvar"
+)
+
+// Container holds the parts of the container spec devices are requested with.
+type Container struct {
+	Env         map[string]string
+	Annotations map[string]string
+	// Destinations of the container mounts.
+	Mounts []string
+	// Whether the container is privileged, see IsPrivileged.
+	Privileged bool
+}
+
+// Options are the trusted sources of device requests.
+type Options struct {
+	// Accept HABANA_VISIBLE_DEVICES. When false, only the annotation and the
+	// volume mounts are used, so users cannot override their allocation through
+	// the environment.
+	AcceptEnvvar bool
+	// Accept the devices requested as volume mounts under VolumeMountsRoot.
+	AcceptVolumeMounts bool
+	// Accept HABANA_VISIBLE_DEVICES for unprivileged containers.
+	AcceptEnvvarUnprivileged bool
+}
+
+// Request is a device request, in the HABANA_VISIBLE_DEVICES format.
+type Request struct {
+	Devices string
+	Source  Source
+}
+
+// Resolve returns the devices requested by the container, or nil when it does
+// not request any. The annotation takes precedence over the volume mounts, and
+// both take precedence over the environment variable. ErrUnprivilegedEnvvar is
+// returned when the environment variable is not allowed for the container.
+func Resolve(c Container, opts Options) (*Request, error) {
+	if devices, ok := c.Annotations[AnnotationVisibleDevices]; ok {
+		return &Request{Devices: devices, Source: SourceAnnotation}, nil
+	}
+
+	if opts.AcceptVolumeMounts {
+		if devices := volumeMountsDevices(c.Mounts); len(devices) != 0 {
+			return &Request{Devices: strings.Join(devices, ","), Source: SourceVolumeMounts}, nil
+		}
+	}
+
+	if devices, ok := c.Env[EnvVisibleDevices]; ok && opts.AcceptEnvvar {
+		if !c.Privileged && !opts.AcceptEnvvarUnprivileged {
+			return nil, ErrUnprivilegedEnvvar
+		}
+		return &Request{Devices: devices, Source: SourceEnvvar}, nil
+	}
+
+	return nil, nil
+}
+
+// DriverCapabilities returns the driver capabilities of the container, from the
+// annotation, or else from the environment variable when the options accept it,
+// or else capability.Default. The capabilities only restrict what is injected
+// with the devices, so the environment variable is accepted in unprivileged
+// containers.
+func DriverCapabilities(c Container, opts Options) (capability.Set, error) {
+	if value, ok := c.Annotations[AnnotationDriverCapabilities]; ok {
+		return capability.Parse(value)
+	}
+	if value, ok := c.Env[EnvDriverCapabilities]; ok && opts.AcceptEnvvar {
+		return capability.Parse(value)
+	}
+	return capability.Default, nil
+}
+
+// Requirements returns the requirements the container declares in its
+// environment and annotations, or none when EnvDisableRequire is true. They are
+// declared by the image, so the environment variables are always accepted.
+func Requirements(c Container) ([]require.Requirement, error) {
+	if disable, _ := strconv.ParseBool(c.Env[EnvDisableRequire]); disable {
+		return nil, nil
+	}
+
+	// The variables are split on the first equal sign, so
+	// HABANA_REQUIRE_DRIVER>=1.17 is a variable named HABANA_REQUIRE_DRIVER>.
+	decls := declarations(c.Env, EnvRequirePrefix)
+	decls = append(decls, declarations(c.Annotations, AnnotationRequirePrefix)...)
+
+	reqs := make([]require.Requirement, 0, len(decls))
+	for _, decl := range decls {
+		r, err := require.Parse(decl)
+		if err != nil {
+			return nil, fmt.Errorf("reading requirements: %w", err)
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+// declarations returns the sorted requirement declarations of the entries of
+// m with the prefix.
+func declarations(m map[string]string, prefix string) []string {
+	var decls []string
+	for k, v := range m {
+		if name, ok := strings.CutPrefix(k, prefix); ok {
+			decls = append(decls, name+"="+v)
+		}
+	}
+	sort.Strings(decls)
+	return decls
+}
+
+// IsPrivileged reports whether a container with the bounding capabilities set
+// is privileged, that is the set has CAP_SYS_ADMIN.
+func IsPrivileged(bounding []string) bool {
+	return slices.Contains(bounding, capSysAdmin)
+}
+
+// volumeMountsDevices returns the devices of the mounts under VolumeMountsRoot,
+// in the mounts order.
+func volumeMountsDevices(mounts []string) []string {
+	var devices []string
+	for _, m := range mounts {
+		device, ok := strings.CutPrefix(path.Clean(m), VolumeMountsRoot+"/")
+		if !ok || device == "" || strings.Contains(device, "/") {
+			continue
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// EnvMap converts a spec environment to a map. Variables without a value are
+// skipped, and the last value wins for duplicated variables.
+func EnvMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, ev := range env {
+		if k, v, found := strings.Cut(ev, "="); found {
+			m[k] = v
+		}
+	}
+	return m
+}
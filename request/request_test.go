@@ -0,0 +1,251 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package request
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/capability"
+)
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		annotations map[string]string
+		mounts      []string
+		privileged  bool
+		opts        Options
+		want        *Request
+		wantErr     error
+	}{
+		{
+			name: "nothing requested",
+			opts: Options{AcceptEnvvar: true},
+			want: nil,
+		},
+		{
+			name: "envvar",
+			env:  map[string]string{EnvVisibleDevices: "0,1"},
+			opts: Options{AcceptEnvvar: true, AcceptEnvvarUnprivileged: true},
+			want: &Request{Devices: "0,1", Source: SourceEnvvar},
+		},
+		{
+			name: "empty envvar is a request",
+			env:  map[string]string{EnvVisibleDevices: ""},
+			opts: Options{AcceptEnvvar: true, AcceptEnvvarUnprivileged: true},
+			want: &Request{Devices: "", Source: SourceEnvvar},
+		},
+		{
+			name:       "envvar in privileged container",
+			env:        map[string]string{EnvVisibleDevices: "0,1"},
+			privileged: true,
+			opts:       Options{AcceptEnvvar: true},
+			want:       &Request{Devices: "0,1", Source: SourceEnvvar},
+		},
+		{
+			name:    "envvar in unprivileged container",
+			env:     map[string]string{EnvVisibleDevices: "0,1"},
+			opts:    Options{AcceptEnvvar: true},
+			wantErr: ErrUnprivilegedEnvvar,
+		},
+		{
+			name:        "annotation in unprivileged container",
+			env:         map[string]string{EnvVisibleDevices: "0,1"},
+			annotations: map[string]string{AnnotationVisibleDevices: "2"},
+			opts:        Options{AcceptEnvvar: true},
+			want:        &Request{Devices: "2", Source: SourceAnnotation},
+		},
+		{
+			name: "envvar not accepted",
+			env:  map[string]string{EnvVisibleDevices: "0,1"},
+			want: nil,
+		},
+		{
+			name:        "annotation takes precedence",
+			env:         map[string]string{EnvVisibleDevices: "all"},
+			annotations: map[string]string{AnnotationVisibleDevices: "2"},
+			opts:        Options{AcceptEnvvar: true},
+			want:        &Request{Devices: "2", Source: SourceAnnotation},
+		},
+		{
+			name:   "volume mounts",
+			env:    map[string]string{EnvVisibleDevices: "all"},
+			mounts: []string{"/etc/hosts", VolumeMountsRoot + "/1", VolumeMountsRoot + "/0000:4d:00.0/", VolumeMountsRoot + "/a/b"},
+			opts:   Options{AcceptEnvvar: true, AcceptVolumeMounts: true},
+			want:   &Request{Devices: "1,0000:4d:00.0", Source: SourceVolumeMounts},
+		},
+		{
+			name:   "volume mounts not accepted",
+			env:    map[string]string{EnvVisibleDevices: "all"},
+			mounts: []string{VolumeMountsRoot + "/1"},
+			opts:   Options{AcceptEnvvar: true, AcceptEnvvarUnprivileged: true},
+			want:   &Request{Devices: "all", Source: SourceEnvvar},
+		},
+		{
+			name:        "annotation takes precedence over volume mounts",
+			annotations: map[string]string{AnnotationVisibleDevices: "2"},
+			mounts:      []string{VolumeMountsRoot + "/1"},
+			opts:        Options{AcceptVolumeMounts: true},
+			want:        &Request{Devices: "2", Source: SourceAnnotation},
+		},
+		{
+			name:        "annotation with envvar not accepted",
+			annotations: map[string]string{AnnotationVisibleDevices: "2"},
+			want:        &Request{Devices: "2", Source: SourceAnnotation},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Container{Env: tt.env, Annotations: tt.annotations, Mounts: tt.mounts, Privileged: tt.privileged}
+			got, err := Resolve(c, tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDriverCapabilities(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		annotations map[string]string
+		opts        Options
+		want        capability.Set
+		wantErr     bool
+	}{
+		{
+			name: "default",
+			opts: Options{AcceptEnvvar: true},
+			want: capability.Default,
+		},
+		{
+			name: "envvar",
+			env:  map[string]string{EnvDriverCapabilities: "control,utility"},
+			opts: Options{AcceptEnvvar: true},
+			want: capability.Control | capability.Utility,
+		},
+		{
+			name: "envvar not accepted",
+			env:  map[string]string{EnvDriverCapabilities: "control"},
+			want: capability.Default,
+		},
+		{
+			name:        "annotation over envvar",
+			env:         map[string]string{EnvDriverCapabilities: "control"},
+			annotations: map[string]string{AnnotationDriverCapabilities: "compute,rdma"},
+			opts:        Options{AcceptEnvvar: true},
+			want:        capability.Compute | capability.RDMA,
+		},
+		{
+			name:    "invalid",
+			env:     map[string]string{EnvDriverCapabilities: "graphics"},
+			opts:    Options{AcceptEnvvar: true},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DriverCapabilities(Container{Env: tt.env, Annotations: tt.annotations}, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequirements(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         []string
+		annotations map[string]string
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name: "none",
+			env:  []string{"HABANA_VISIBLE_DEVICES=all"},
+			want: []string{},
+		},
+		{
+			name: "envvars",
+			env:  []string{"HABANA_REQUIRE_DRIVER>=1.17", "HABANA_REQUIRE_DEVICE=gaudi3", "HABANA_REQUIRE_FIRMWARE=>=51"},
+			want: []string{"device=gaudi3", "driver>=1.17", "firmware>=51"},
+		},
+		{
+			name:        "annotations",
+			env:         []string{"HABANA_REQUIRE_DRIVER=>=1.17"},
+			annotations: map[string]string{"habana.ai/require-driver": "<1.20", "habana.ai/visible-devices": "0"},
+			want:        []string{"driver>=1.17", "driver<1.20"},
+		},
+		{
+			name: "disabled",
+			env:  []string{"HABANA_REQUIRE_DRIVER>=1.17", "HABANA_DISABLE_REQUIRE=true"},
+		},
+		{
+			name:    "invalid",
+			env:     []string{"HABANA_REQUIRE_KERNEL>=5.15"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqs, err := Requirements(Container{Env: EnvMap(tt.env), Annotations: tt.annotations})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			var got []string
+			if reqs != nil {
+				got = []string{}
+			}
+			for _, r := range reqs {
+				got = append(got, r.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPrivileged(t *testing.T) {
+	if !IsPrivileged([]string{"CAP_CHOWN", "CAP_SYS_ADMIN"}) {
+		t.Error("want privileged with CAP_SYS_ADMIN")
+	}
+	if IsPrivileged([]string{"CAP_CHOWN"}) || IsPrivileged(nil) {
+		t.Error("want unprivileged without CAP_SYS_ADMIN")
+	}
+}
+
+func TestEnvMap(t *testing.T) {
+	got := EnvMap([]string{"A=1", "B", "C=x=y", "A=2", "D="})
+	want := map[string]string{"A": "2", "C": "x=y", "D": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
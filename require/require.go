@@ -0,0 +1,283 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package require checks the requirements a container declares on the node:
+// the version of the habanalabs driver, and the type and the firmware version
+// of its devices. Images built for a release declare them, so they are
+// rejected with an explicit error on nodes they would crash on.
+//
+// A requirement is a name, an operator and a value, i.e "driver>=1.17". The
+// constraints separated by commas must all hold, and "|" separates
+// alternatives, any of which is enough: "driver>=1.17,<1.20" or
+// "device=gaudi2|gaudi3". A constraint without an operator is an equality.
+//
+// Versions are compared by their numeric components, and an equality matches
+// the versions starting with the value: "driver=1.17" matches 1.17.1.
+package require
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/discover"
+)
+
+const (
+	// Driver is the version of the habanalabs driver, i.e 1.17.0.
+	Driver = "driver"
+	// Firmware is the firmware version of the devices, i.e 51.2.0 for
+	// hl-gaudi2-1.17.0-fw-51.2.0-sec-9.
+	Firmware = "firmware"
+	// Device is the type of the devices, i.e gaudi3.
+	Device = "device"
+)
+
+// Operators, longest first so ">=" is not read as ">".
+var operators = []string{">=", "<=", "!=", "==", ">", "<", "="}
+
+var (
+	nameRE    = regexp.MustCompile(`^[A-Za-z0-9_]+`)
+	versionRE = regexp.MustCompile(`\d+(\.\d+)*`)
+)
+
+// Requirement is a constraint of a container on the node.
+type Requirement struct {
+	// Name of the checked property: Driver, Firmware or Device.
+	Name string
+	// Alternatives of constraints all holding.
+	alternatives [][]constraint
+	// Declaration, for errors.
+	decl string
+}
+
+type constraint struct {
+	op    string
+	value string
+}
+
+// String returns the requirement declaration, i.e "driver>=1.17".
+func (r Requirement) String() string {
+	return r.decl
+}
+
+// Parse returns the requirement of the declaration, i.e "driver>=1.17". The
+// name is case insensitive, and an equal sign between the name and the
+// operator is skipped, so "DRIVER=>=1.17" is the same requirement.
+func Parse(decl string) (Requirement, error) {
+	name := nameRE.FindString(decl)
+	rest := strings.TrimSpace(decl[len(name):])
+	r := Requirement{Name: strings.ToLower(name)}
+	if !slices.Contains([]string{Driver, Firmware, Device}, r.Name) {
+		return r, fmt.Errorf("invalid requirement %q: unknown name %q, want %s, %s or %s", decl, name, Driver, Firmware, Device)
+	}
+	if len(rest) > 1 && rest[0] == '=' && strings.ContainsRune("<>!=", rune(rest[1])) {
+		rest = rest[1:]
+	}
+	r.decl = r.Name + rest
+
+	for _, alt := range strings.Split(rest, "|") {
+		var constraints []constraint
+		for _, expr := range strings.Split(alt, ",") {
+			c, err := parseConstraint(r.Name, strings.TrimSpace(expr))
+			if err != nil {
+				return r, fmt.Errorf("invalid requirement %q: %w", decl, err)
+			}
+			constraints = append(constraints, c)
+		}
+		r.alternatives = append(r.alternatives, constraints)
+	}
+	return r, nil
+}
+
+func parseConstraint(name, expr string) (constraint, error) {
+	c := constraint{op: "="}
+	for _, op := range operators {
+		if value, ok := strings.CutPrefix(expr, op); ok {
+			c.op = op
+			expr = strings.TrimSpace(value)
+			break
+		}
+	}
+	if c.op == "==" {
+		c.op = "="
+	}
+	c.value = strings.ToLower(expr)
+
+	if c.value == "" {
+		return c, fmt.Errorf("missing value")
+	}
+	if name == Device {
+		if c.op != "=" && c.op != "!=" {
+			return c, fmt.Errorf("operator %s not supported for %s", c.op, name)
+		}
+		return c, nil
+	}
+	if versionRE.FindString(c.value) != c.value {
+		return c, fmt.Errorf("invalid version %q", c.value)
+	}
+	return c, nil
+}
+
+// Node is what the requirements are checked against.
+type Node struct {
+	// Version of the habanalabs driver. Empty when unknown.
+	Driver string
+	// Devices given to the container.
+	Devices []discover.Accelerator
+}
+
+// UnmetError is returned when the node does not meet a requirement.
+type UnmetError struct {
+	Requirement Requirement
+	// What the node has instead, i.e "driver version 1.16.2".
+	Got string
+}
+
+func (e *UnmetError) Error() string {
+	return fmt.Sprintf("requirement %s is not met: %s", e.Requirement, e.Got)
+}
+
+// Check returns an *UnmetError for the first requirement the node does not
+// meet. The device requirements must be met by all the devices.
+func Check(reqs []Requirement, n Node) error {
+	for _, r := range reqs {
+		switch r.Name {
+		case Driver:
+			if n.Driver == "" {
+				return &UnmetError{Requirement: r, Got: "driver version unknown"}
+			}
+			if !r.matches(n.Driver) {
+				return &UnmetError{Requirement: r, Got: "driver version " + n.Driver}
+			}
+		case Firmware:
+			for _, acc := range n.Devices {
+				if acc.Firmware == "" {
+					return &UnmetError{Requirement: r, Got: fmt.Sprintf("device %s firmware version unknown", acc.ID())}
+				}
+				if !r.matches(firmwareVersion(acc.Firmware)) {
+					return &UnmetError{Requirement: r, Got: fmt.Sprintf("device %s firmware %s", acc.ID(), acc.Firmware)}
+				}
+			}
+		case Device:
+			for _, acc := range n.Devices {
+				if !r.matches(acc.Type) {
+					return &UnmetError{Requirement: r, Got: fmt.Sprintf("device %s is a %s", acc.ID(), acc.Type)}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// firmwareVersion returns the firmware version of the firmware string, the
+// one following "fw-" when there is one.
+func firmwareVersion(firmware string) string {
+	if _, v, ok := strings.Cut(firmware, "fw-"); ok {
+		return v
+	}
+	return firmware
+}
+
+// matches reports whether one of the alternatives holds for the value.
+func (r Requirement) matches(value string) bool {
+	for _, alt := range r.alternatives {
+		if !slices.ContainsFunc(alt, func(c constraint) bool { return !c.holds(r.Name, value) }) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c constraint) holds(name, value string) bool {
+	if name == Device {
+		return (strings.ToLower(value) == c.value) == (c.op == "=")
+	}
+
+	v, want := parseVersion(value), parseVersion(c.value)
+	if v == nil {
+		return false
+	}
+	switch c.op {
+	case "=":
+		return prefixEqual(v, want)
+	case "!=":
+		return !prefixEqual(v, want)
+	}
+	cmp := compareVersions(v, want)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	}
+	return false
+}
+
+// parseVersion returns the numeric components of the first version in s, i.e
+// [1 17 0] for "1.17.0-a4e6b6c", or nil when there is none.
+func parseVersion(s string) []int {
+	match := versionRE.FindString(s)
+	if match == "" {
+		return nil
+	}
+	var v []int
+	for _, part := range strings.Split(match, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil
+		}
+		v = append(v, n)
+	}
+	return v
+}
+
+// prefixEqual reports whether the version v starts with the components of
+// prefix.
+func prefixEqual(v, prefix []int) bool {
+	for i, n := range prefix {
+		if component(v, i) != n {
+			return false
+		}
+	}
+	return true
+}
+
+// compareVersions compares the versions, the missing components being 0.
+func compareVersions(a, b []int) int {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		if d := component(a, i) - component(b, i); d != 0 {
+			if d < 0 {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func component(v []int, i int) int {
+	if i < len(v) {
+		return v[i]
+	}
+	return 0
+}
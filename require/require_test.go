@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package require
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/discover"
+)
+
+func TestParse(t *testing.T) {
+	for decl, want := range map[string]string{
+		"driver>=1.17":           "driver>=1.17",
+		"DRIVER=>=1.17":          "driver>=1.17",
+		"DRIVER==1.17":           "driver=1.17",
+		"driver=1.17":            "driver=1.17",
+		"firmware>=51.2, <52":    "firmware>=51.2, <52",
+		"DEVICE=gaudi2|gaudi3":   "device=gaudi2|gaudi3",
+		"device!=gaudi":          "device!=gaudi",
+		"driver>=1.17,<1.20|1.9": "driver>=1.17,<1.20|1.9",
+	} {
+		r, err := Parse(decl)
+		if err != nil {
+			t.Fatalf("%q: %v", decl, err)
+		}
+		if r.String() != want {
+			t.Errorf("%q: got %q, want %q", decl, r.String(), want)
+		}
+	}
+
+	for _, decl := range []string{"kernel>=5.15", "driver>=", "driver>=1.x", "device>=gaudi2", "driver=1.17,", ">=1.17"} {
+		if _, err := Parse(decl); err == nil {
+			t.Errorf("%q: got no error", decl)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	gaudi2 := discover.Accelerator{Index: 0, Type: "gaudi2", Firmware: "hl-gaudi2-1.17.0-fw-51.2.0-sec-9"}
+	gaudi3 := discover.Accelerator{Index: 1, Type: "gaudi3", Firmware: "hl-gaudi3-1.17.0-fw-51.2.0-sec-9"}
+	node := Node{Driver: "1.17.0-a4e6b6c", Devices: []discover.Accelerator{gaudi2, gaudi3}}
+
+	for decl, met := range map[string]bool{
+		"driver>=1.17":            true,
+		"driver>=1.17.1":          false,
+		"driver>1.16.9":           true,
+		"driver<1.17":             false,
+		"driver<=1.17":            true,
+		"driver=1.17":             true,
+		"driver=1.1":              false,
+		"driver!=1.17":            false,
+		"driver>=1.18|=1.17":      true,
+		"driver>=1.16,<1.17":      false,
+		"firmware>=51.2":          true,
+		"firmware>51.2":           false,
+		"device=gaudi2":           false,
+		"device=gaudi2|gaudi3":    true,
+		"device!=gaudi":           true,
+		"device=GAUDI3|GAUDI2":    true,
+		"device!=gaudi2,!=gaudi3": false,
+	} {
+		r, err := Parse(decl)
+		if err != nil {
+			t.Fatalf("%q: %v", decl, err)
+		}
+		err = Check([]Requirement{r}, node)
+		var unmet *UnmetError
+		if met && err != nil || !met && !errors.As(err, &unmet) {
+			t.Errorf("%q: got error %v, want met %t", decl, err, met)
+		}
+	}
+}
+
+func TestCheckUnknown(t *testing.T) {
+	driver, _ := Parse("driver>=1.17")
+	firmware, _ := Parse("firmware>=51")
+	node := Node{Devices: []discover.Accelerator{{Index: 2, Type: "gaudi2"}}}
+
+	for _, r := range []Requirement{driver, firmware} {
+		err := Check([]Requirement{r}, node)
+		var unmet *UnmetError
+		if !errors.As(err, &unmet) {
+			t.Errorf("%s: got error %v, want unmet", r, err)
+		}
+	}
+	if err := Check([]Requirement{driver}, Node{Driver: "1.16.2"}); err == nil || err.Error() != "requirement driver>=1.17 is not met: driver version 1.16.2" {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,365 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package selector parses the HABANA_VISIBLE_DEVICES values, and selects the
+// requested accelerators.
+//
+// A value is a comma separated list of terms:
+//
+//	all             all the accelerators
+//	none, void, ""  no accelerators. Cannot be combined with other terms
+//	N               accelerator index, as in /dev/accel/accelN
+//	N-M             accelerator indexes from N to M, inclusive
+//	0000:4d:00.0    PCI address. The domain is optional
+//	module:N        module ID (OAM)
+//	serial:S        serial number
+//	type:T          all the accelerators of the device type, i.e type:gaudi3
+//	count:N         N accelerators chosen by topology.Allocate. Cannot be
+//	                combined with other terms
+//
+// A term prefixed with '-' excludes the accelerators it matches. When a value
+// has only exclusions, they apply to all the accelerators, i.e "-2" is "all,-2".
+//
+// HABANA_VISIBLE_MODULES values are parsed with ParseModules, where the
+// numbers and ranges are module IDs instead of indexes.
+package selector
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/discover"
+	"github.com/HabanaAI/habana-container-runtime/topology"
+)
+
+const (
+	All  = "all"
+	None = "none"
+	Void = "void"
+)
+
+var pciAddressRe = regexp.MustCompile(`^([0-9a-fA-F]{4}:)?[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7]$`)
+
+type termKind int
+
+const (
+	termAll termKind = iota
+	termIndex
+	termPCI
+	termModule
+	termSerial
+	termType
+	termCount
+)
+
+type term struct {
+	raw     string
+	kind    termKind
+	exclude bool
+	// Inclusive index or module ID range, for index and module terms, and
+	// number of devices for count terms.
+	first, last int
+	// Value to match, for the other terms.
+	value string
+}
+
+// Selector is a parsed HABANA_VISIBLE_DEVICES or HABANA_VISIBLE_MODULES value.
+type Selector struct {
+	env   string
+	raw   string
+	terms []term
+}
+
+// Parse parses a HABANA_VISIBLE_DEVICES value. It fails on any invalid term.
+func Parse(value string) (*Selector, error) {
+	return parse("HABANA_VISIBLE_DEVICES", value, false)
+}
+
+// ParseModules parses a HABANA_VISIBLE_MODULES value, a comma separated list
+// of module IDs and module ID ranges, i.e "0-3,6". It fails on any invalid term.
+func ParseModules(value string) (*Selector, error) {
+	return parse("HABANA_VISIBLE_MODULES", value, true)
+}
+
+func parse(env, value string, modules bool) (*Selector, error) {
+	s := &Selector{env: env, raw: value}
+
+	value = strings.TrimSpace(value)
+	switch value {
+	case "", None, Void:
+		return s, nil
+	}
+
+	raws := strings.Split(value, ",")
+	for _, raw := range raws {
+		raw = strings.TrimSpace(raw)
+		t, err := parseTerm(raw)
+		if err == nil && modules && t.kind != termIndex {
+			err = fmt.Errorf("invalid module id %q", raw)
+		}
+		if err == nil && t.kind == termCount && len(raws) != 1 {
+			err = fmt.Errorf("%q cannot be combined with other devices", raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q: %w", env, s.raw, err)
+		}
+		if modules {
+			t.kind = termModule
+		}
+		s.terms = append(s.terms, t)
+	}
+	return s, nil
+}
+
+func parseTerm(raw string) (term, error) {
+	t := term{raw: raw}
+
+	value := raw
+	if v, ok := strings.CutPrefix(value, "-"); ok {
+		t.exclude = true
+		value = v
+	}
+
+	switch {
+	case value == "":
+		return t, fmt.Errorf("empty device")
+	case value == All:
+		if t.exclude {
+			return t, fmt.Errorf("cannot exclude %q", All)
+		}
+		t.kind = termAll
+	case value == None || value == Void:
+		return t, fmt.Errorf("%q cannot be combined with other devices", value)
+	case pciAddressRe.MatchString(value):
+		t.kind = termPCI
+		t.value = normalizePCIAddress(value)
+	case strings.Contains(value, ":"):
+		prefix, v, _ := strings.Cut(value, ":")
+		if v == "" {
+			return t, fmt.Errorf("missing value in %q", raw)
+		}
+		switch prefix {
+		case "module":
+			id, err := parseIndex(v)
+			if err != nil {
+				return t, fmt.Errorf("invalid module id %q", v)
+			}
+			t.kind = termModule
+			t.first, t.last = id, id
+		case "serial":
+			t.kind = termSerial
+		case "type":
+			t.kind = termType
+			v = strings.ToLower(v)
+		case "count":
+			n, err := parseIndex(v)
+			if err != nil || n == 0 || t.exclude {
+				return t, fmt.Errorf("invalid device count %q", raw)
+			}
+			t.kind = termCount
+			t.first = n
+		default:
+			return t, fmt.Errorf("unknown selector %q", prefix)
+		}
+		t.value = v
+	default:
+		t.kind = termIndex
+		first, last, isRange := strings.Cut(value, "-")
+		var err error
+		if t.first, err = parseIndex(first); err != nil {
+			return t, fmt.Errorf("invalid device %q", raw)
+		}
+		t.last = t.first
+		if isRange {
+			if t.last, err = parseIndex(last); err != nil {
+				return t, fmt.Errorf("invalid device range %q", raw)
+			}
+			if t.last < t.first {
+				return t, fmt.Errorf("invalid device range %q: end is lower than start", raw)
+			}
+		}
+	}
+	return t, nil
+}
+
+// parseIndex parses a non negative decimal number.
+func parseIndex(s string) (int, error) {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("not a number")
+		}
+	}
+	return strconv.Atoi(s)
+}
+
+// normalizePCIAddress returns the lower case PCI address with its domain.
+func normalizePCIAddress(addr string) string {
+	addr = strings.ToLower(addr)
+	if strings.Count(addr, ":") == 1 {
+		addr = "0000:" + addr
+	}
+	return addr
+}
+
+// String returns the value the selector was parsed from.
+func (s *Selector) String() string {
+	return s.raw
+}
+
+// IsNone reports whether the selector selects no accelerators at all.
+func (s *Selector) IsNone() bool {
+	return len(s.terms) == 0
+}
+
+// IsAll reports whether the selector is only "all".
+func (s *Selector) IsAll() bool {
+	return len(s.terms) == 1 && s.terms[0].kind == termAll
+}
+
+// Count returns the number of accelerators of a count selector, or 0.
+func (s *Selector) Count() int {
+	if len(s.terms) == 1 && s.terms[0].kind == termCount {
+		return s.terms[0].first
+	}
+	return 0
+}
+
+// Select returns the selected accelerators, in the order of the given ones.
+// It fails when a term does not match any accelerator. Count selectors choose
+// among the given accelerators, which should only be the free ones.
+func (s *Selector) Select(accelerators []discover.Accelerator) ([]discover.Accelerator, error) {
+	if s.IsNone() {
+		return nil, nil
+	}
+	if n := s.Count(); n != 0 {
+		devices, err := topology.Allocate(accelerators, n)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.env, err)
+		}
+		return devices, nil
+	}
+
+	included := make([]bool, len(accelerators))
+	excluded := make([]bool, len(accelerators))
+
+	hasInclusions := false
+	for _, t := range s.terms {
+		if !t.exclude {
+			hasInclusions = true
+		}
+	}
+	if !hasInclusions {
+		for i := range included {
+			included[i] = true
+		}
+	}
+
+	for _, t := range s.terms {
+		set := included
+		if t.exclude {
+			set = excluded
+		}
+
+		if t.kind == termIndex || t.kind == termModule {
+			// Every index or module ID of a range must exist. The lookup stops
+			// at the first missing one, so it is bounded by the number of
+			// accelerators whatever the range.
+			for id := t.first; id <= t.last; id++ {
+				found := false
+				for i, acc := range accelerators {
+					if accID, ok := t.id(acc); ok && accID == id {
+						set[i], found = true, true
+					}
+				}
+				if !found {
+					if t.kind == termModule {
+						return nil, fmt.Errorf("%s: module %d not found", s.env, id)
+					}
+					return nil, fmt.Errorf("%s: device %d not found", s.env, id)
+				}
+			}
+			continue
+		}
+
+		found := false
+		for i, acc := range accelerators {
+			if t.matches(acc) {
+				set[i], found = true, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: no device matches %q", s.env, t.raw)
+		}
+	}
+
+	var selected []discover.Accelerator
+	for i, acc := range accelerators {
+		if included[i] && !excluded[i] {
+			selected = append(selected, acc)
+		}
+	}
+	return selected, nil
+}
+
+// Matches reports whether the selector selects the accelerator. Unlike Select,
+// the terms do not have to match any accelerator, and count selectors match
+// none.
+func (s *Selector) Matches(acc discover.Accelerator) bool {
+	if s.Count() != 0 {
+		return false
+	}
+	included, hasInclusions := false, false
+	for _, t := range s.terms {
+		if t.exclude {
+			if t.matches(acc) {
+				return false
+			}
+			continue
+		}
+		hasInclusions = true
+		included = included || t.matches(acc)
+	}
+	return included || (!hasInclusions && !s.IsNone())
+}
+
+func (t term) matches(acc discover.Accelerator) bool {
+	switch t.kind {
+	case termAll:
+		return true
+	case termIndex, termModule:
+		id, ok := t.id(acc)
+		return ok && id >= t.first && id <= t.last
+	case termPCI:
+		return normalizePCIAddress(acc.PCIAddress) == t.value
+	case termSerial:
+		return acc.Serial == t.value
+	case termType:
+		return acc.Type == t.value
+	}
+	return false
+}
+
+// id returns the index or the module ID of the accelerator, for index and
+// module terms.
+func (t term) id(acc discover.Accelerator) (int, bool) {
+	if t.kind == termModule {
+		id, err := parseIndex(acc.ModuleID)
+		return id, err == nil
+	}
+	return acc.Index, true
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package selector
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/discover"
+)
+
+func testAccelerators() []discover.Accelerator {
+	var accelerators []discover.Accelerator
+	for i := 0; i < 4; i++ {
+		devType := "gaudi2"
+		if i == 3 {
+			devType = "gaudi3"
+		}
+		accelerators = append(accelerators, discover.Accelerator{
+			Index:      i,
+			PCIAddress: fmt.Sprintf("0000:%02x:00.0", 0x4d+i),
+			ModuleID:   fmt.Sprint(i + 4),
+			Serial:     fmt.Sprintf("AN%08d", i),
+			Type:       devType,
+		})
+	}
+	return accelerators
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []int
+	}{
+		{value: "all", want: []int{0, 1, 2, 3}},
+		{value: "", want: nil},
+		{value: "none", want: nil},
+		{value: "void", want: nil},
+		{value: "2", want: []int{2}},
+		{value: "2,0", want: []int{0, 2}},
+		{value: " 1 , 2 ", want: []int{1, 2}},
+		{value: "0-2", want: []int{0, 1, 2}},
+		{value: "1-1", want: []int{1}},
+		{value: "all,-2", want: []int{0, 1, 3}},
+		{value: "-2", want: []int{0, 1, 3}},
+		{value: "0-3,-1-2", want: []int{0, 3}},
+		{value: "0000:4e:00.0", want: []int{1}},
+		{value: "4F:00.0", want: []int{2}},
+		{value: "module:4,module:07", want: []int{0, 3}},
+		{value: "serial:AN00000002", want: []int{2}},
+		{value: "type:gaudi3", want: []int{3}},
+		{value: "type:GAUDI2,-module:5", want: []int{0, 2}},
+		{value: "count:2", want: []int{0, 1}},
+		{value: "count:3", want: []int{0, 1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			s, err := Parse(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.Select(testAccelerators())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var indexes []int
+			for _, acc := range got {
+				indexes = append(indexes, acc.Index)
+			}
+			if !reflect.DeepEqual(indexes, tt.want) {
+				t.Errorf("got %v, want %v", indexes, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, value := range []string{
+		"a",
+		"1,",
+		"1,,2",
+		"+1",
+		"3-1",
+		"1-",
+		"1-a",
+		"-all",
+		"all,none",
+		"0,void",
+		"module:",
+		"module:x",
+		"uuid:123",
+		"0000:4d:00.9",
+		"count:0",
+		"count:x",
+		"-count:1",
+		"count:1,2",
+	} {
+		t.Run(value, func(t *testing.T) {
+			if _, err := Parse(value); err == nil {
+				t.Errorf("Parse(%q) succeeded, want an error", value)
+			}
+		})
+	}
+}
+
+func TestSelectErrors(t *testing.T) {
+	for _, value := range []string{
+		"4",
+		"2-5",
+		"0-9223372036854775807",
+		"all,-7",
+		"0000:aa:00.0",
+		"module:1",
+		"serial:none",
+		"type:gaudi",
+		"count:5",
+	} {
+		t.Run(value, func(t *testing.T) {
+			s, err := Parse(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := s.Select(testAccelerators()); err == nil {
+				t.Errorf("Select(%q) = %v, want an error", value, got)
+			}
+		})
+	}
+}
+
+func TestSelectorKinds(t *testing.T) {
+	if s, _ := Parse("count:4"); s.Count() != 4 {
+		t.Errorf("got count %d, want 4", s.Count())
+	}
+	if s, _ := Parse("0-3"); s.Count() != 0 {
+		t.Errorf("got count %d, want 0", s.Count())
+	}
+
+	for value, want := range map[string][2]bool{
+		"":      {true, false},
+		"none":  {true, false},
+		"all":   {false, true},
+		"all,1": {false, false},
+		"0":     {false, false},
+	} {
+		s, err := Parse(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.IsNone() != want[0] || s.IsAll() != want[1] {
+			t.Errorf("%q: got none=%t all=%t, want none=%t all=%t", value, s.IsNone(), s.IsAll(), want[0], want[1])
+		}
+		if s.String() != value {
+			t.Errorf("got %q, want %q", s.String(), value)
+		}
+	}
+}
+
+func TestSelectModules(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{value: "4", want: []int{0}},
+		{value: "7,5", want: []int{1, 3}},
+		{value: "4-6", want: []int{0, 1, 2}},
+		{value: "-5", want: []int{0, 2, 3}},
+		{value: "none", want: nil},
+		{value: "3", wantErr: true},
+		{value: "6-8", wantErr: true},
+		{value: "0-999999999", wantErr: true},
+		{value: "4-9223372036854775807", wantErr: true},
+		{value: "-9223372036854775807-9223372036854775807", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			s, err := ParseModules(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.Select(testAccelerators())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			var indexes []int
+			for _, acc := range got {
+				indexes = append(indexes, acc.Index)
+			}
+			if !reflect.DeepEqual(indexes, tt.want) {
+				t.Errorf("got %v, want %v", indexes, tt.want)
+			}
+		})
+	}
+
+	for _, value := range []string{"all", "module:4", "0000:4d:00.0", "type:gaudi2", "count:2", "x"} {
+		if _, err := ParseModules(value); err == nil {
+			t.Errorf("ParseModules(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	accelerators := testAccelerators()
+	for value, want := range map[string][]int{
+		"0-7":          {0, 1, 2, 3},
+		"2,9":          {2},
+		"-1":           {0, 2, 3},
+		"all,-1-2":     {0, 3},
+		"module:5":     {1},
+		"type:gaudi3":  {3},
+		"serial:AN999": nil,
+		"none":         nil,
+		"count:2":      nil,
+	} {
+		s, err := Parse(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, acc := range accelerators {
+			if s.Matches(acc) {
+				got = append(got, acc.Index)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %v, want %v", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package topology chooses accelerators by count, so they can use the internal
+// scale-up links of the box, and are local to as few NUMA nodes as possible.
+package topology
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/HabanaAI/habana-container-runtime/discover"
+)
+
+// ErrInvalidGroup is returned when devices do not form a scale-up group.
+var ErrInvalidGroup = errors.New("devices do not form a scale-up group")
+
+// hlsGroups are the module IDs of the scale-up groups of an 8 cards HLS box,
+// by number of devices. Other numbers of devices cannot use the scale-up links
+// together.
+var hlsGroups = map[int][][]string{
+	2: {{"0", "1"}, {"2", "3"}, {"4", "5"}, {"6", "7"}},
+	4: {{"0", "1", "2", "3"}, {"4", "5", "6", "7"}},
+	8: {{"0", "1", "2", "3", "4", "5", "6", "7"}},
+}
+
+// groupsByType are the scale-up groups by device type.
+var groupsByType = map[string]map[int][][]string{
+	"gaudi":  hlsGroups,
+	"gaudi2": hlsGroups,
+	"gaudi3": hlsGroups,
+}
+
+// Groups returns the module IDs of the scale-up groups of n devices of the
+// type, or nil when there are none, as for a single device or an unknown type.
+func Groups(devType string, n int) [][]string {
+	return groupsByType[devType][n]
+}
+
+// Check returns ErrInvalidGroup when several devices of a type with scale-up
+// groups do not form one of them.
+func Check(devices []discover.Accelerator) error {
+	if len(devices) <= 1 {
+		return nil
+	}
+	if _, ok := groupsByType[devices[0].Type]; !ok {
+		return nil
+	}
+	groups := Groups(devices[0].Type, len(devices))
+	modules := discover.ModuleIDs(devices)
+	slices.Sort(modules)
+	for _, g := range groups {
+		if slices.Equal(modules, g) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: modules %s", ErrInvalidGroup, strings.Join(modules, ","))
+}
+
+// Allocate chooses n devices among the free ones. When the device type has
+// scale-up groups of n devices, the devices form one of them, otherwise they
+// are packed on as few NUMA nodes as possible. The devices are returned by index.
+func Allocate(free []discover.Accelerator, n int) ([]discover.Accelerator, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid device count %d", n)
+	}
+	if len(free) < n {
+		return nil, fmt.Errorf("%d devices requested, %d available", n, len(free))
+	}
+
+	// Groups are matched by module ID, which older drivers do not report.
+	var devices []discover.Accelerator
+	if groups := Groups(free[0].Type, n); groups != nil && len(discover.ModuleIDs(free)) == len(free) {
+		devices = allocateGroup(free, groups)
+		if devices == nil {
+			return nil, fmt.Errorf("%d devices requested, no free scale-up group among modules %s",
+				n, strings.Join(discover.ModuleIDs(free), ","))
+		}
+	} else {
+		devices = allocateNUMA(free, n)
+	}
+
+	slices.SortFunc(devices, func(a, b discover.Accelerator) int { return a.Index - b.Index })
+	return devices, nil
+}
+
+// allocateGroup returns the devices of the free group spanning the fewest NUMA
+// nodes, or nil when no group is free.
+func allocateGroup(free []discover.Accelerator, groups [][]string) []discover.Accelerator {
+	var best []discover.Accelerator
+	for _, g := range groups {
+		var devices []discover.Accelerator
+		for _, module := range g {
+			i := slices.IndexFunc(free, func(acc discover.Accelerator) bool { return acc.ModuleID == module })
+			if i < 0 {
+				devices = nil
+				break
+			}
+			devices = append(devices, free[i])
+		}
+		if devices != nil && (best == nil || numaSpread(devices) < numaSpread(best)) {
+			best = devices
+		}
+	}
+	return best
+}
+
+// allocateNUMA returns n devices from the NUMA node with the fewest free
+// devices that fits them all, so larger nodes are kept for larger requests.
+// Otherwise the devices are taken from the nodes with the most free devices.
+func allocateNUMA(free []discover.Accelerator, n int) []discover.Accelerator {
+	var nodes []int
+	byNode := make(map[int][]discover.Accelerator)
+	for _, acc := range free {
+		if _, ok := byNode[acc.NUMANode]; !ok {
+			nodes = append(nodes, acc.NUMANode)
+		}
+		byNode[acc.NUMANode] = append(byNode[acc.NUMANode], acc)
+	}
+
+	// Stable, so nodes with as many free devices are taken in discovery order.
+	slices.SortStableFunc(nodes, func(a, b int) int { return len(byNode[a]) - len(byNode[b]) })
+	for _, node := range nodes {
+		if len(byNode[node]) >= n {
+			return byNode[node][:n]
+		}
+	}
+
+	var devices []discover.Accelerator
+	for i := len(nodes) - 1; i >= 0 && len(devices) < n; i-- {
+		devs := byNode[nodes[i]]
+		devices = append(devices, devs[:min(len(devs), n-len(devices))]...)
+	}
+	return devices
+}
+
+func numaSpread(devices []discover.Accelerator) int {
+	nodes := make(map[int]struct{})
+	for _, acc := range devices {
+		nodes[acc.NUMANode] = struct{}{}
+	}
+	return len(nodes)
+}
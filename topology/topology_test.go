@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2022, HabanaLabs Ltd.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package topology
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/HabanaAI/habana-container-runtime/discover"
+)
+
+// hlsAccelerators returns the accelerators of an HLS box with the indexes,
+// where module IDs are the indexes, and modules 0-3 are on NUMA node 0.
+func hlsAccelerators(devType string, indexes ...int) []discover.Accelerator {
+	var accelerators []discover.Accelerator
+	for _, i := range indexes {
+		accelerators = append(accelerators, discover.Accelerator{
+			Index:    i,
+			ModuleID: fmt.Sprint(i),
+			Type:     devType,
+			NUMANode: i / 4,
+		})
+	}
+	return accelerators
+}
+
+func indexes(accelerators []discover.Accelerator) []int {
+	var ids []int
+	for _, acc := range accelerators {
+		ids = append(ids, acc.Index)
+	}
+	return ids
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name    string
+		free    []discover.Accelerator
+		n       int
+		want    []int
+		wantErr bool
+	}{
+		{
+			name: "single device on the busiest node",
+			free: hlsAccelerators("gaudi2", 0, 1, 2, 5),
+			n:    1,
+			want: []int{5},
+		},
+		{
+			name: "pair",
+			free: hlsAccelerators("gaudi2", 1, 2, 3, 4),
+			n:    2,
+			want: []int{2, 3},
+		},
+		{
+			name: "partition",
+			free: hlsAccelerators("gaudi2", 0, 1, 2, 4, 5, 6, 7),
+			n:    4,
+			want: []int{4, 5, 6, 7},
+		},
+		{
+			name:    "no free partition",
+			free:    hlsAccelerators("gaudi2", 0, 1, 2, 4, 5, 6),
+			n:       4,
+			wantErr: true,
+		},
+		{
+			name: "no scale-up group of three devices",
+			free: hlsAccelerators("gaudi3", 0, 4, 5, 6, 7),
+			n:    3,
+			want: []int{4, 5, 6},
+		},
+		{
+			name: "unknown type spans NUMA nodes",
+			free: hlsAccelerators("gaudi9", 1, 2, 3, 4, 5),
+			n:    4,
+			want: []int{1, 2, 3, 4},
+		},
+		{
+			name:    "not enough devices",
+			free:    hlsAccelerators("gaudi2", 0),
+			n:       2,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Allocate(tt.free, tt.n)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(indexes(got), tt.want) {
+				t.Errorf("got %v, want %v", indexes(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocateWithoutModuleIDs(t *testing.T) {
+	free := hlsAccelerators("gaudi2", 0, 1, 4)
+	for i := range free {
+		free[i].ModuleID = ""
+	}
+	got, err := Allocate(free, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 1}; !reflect.DeepEqual(indexes(got), want) {
+		t.Errorf("got %v, want %v", indexes(got), want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		devices []discover.Accelerator
+		valid   bool
+	}{
+		{devices: hlsAccelerators("gaudi2", 3), valid: true},
+		{devices: hlsAccelerators("gaudi2", 2, 3), valid: true},
+		{devices: hlsAccelerators("gaudi2", 7, 6, 5, 4), valid: true},
+		{devices: hlsAccelerators("gaudi2", 0, 1, 2, 3, 4, 5, 6, 7), valid: true},
+		{devices: hlsAccelerators("gaudi2", 1, 2), valid: false},
+		{devices: hlsAccelerators("gaudi2", 0, 1, 2), valid: false},
+		{devices: hlsAccelerators("gaudi9", 1, 2), valid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(indexes(tt.devices)), func(t *testing.T) {
+			err := Check(tt.devices)
+			if tt.valid && err != nil {
+				t.Errorf("got error %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidGroup) {
+				t.Errorf("got error %v, want %v", err, ErrInvalidGroup)
+			}
+		})
+	}
+}